@@ -0,0 +1,191 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Ban represents an identity banned by the administrator, the peers of the
+// identity will be rejected by the gateway until the ban removed.
+type Ban struct {
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Address   string            `json:"address"` // The primary virtual address when banned
+	Created   time.Time         `json:"created"`
+}
+
+// Key returns the hex encoded public key which identifies the ban
+func (b *Ban) Key() string {
+	return hex.EncodeToString(b.PublicKey)
+}
+
+// authorize verifies the admin key carried by the bearer token
+func (s *Server) authorize(r *http.Request) error {
+	if s.adminKey == "" {
+		return ErrorWithCode(message.StatusCode_KeyNotMatched, errors.New("admin API is disabled"))
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ErrorWithCode(message.StatusCode_KeyNotMatched, errors.New("admin key required"))
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminKey)) != 1 {
+		return ErrorWithCode(message.StatusCode_KeyNotMatched, errors.New("admin key mismatched"))
+	}
+	return nil
+}
+
+// peerOf returns the peer of the address in the request path
+func (s *Server) peerOf(r *http.Request) (*PeerInfo, error) {
+	addr := mux.Vars(r)["address"]
+	peer := s.Peer(addr)
+	if peer == nil {
+		return nil, ErrorWithCode(message.StatusCode_PeerNotFound, errors.Errorf("peer '%s' not found", addr))
+	}
+	return peer, nil
+}
+
+// ListPeers handles the admin request of listing all peers
+func (s *Server) ListPeers(r *http.Request) ([]*PeerInfo, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+	peers := s.storage.Peers()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].VirtAddress < peers[j].VirtAddress
+	})
+	if peers == nil {
+		peers = []*PeerInfo{}
+	}
+	return peers, nil
+}
+
+// GetPeer handles the admin request of fetching the peer, both the primary and
+// secondary virtual address of the peer are accepted.
+func (s *Server) GetPeer(r *http.Request) (*PeerInfo, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+	return s.peerOf(r)
+}
+
+// EvictPeer handles the admin request of evicting the peer. The peer will be
+// removed from the gateway and notified to exit, but it is able to join again.
+func (s *Server) EvictPeer(r *http.Request) (*PeerInfo, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	peer, err := s.peerOf(r)
+	if err == nil {
+		s.removePeer(peer)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	zap.L().Info("Evict peer", zap.String("peer", peer.VirtAddress), zap.String("remote", r.RemoteAddr))
+	s.notifier.Evict(peer, s.evictionAck(peer, message.StatusCode_PeerEvicted, "evicted by the administrator"))
+	return peer, nil
+}
+
+// BanPeer handles the admin request of banning the identity of the peer. The
+// peer will be evicted and all later requests of the identity will be rejected.
+func (s *Server) BanPeer(r *http.Request) (*Ban, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	peer, err := s.peerOf(r)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	ban := &Ban{
+		PublicKey: peer.PublicKey,
+		Address:   peer.VirtAddress,
+		Created:   time.Now(),
+	}
+	if err := s.storage.PutBan(ban); err != nil {
+		s.mu.Unlock()
+		return nil, ErrorWithCode(message.StatusCode_ServerInternal, err)
+	}
+	s.removePeer(peer)
+	s.mu.Unlock()
+
+	zap.L().Info("Ban peer", zap.String("peer", peer.VirtAddress), zap.String("key", ban.Key()), zap.String("remote", r.RemoteAddr))
+	s.notifier.Evict(peer, s.evictionAck(peer, message.StatusCode_PeerBanned, "banned by the administrator"))
+	return ban, nil
+}
+
+// evictionAck returns the heartbeat ack signed by the gateway, which notifies
+// the peer to exit with the code
+func (s *Server) evictionAck(peer *PeerInfo, code message.StatusCode, reason string) *message.CtrlHeartbeatAck {
+	ack := &message.CtrlHeartbeatAck{Code: code, Error: reason, HeartbeatNonce: peer.HeartbeatNonce}
+	s.SignHeartbeatAck(peer.VirtAddress, ack)
+	return ack
+}
+
+// ListBans handles the admin request of listing all banned identities
+func (s *Server) ListBans(r *http.Request) ([]*Ban, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+	bans := s.storage.Bans()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created.Before(bans[j].Created)
+	})
+	if bans == nil {
+		bans = []*Ban{}
+	}
+	return bans, nil
+}
+
+// Unban handles the admin request of removing the ban of the identity
+func (s *Server) Unban(r *http.Request) (*Ban, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+	key := mux.Vars(r)["key"]
+	ban, found := s.storage.Ban(key)
+	if !found {
+		return nil, ErrorWithCode(message.StatusCode_PeerNotFound, errors.Errorf("ban '%s' not found", key))
+	}
+	if err := s.storage.DeleteBan(key); err != nil {
+		return nil, ErrorWithCode(message.StatusCode_ServerInternal, err)
+	}
+
+	zap.L().Info("Unban identity", zap.String("key", key), zap.String("remote", r.RemoteAddr))
+	return ban, nil
+}
+
+// banned reports whether the identity is banned by the administrator
+func (s *Server) banned(public ed25519.PublicKey) bool {
+	_, found := s.storage.Ban(hex.EncodeToString(public))
+	return found
+}
@@ -15,10 +15,16 @@ package api
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lonng/zetamesh/version"
 	"github.com/pkg/errors"
@@ -26,9 +32,10 @@ import (
 
 // Client is used to access with the remote gateway
 type Client struct {
-	gateway string
-	key     string
-	tls     bool
+	gateway  string
+	key      string
+	adminKey string
+	tls      bool
 }
 
 // NewClient returns a new client instance which can be used to interact
@@ -41,21 +48,97 @@ func NewClient(gateway, key string, tls bool) *Client {
 	}
 }
 
-// OpenTunnel request the server to open tunnel between the two peers.
-// The source and destionation virtual network address need to be provided.
-func (c *Client) OpenTunnel(src, dst string) error {
-	req := OpenTunnelRequest{
-		Version:     version.NewVersion().String(),
-		Source:      src,
-		Destination: dst,
+// Lease requests the gateway to allocate an address for the identity. The same
+// address will be returned if the identity has been allocated before.
+func (c *Client) Lease(identity ed25519.PrivateKey) (*LeaseResponse, error) {
+	req := LeaseRequest{
+		Version:   version.NewVersion().String(),
+		PublicKey: identity.Public().(ed25519.PublicKey),
+		Timestamp: time.Now().UnixNano(),
 	}
-	res := OpenTunnelResponse{}
-	err := c.post(URIOpenTunnel, req, &res)
+	timestamp := strconv.FormatInt(req.Timestamp, 10)
+	req.Proof = SignIdentity(identity, URILease, timestamp)
+	if c.key != "" {
+		req.Algorithm = AlgorithmHMACSHA256
+		req.Nonce = NewNonce()
+		req.Cipher = hex.EncodeToString(Sign(c.key, req.Nonce, req.Version, string(req.PublicKey), timestamp))
+	}
+	res := &LeaseResponse{}
+	err := c.post(URILease, req, res)
 	if err != nil {
-		return errors.WithMessage(err, "open tunnel failed")
+		return nil, errors.WithMessage(err, "lease address failed")
 	}
 
-	return nil
+	return res, nil
+}
+
+// NewAdminClient returns a new client instance which can be used to access the
+// admin API of the gateway with the admin key.
+func NewAdminClient(gateway, adminKey string, tls bool) *Client {
+	return &Client{
+		gateway:  gateway,
+		adminKey: adminKey,
+		tls:      tls,
+	}
+}
+
+// Peers returns all peers registered in the gateway
+func (c *Client) Peers() ([]*PeerInfo, error) {
+	var res []*PeerInfo
+	if err := c.get(URIPeers, &res); err != nil {
+		return nil, errors.WithMessage(err, "list peers failed")
+	}
+	return res, nil
+}
+
+// Peer returns the peer of the virtual address
+func (c *Client) Peer(virtAddr string) (*PeerInfo, error) {
+	res := &PeerInfo{}
+	if err := c.get(peerURI(URIPeer, virtAddr), res); err != nil {
+		return nil, errors.WithMessage(err, "get peer failed")
+	}
+	return res, nil
+}
+
+// EvictPeer removes the peer of the virtual address from the gateway
+func (c *Client) EvictPeer(virtAddr string) (*PeerInfo, error) {
+	res := &PeerInfo{}
+	if err := c.do(http.MethodDelete, peerURI(URIPeer, virtAddr), nil, res); err != nil {
+		return nil, errors.WithMessage(err, "evict peer failed")
+	}
+	return res, nil
+}
+
+// BanPeer bans the identity of the peer of the virtual address
+func (c *Client) BanPeer(virtAddr string) (*Ban, error) {
+	res := &Ban{}
+	if err := c.do(http.MethodPost, peerURI(URIPeerBan, virtAddr), nil, res); err != nil {
+		return nil, errors.WithMessage(err, "ban peer failed")
+	}
+	return res, nil
+}
+
+// Bans returns all banned identities
+func (c *Client) Bans() ([]*Ban, error) {
+	var res []*Ban
+	if err := c.get(URIBans, &res); err != nil {
+		return nil, errors.WithMessage(err, "list bans failed")
+	}
+	return res, nil
+}
+
+// Unban removes the ban of the identity, the key is the hex encoded public key
+func (c *Client) Unban(key string) (*Ban, error) {
+	res := &Ban{}
+	uri := strings.Replace(URIBan, "{key}", url.PathEscape(key), 1)
+	if err := c.do(http.MethodDelete, uri, nil, res); err != nil {
+		return nil, errors.WithMessage(err, "unban failed")
+	}
+	return res, nil
+}
+
+func peerURI(pattern, virtAddr string) string {
+	return strings.Replace(pattern, "{address}", url.PathEscape(virtAddr), 1)
 }
 
 func (c *Client) do(method, api string, reader io.Reader, res interface{}) error {
@@ -70,18 +153,26 @@ func (c *Client) do(method, api string, reader io.Reader, res interface{}) error
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	defer request.Body.Close()
 
 	// Set the request headers
 	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if c.adminKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.adminKey)
+	}
 
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	defer resp.Body.Close()
 
+	// The failed response carries the status code in the body
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+		result := &Result{}
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil || isSuccess(result.Code) {
+			return errors.New(resp.Status)
+		}
+		return ErrorWithCode(result.Code, errors.New(result.Error))
 	}
 
 	result := &Result{Data: res}
@@ -97,7 +188,6 @@ func (c *Client) do(method, api string, reader io.Reader, res interface{}) error
 	return nil
 }
 
-//nolint:unused
 func (c *Client) get(api string, res interface{}) error {
 	return c.do(http.MethodGet, api, nil, res)
 }
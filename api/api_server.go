@@ -14,11 +14,18 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
+	"github.com/lonng/zetamesh/constant"
 	"github.com/lonng/zetamesh/message"
 	"github.com/lonng/zetamesh/version"
 	"github.com/pkg/errors"
@@ -28,95 +35,542 @@ import (
 type (
 	// PeerInfo represents the peer of the Zetamesh system.
 	PeerInfo struct {
-		VirtAddress   string    `json:"virt_address"`
-		UDPAddress    string    `json:"udp_address"`
-		LastHeartbeat time.Time `json:"-"`
+		VirtAddress   string                  `json:"virt_address"`         // The primary virtual address
+		Addresses     []string                `json:"addresses"`            // All virtual addresses, e.g: IPv4 and IPv6
+		UDPAddress    string                  `json:"udp_address"`          // The server reflexive address observed by the gateway
+		Candidates    []*message.Candidate    `json:"candidates,omitempty"` // The candidates reported by the peer
+		PublicKey     ed25519.PublicKey       `json:"public_key"`
+		Version       string                  `json:"version"`
+		NATType       string                  `json:"nat_type"`         // The NAT behavior detected by the peer
+		Relays        []*message.RelayLatency `json:"relays,omitempty"` // The relay servers bound by the peer
+		Offline       bool                    `json:"offline"`          // No heartbeat received for a while
+		LastHeartbeat time.Time               `json:"last_heartbeat"`
+		Timestamp     int64                   `json:"timestamp"` // The timestamp of the last accepted heartbeat
+
+		// The nonce of the last accepted heartbeat, which is echoed by the acks
+		// sent without a heartbeat, e.g: the eviction
+		HeartbeatNonce string `json:"-"`
 	}
 
 	// Notifier represents a notifier which is used to synchronize
 	// the peer information to the remote peer when any of the peer
 	// tries to establish a connection between the them.
 	Notifier interface {
-		OpenTunnel(src, dst *PeerInfo)
+		// OpenTunnel notifies both peers and returns after they acknowledged
+		OpenTunnel(src, dst *PeerInfo) error
+		// Evict notifies the peer removed by the administrator to exit with the
+		// signed heartbeat ack
+		Evict(peer *PeerInfo, ack *message.CtrlHeartbeatAck)
+		// UpdatePeer notifies the other peers that the peer has changed its
+		// network, it must not block because the caller holds the lock
+		UpdatePeer(peer *PeerInfo)
+	}
+
+	// ServerOptions represents the options of the gateway server
+	ServerOptions struct {
+		Key            string
+		AdminKey       string // The admin API is disabled if not specified
+		Networks       []*net.IPNet
+		LeaseDuration  time.Duration
+		OfflineTimeout time.Duration // The peer is marked offline if no heartbeat received in the duration
+		ExpireTimeout  time.Duration // The peer is removed if no heartbeat received in the duration
+		Storage        Storage       // The registry storage, the memory storage is used if not specified
 	}
 
 	// Server represents the HTTP server which serves for current
 	// gateway.
 	Server struct {
-		notifier Notifier // Notifier is used to notify the peers of current tunnel
-		key      string   // The key of gateway
-		peers    sync.Map // All peers connected to the gateway
+		notifier       Notifier      // Notifier is used to notify the peers of current tunnel
+		key            string        // The key of gateway
+		adminKey       string        // The key of admin API
+		offlineTimeout time.Duration // The duration of missed heartbeats before marking the peer offline
+		expireTimeout  time.Duration // The duration of missed heartbeats before removing the peer
+		mu             sync.Mutex    // Serializes the updates of peers, the peers are read without lock
+		storage        Storage       // All peers connected to the gateway and the address leases
+		aliases        sync.Map      // The secondary virtual address -> primary virtual address
+		leases         []*leasePool  // The addresses allocated to peers joined without address
+		nonces         *nonceWindow  // The recent nonces of the signed packets of each peer
 	}
 )
 
 // NewServer returns a new gateway server instance and the gateway server is
-// used to handle the HTTP request and store the peer information.
-func NewServer(notifier Notifier, key string) *Server {
-	return &Server{
-		notifier: notifier,
-		key:      key,
+// used to handle the HTTP request and store the peer information. The addresses
+// of networks are leased to the peers joined without address, and a peer will
+// get one address of each network, e.g: an IPv4 address and an IPv6 address.
+func NewServer(notifier Notifier, opt ServerOptions) *Server {
+	storage := opt.Storage
+	if storage == nil {
+		storage = NewMemoryStorage()
+	}
+	s := &Server{
+		notifier:       notifier,
+		key:            opt.Key,
+		adminKey:       opt.AdminKey,
+		offlineTimeout: opt.OfflineTimeout,
+		expireTimeout:  opt.ExpireTimeout,
+		storage:        storage,
+		nonces:         newNonceWindow(),
+	}
+	for _, network := range opt.Networks {
+		s.leases = append(s.leases, newLeasePool(network, opt.LeaseDuration, storage))
 	}
+	// Rebuild the aliases of the peers restored from the storage
+	for _, peer := range storage.Peers() {
+		s.updateAliases(peer, nil)
+	}
+	return s
 }
 
-// OpenTunnel handles the `OpenTunnelRequest` POST request. It will validate the
-// client information of `Version/Key` and notify the two endpoint if the peer
-// validation successfully.
-func (s *Server) OpenTunnel(req *OpenTunnelRequest) (*OpenTunnelResponse, error) {
-	ver, err := semver.NewVersion(req.Version)
-	if err != nil {
-		return nil, ErrorWithCode(message.StatusCode_InvalidVersion, errors.WithStack(err))
+// OpenTunnel notifies the two peers to open the tunnel between them, which is
+// requested by the source peer via its control stream. The error is returned
+// if any peer failed to acknowledge the notification.
+func (s *Server) OpenTunnel(source, destination string) error {
+	src := s.Peer(source)
+	if src == nil {
+		return errors.Errorf("source peer '%s' not found in cache", source)
+	}
+	// The peer removed by the reaper is offline as well
+	dst := s.Peer(destination)
+	if dst == nil || dst.Offline {
+		err := errors.Errorf("destination peer '%s' is offline", destination)
+		return ErrorWithCode(message.StatusCode_PeerOffline, err)
 	}
+	return s.notifier.OpenTunnel(src, dst)
+}
 
-	if ver.Major < version.MajorVersion {
-		err := errors.Errorf("client version %s doesn't match the server version %s", req.Version, version.NewVersion().String())
-		return nil, ErrorWithCode(message.StatusCode_VersionTooOld, err)
+// Lease handles the `LeaseRequest` POST request. It allocates an address of
+// the virtual network to the identity of the peer, and the same address will be
+// returned if the identity has been allocated before.
+func (s *Server) Lease(req *LeaseRequest) (*LeaseResponse, error) {
+	if err := s.checkVersion(req.Version); err != nil {
+		return nil, err
 	}
 
-	// TODO: check encryption
+	timestamp := strconv.FormatInt(req.Timestamp, 10)
+	if err := s.verifyRequest(req.Algorithm, req.Nonce, req.Cipher, req.Version, string(req.PublicKey), timestamp); err != nil {
+		return nil, ErrorWithCode(message.StatusCode_KeyNotMatched, err)
+	}
+	if !VerifyIdentity(req.PublicKey, req.Proof, URILease, timestamp) {
+		return nil, ErrorWithCode(message.StatusCode_KeyNotMatched, errors.New("invalid identity proof"))
+	}
+	// The proof is bound to the timestamp, which is accepted only once
+	if !s.nonces.accept(URILease+"/"+hex.EncodeToString(req.PublicKey), timestamp, req.Timestamp) {
+		return nil, ErrorWithCode(message.StatusCode_KeyNotMatched, errors.New("stale or replayed identity proof"))
+	}
+	if s.banned(req.PublicKey) {
+		return nil, ErrorWithCode(message.StatusCode_PeerBanned, errors.New("identity is banned"))
+	}
 
-	src := s.Peer(req.Source)
-	if src == nil {
-		return nil, errors.Errorf("source peer '%s' not found in cache", req.Source)
+	inUse := func(addr string) bool {
+		return s.Peer(addr) != nil
+	}
+	reclaim := func(addr string) {
+		zap.L().Info("Reclaim expired lease", zap.String("peer", addr))
+		if peer := s.Peer(addr); peer != nil {
+			s.removePeer(peer)
+		}
 	}
-	dst := s.Peer(req.Destination)
-	if dst == nil {
-		return nil, errors.Errorf("destination peer '%s' not found in cache", req.Destination)
+
+	// The reclaim may remove the peer which requires the lock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &LeaseResponse{}
+	for _, pool := range s.leases {
+		lease, err := pool.allocate(req.PublicKey, inUse, reclaim)
+		if err != nil {
+			return nil, err
+		}
+		ones, _ := pool.network.Mask.Size()
+		res.Addresses = append(res.Addresses, fmt.Sprintf("%s/%d", lease.Address, ones))
+		res.Expire = lease.Expire.Unix()
 	}
-	s.notifier.OpenTunnel(src, dst)
 
-	return &OpenTunnelResponse{}, nil
+	zap.L().Info("Lease address", zap.Strings("addresses", res.Addresses), zap.Int64("expire", res.Expire))
+
+	return res, nil
 }
 
 // Heartbeat handles the peer heartbeat packet and update the peer information
-// to the latest to keep it up to date.
-func (s *Server) Heartbeat(remote *net.UDPAddr, heartbeat *message.CtrlHeartbeat) {
-	val, found := s.peers.Load(heartbeat.VirtAddress)
-	if found {
-		peer := val.(*PeerInfo)
-		dest := remote.String()
-		peer.LastHeartbeat = time.Now()
-		if peer.UDPAddress != dest {
-			peer.UDPAddress = dest
-		}
-		return
+// to the latest to keep it up to date. The virtual addresses are bound to the
+// identity of the first registered peer and all later heartbeats of the address
+// must be signed by the same identity, otherwise the `AddConflicted` error will
+// be returned.
+func (s *Server) Heartbeat(remote net.Addr, heartbeat *message.CtrlHeartbeat) error {
+	addresses, err := s.admit(remote, heartbeat)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.bindAddresses(remote, heartbeat, addresses); err != nil {
+		return err
 	}
 
-	zap.L().Info("New peer added", zap.String("peer", heartbeat.VirtAddress), zap.Stringer("remote", remote))
+	// The peer information is never modified in place because it is read
+	// without lock, a new copy will be stored instead.
+	peer := newPeer(heartbeat, addresses)
+	peer.UDPAddress = remote.String()
+	peer.HeartbeatNonce = heartbeat.Nonce
+
+	// The address is bound to the identity of the new peer atomically
+	current, loaded, err := s.storage.LoadOrStorePeer(peer)
+	if err != nil {
+		zap.L().Error("Persist peer failed", zap.String("peer", peer.VirtAddress), zap.Error(err))
+	}
+	if !loaded {
+		zap.L().Info("New peer added", zap.String("peer", heartbeat.VirtAddress), zap.Strings("addresses", addresses), zap.Stringer("remote", remote))
+		s.updateAliases(peer, nil)
+		return nil
+	}
+	if !bytes.Equal(current.PublicKey, heartbeat.PublicKey) {
+		err := errors.Errorf("address '%s' is owned by another identity, heartbeat from %s rejected", heartbeat.VirtAddress, remote)
+		return ErrorWithCode(message.StatusCode_AddConflicted, err)
+	}
+	// Reject the replayed heartbeat packets
+	if heartbeat.Timestamp <= current.Timestamp {
+		return errors.Errorf("stale heartbeat of peer '%s' from %s", heartbeat.VirtAddress, remote)
+	}
+	if current.Offline {
+		zap.L().Info("Peer back online", zap.String("peer", heartbeat.VirtAddress), zap.Stringer("remote", remote))
+	}
+	if err := s.storage.PutPeer(peer); err != nil {
+		zap.L().Error("Persist peer failed", zap.String("peer", peer.VirtAddress), zap.Error(err))
+	}
+	s.updateAliases(peer, current.Addresses)
 
-	peer := &PeerInfo{
+	// The peers connected to the peer must open the tunnel to its new candidates
+	if networkChanged(current, peer) {
+		s.notifier.UpdatePeer(peer)
+	}
+	return nil
+}
+
+// admit authenticates the heartbeat and checks the version and the addresses
+// of the peer, and returns the addresses claimed by the peer
+func (s *Server) admit(remote net.Addr, heartbeat *message.CtrlHeartbeat) ([]string, error) {
+	if err := s.verifyHeartbeat(remote, heartbeat); err != nil {
+		return nil, err
+	}
+	// The heartbeat binds the address to the identity before any other request,
+	// so the incompatible nodes must be rejected here as well
+	if err := s.checkVersion(heartbeat.Version); err != nil {
+		return nil, err
+	}
+	addresses := heartbeat.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{heartbeat.VirtAddress}
+	}
+	if err := s.checkAddresses(heartbeat.VirtAddress, addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// bindAddresses renews the leases of the addresses and rejects the addresses
+// owned by another identity, the previous peer is removed if the peer has
+// changed its primary address. The caller must hold the lock.
+func (s *Server) bindAddresses(remote net.Addr, heartbeat *message.CtrlHeartbeat, addresses []string) error {
+	for _, addr := range addresses {
+		// Renew the lease if the address is allocated by the gateway
+		if !s.renewLease(addr, heartbeat.PublicKey) {
+			err := errors.Errorf("address '%s' is leased to another identity, heartbeat from %s rejected", addr, remote)
+			return ErrorWithCode(message.StatusCode_AddConflicted, err)
+		}
+
+		owner := s.Peer(addr)
+		if owner == nil {
+			continue
+		}
+		// Keep the original owner and reject the newcomer
+		if !bytes.Equal(owner.PublicKey, heartbeat.PublicKey) {
+			err := errors.Errorf("address '%s' is owned by another identity, heartbeat from %s rejected", addr, remote)
+			return ErrorWithCode(message.StatusCode_AddConflicted, err)
+		}
+		// The peer has changed its primary address
+		if owner.VirtAddress != heartbeat.VirtAddress {
+			s.removePeer(owner)
+		}
+	}
+	return nil
+}
+
+// newPeer returns the peer information claimed by the heartbeat
+func newPeer(heartbeat *message.CtrlHeartbeat, addresses []string) *PeerInfo {
+	return &PeerInfo{
 		VirtAddress:   heartbeat.VirtAddress,
-		UDPAddress:    remote.String(),
+		Addresses:     addresses,
+		Candidates:    validCandidates(heartbeat.Candidates),
+		PublicKey:     heartbeat.PublicKey,
+		Version:       heartbeat.Version,
+		NATType:       heartbeat.NatType.String(),
+		Relays:        validRelays(heartbeat.RelayLatencies),
 		LastHeartbeat: time.Now(),
+		Timestamp:     heartbeat.Timestamp,
 	}
-	s.peers.Store(heartbeat.VirtAddress, peer)
+}
+
+// networkChanged reports whether the peer has changed the addresses which are
+// used by the other peers to open the tunnel
+func networkChanged(prev, peer *PeerInfo) bool {
+	return prev.UDPAddress != peer.UDPAddress || prev.NATType != peer.NATType ||
+		CandidatesField(prev.AllCandidates()) != CandidatesField(peer.AllCandidates())
+}
+
+// Register authenticates the control stream of the peer with the heartbeat
+// signed by the peer, which is checked as the heartbeats. The peer is added by
+// the registration if unknown, e.g: the gateway restarted, but its UDP address
+// is unknown until its heartbeat accepted because the observed address of the
+// control stream is useless to the peers. The registration must be newer than
+// the last accepted heartbeat or registration to prevent it from being replayed.
+func (s *Server) Register(remote net.Addr, heartbeat *message.CtrlHeartbeat) error {
+	addresses, err := s.admit(remote, heartbeat)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.bindAddresses(remote, heartbeat, addresses); err != nil {
+		return err
+	}
+
+	peer := newPeer(heartbeat, addresses)
+	current, loaded, err := s.storage.LoadOrStorePeer(peer)
+	if err != nil {
+		zap.L().Error("Persist peer failed", zap.String("peer", peer.VirtAddress), zap.Error(err))
+	}
+	if !loaded {
+		zap.L().Info("New peer added by control stream", zap.String("peer", heartbeat.VirtAddress), zap.Strings("addresses", addresses), zap.Stringer("remote", remote))
+		s.updateAliases(peer, nil)
+		return nil
+	}
+	if !bytes.Equal(current.PublicKey, heartbeat.PublicKey) {
+		err := errors.Errorf("address '%s' is owned by another identity, registration from %s rejected", heartbeat.VirtAddress, remote)
+		return ErrorWithCode(message.StatusCode_AddConflicted, err)
+	}
+	if heartbeat.Timestamp <= current.Timestamp {
+		err := errors.Errorf("stale registration of peer '%s' from %s", heartbeat.VirtAddress, remote)
+		return ErrorWithCode(message.StatusCode_KeyNotMatched, err)
+	}
+	registered := *current
+	registered.Timestamp = heartbeat.Timestamp
+	if err := s.storage.PutPeer(&registered); err != nil {
+		zap.L().Error("Persist peer failed", zap.String("peer", current.VirtAddress), zap.Error(err))
+	}
+	return nil
+}
+
+// verifyHeartbeat verifies the signature and the identity proof of the heartbeat.
+// The unauthenticated heartbeats are rejected without status code, so they are
+// dropped silently instead of answered with a signed error to the source address,
+// which may be spoofed to make another node exit.
+func (s *Server) verifyHeartbeat(remote net.Addr, heartbeat *message.CtrlHeartbeat) error {
+	if !s.Authenticate(heartbeat.Nonce, heartbeat.Signature, HeartbeatFields(heartbeat)...) {
+		return errors.Errorf("heartbeat of peer '%s' from %s signed with mismatched key", heartbeat.VirtAddress, remote)
+	}
+
+	if !VerifyIdentity(heartbeat.PublicKey, heartbeat.Proof, IdentityFields(heartbeat)...) {
+		return errors.Errorf("heartbeat of peer '%s' from %s has invalid identity proof", heartbeat.VirtAddress, remote)
+	}
+	if s.banned(heartbeat.PublicKey) {
+		err := errors.Errorf("heartbeat of peer '%s' from %s signed by banned identity", heartbeat.VirtAddress, remote)
+		return ErrorWithCode(message.StatusCode_PeerBanned, err)
+	}
+
+	// The node signs the address observed by the gateway once it learned it, so
+	// the heartbeat cannot be forwarded by others from another address
+	if udp, ok := remote.(*net.UDPAddr); ok && heartbeat.Endpoint != "" && heartbeat.Endpoint != udp.String() {
+		return errors.Errorf("heartbeat of peer '%s' signed for %s received from %s", heartbeat.VirtAddress, heartbeat.Endpoint, remote)
+	}
+	if !s.nonces.accept(heartbeat.VirtAddress, heartbeat.Nonce, heartbeat.Timestamp) {
+		return errors.Errorf("replayed heartbeat of peer '%s' from %s", heartbeat.VirtAddress, remote)
+	}
+	return nil
+}
+
+// SignHeartbeatAck signs the heartbeat ack to the peer with the key of the
+// gateway, so the peer only acts on the error codes sent by the gateway
+func (s *Server) SignHeartbeatAck(virtAddress string, ack *message.CtrlHeartbeatAck) {
+	ack.VirtAddress = virtAddress
+	ack.Timestamp = time.Now().UnixNano()
+	ack.Nonce = NewNonce()
+	ack.Signature = Sign(s.key, ack.Nonce, HeartbeatAckFields(ack)...)
+}
+
+// AuthenticateRelay reports whether the relay packet is signed with the key of
+// the gateway and not replayed
+func (s *Server) AuthenticateRelay(relay *message.CtrlRelay) bool {
+	if !s.Authenticate(relay.Nonce, relay.Signature, RelayFields(relay)...) {
+		return false
+	}
+	return s.nonces.accept(relayNonces(relay.Source), relay.Nonce, relay.Timestamp)
+}
+
+// Reap marks the peers offline if they missed heartbeats for the offline
+// timeout, and removes the peers missed heartbeats for the expire timeout
+// and the expired leases. It blocks until the context done.
+func (s *Server) Reap(ctx context.Context) {
+	ticker := time.NewTicker(constant.PeerReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.reap(now)
+		}
+	}
+}
+
+func (s *Server) reap(now time.Time) {
+	s.nonces.expire(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pool := range s.leases {
+		pool.reap(now)
+	}
+
+	for _, peer := range s.storage.Peers() {
+		silence := now.Sub(peer.LastHeartbeat)
+		switch {
+		case silence >= s.expireTimeout:
+			zap.L().Info("Remove expired peer", zap.String("peer", peer.VirtAddress), zap.Duration("silence", silence))
+			s.removePeer(peer)
+		case silence >= s.offlineTimeout && !peer.Offline:
+			zap.L().Info("Peer offline", zap.String("peer", peer.VirtAddress), zap.Duration("silence", silence))
+			offline := *peer
+			offline.Offline = true
+			if err := s.storage.PutPeer(&offline); err != nil {
+				zap.L().Error("Persist peer failed", zap.String("peer", peer.VirtAddress), zap.Error(err))
+			}
+		}
+	}
+}
+
+// updateAliases points the addresses of the peer to its primary address and
+// removes the previous addresses which are not owned by the peer anymore
+func (s *Server) updateAliases(peer *PeerInfo, previous []string) {
+	for _, addr := range previous {
+		if primary, found := s.aliases.Load(addr); found && primary == peer.VirtAddress {
+			s.aliases.Delete(addr)
+		}
+	}
+	for _, addr := range peer.Addresses {
+		if addr != peer.VirtAddress {
+			s.aliases.Store(addr, peer.VirtAddress)
+		}
+	}
+}
+
+// removePeer removes the peer and its aliases, the caller must hold the lock
+func (s *Server) removePeer(peer *PeerInfo) {
+	for _, addr := range peer.Addresses {
+		if primary, found := s.aliases.Load(addr); found && primary == peer.VirtAddress {
+			s.aliases.Delete(addr)
+		}
+	}
+	if err := s.storage.DeletePeer(peer.VirtAddress); err != nil {
+		zap.L().Error("Delete peer from storage failed", zap.String("peer", peer.VirtAddress), zap.Error(err))
+	}
+}
+
+func (s *Server) renewLease(addr string, public ed25519.PublicKey) bool {
+	for _, pool := range s.leases {
+		if !pool.renew(addr, public) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticate reports whether the signature of the fields matches the key of
+// the gateway. All packets are accepted if the gateway is started without key.
+func (s *Server) Authenticate(nonce string, signature []byte, fields ...string) bool {
+	if s.key == "" {
+		return true
+	}
+	return Verify(s.key, nonce, signature, fields...)
+}
+
+func (s *Server) verifyRequest(algorithm, nonce, cipher string, fields ...string) error {
+	if s.key == "" {
+		return nil
+	}
+	if algorithm != AlgorithmHMACSHA256 {
+		return errors.Errorf("unsupported signature algorithm '%s'", algorithm)
+	}
+	signature, err := hex.DecodeString(cipher)
+	if err != nil {
+		return errors.WithMessage(err, "malformed signature")
+	}
+	if !s.Authenticate(nonce, signature, fields...) {
+		return errors.New("request signature mismatched")
+	}
+	return nil
+}
+
+func (s *Server) checkVersion(v string) error {
+	ver, err := semver.NewVersion(v)
+	if err != nil {
+		return ErrorWithCode(message.StatusCode_InvalidVersion, errors.WithStack(err))
+	}
+
+	if ver.Major < version.MajorVersion {
+		err := errors.Errorf("client version %s doesn't match the server version %s", v, version.NewVersion().String())
+		return ErrorWithCode(message.StatusCode_VersionTooOld, err)
+	}
+	return nil
+}
+
+// checkAddresses rejects the addresses of the peer out of the virtual networks
+// defined by the gateway, the primary address must be one of the addresses
+func (s *Server) checkAddresses(primary string, addresses []string) error {
+	found := false
+	for _, addr := range addresses {
+		found = found || addr == primary
+		ip := net.ParseIP(addr)
+		contained := false
+		for _, pool := range s.leases {
+			contained = contained || ip != nil && pool.network.Contains(ip)
+		}
+		if !contained {
+			err := errors.Errorf("address '%s' out of the virtual networks", addr)
+			return ErrorWithCode(message.StatusCode_AddOutOfNetwork, err)
+		}
+	}
+	if !found {
+		err := errors.Errorf("primary address '%s' not in the addresses", primary)
+		return ErrorWithCode(message.StatusCode_AddOutOfNetwork, err)
+	}
+	return nil
+}
+
+// Networks returns the CIDR of the virtual networks defined by the gateway
+func (s *Server) Networks() []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(s.leases))
+	for _, pool := range s.leases {
+		networks = append(networks, pool.network)
+	}
+	return networks
 }
 
 // Peer returns the peers and nil will be returned if the peer corresponding
-// to the virtual address is not found.
+// to the virtual address is not found. Both primary and secondary virtual
+// address of the peer are accepted.
 func (s *Server) Peer(virtAddr string) *PeerInfo {
-	val, found := s.peers.Load(virtAddr)
+	if primary, found := s.aliases.Load(virtAddr); found {
+		virtAddr = primary.(string)
+	}
+	peer, found := s.storage.Peer(virtAddr)
 	if !found {
 		return nil
 	}
-	return val.(*PeerInfo)
+	return peer
 }
@@ -0,0 +1,205 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lonng/zetamesh/message"
+	"github.com/lonng/zetamesh/version"
+	"github.com/pkg/errors"
+)
+
+const testKey = "test key"
+
+type testNotifier struct{}
+
+func (testNotifier) OpenTunnel(src, dst *PeerInfo) error                 { return nil }
+func (testNotifier) Evict(peer *PeerInfo, ack *message.CtrlHeartbeatAck) {}
+func (testNotifier) UpdatePeer(peer *PeerInfo)                           {}
+
+func newTestServer(t *testing.T, networks ...string) *Server {
+	opt := ServerOptions{Key: testKey, LeaseDuration: time.Hour}
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt.Networks = append(opt.Networks, ipnet)
+	}
+	return NewServer(testNotifier{}, opt)
+}
+
+// newTestHeartbeat returns the heartbeat signed by the identity, the mutate
+// function modifies the heartbeat before signed
+func newTestHeartbeat(identity ed25519.PrivateKey, virtAddress string, mutate func(*message.CtrlHeartbeat)) *message.CtrlHeartbeat {
+	heartbeat := &message.CtrlHeartbeat{
+		VirtAddress: virtAddress,
+		Nonce:       NewNonce(),
+		PublicKey:   identity.Public().(ed25519.PublicKey),
+		Timestamp:   time.Now().UnixNano(),
+		Version:     version.NewVersion().String(),
+	}
+	if mutate != nil {
+		mutate(heartbeat)
+	}
+	heartbeat.Proof = SignIdentity(identity, IdentityFields(heartbeat)...)
+	heartbeat.Signature = Sign(testKey, heartbeat.Nonce, HeartbeatFields(heartbeat)...)
+	return heartbeat
+}
+
+// statusOf returns the status code of the error, Success if nil
+func statusOf(err error) message.StatusCode {
+	if err == nil {
+		return message.StatusCode_Success
+	}
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Code
+	}
+	return message.StatusCode_ServerInternal
+}
+
+func TestHeartbeatVersion(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	remote := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2823}
+	s := newTestServer(t, "10.0.0.0/24")
+
+	heartbeat := newTestHeartbeat(identity, "10.0.0.1", func(h *message.CtrlHeartbeat) {
+		h.Version = "invalid"
+	})
+	if code := statusOf(s.Heartbeat(remote, heartbeat)); code != message.StatusCode_InvalidVersion {
+		t.Errorf("expected %s, got %s", message.StatusCode_InvalidVersion, code)
+	}
+	if s.Peer("10.0.0.1") != nil {
+		t.Error("address bound by the incompatible node")
+	}
+
+	if err := s.Heartbeat(remote, newTestHeartbeat(identity, "10.0.0.1", nil)); err != nil {
+		t.Fatalf("compatible heartbeat rejected: %v", err)
+	}
+	if s.Peer("10.0.0.1") == nil {
+		t.Error("address not bound by the compatible node")
+	}
+}
+
+func TestHeartbeatUnauthenticated(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	remote := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2823}
+	s := newTestServer(t, "10.0.0.0/24")
+
+	forged := newTestHeartbeat(identity, "10.0.0.1", nil)
+	forged.Signature = Sign("another key", forged.Nonce, HeartbeatFields(forged)...)
+	unproved := newTestHeartbeat(identity, "10.0.0.1", nil)
+	unproved.Proof = SignIdentity(other, IdentityFields(unproved)...)
+
+	// The unauthenticated heartbeats must not be answered with a status code,
+	// which would be signed and sent to the spoofed source address
+	for name, heartbeat := range map[string]*message.CtrlHeartbeat{"forged": forged, "unproved": unproved} {
+		err := s.Heartbeat(remote, heartbeat)
+		if err == nil {
+			t.Errorf("%s: heartbeat accepted", name)
+			continue
+		}
+		if _, ok := errors.Cause(err).(*Error); ok {
+			t.Errorf("%s: rejected with status code: %v", name, err)
+		}
+	}
+}
+
+func TestHeartbeatNetworks(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2823}
+	s := newTestServer(t, "10.0.0.0/24", "fd00::/64")
+	cases := []struct {
+		name      string
+		primary   string
+		addresses []string
+		expected  message.StatusCode
+	}{
+		{"primary only", "10.0.0.1", nil, message.StatusCode_Success},
+		{"dual stack", "10.0.0.2", []string{"10.0.0.2", "fd00::2"}, message.StatusCode_Success},
+		{"out of networks", "10.0.1.1", nil, message.StatusCode_AddOutOfNetwork},
+		{"secondary out of networks", "10.0.0.3", []string{"10.0.0.3", "fd01::3"}, message.StatusCode_AddOutOfNetwork},
+		{"primary not listed", "10.0.0.4", []string{"10.0.0.5"}, message.StatusCode_AddOutOfNetwork},
+		{"invalid address", "invalid", nil, message.StatusCode_AddOutOfNetwork},
+	}
+	for _, c := range cases {
+		_, identity, _ := ed25519.GenerateKey(rand.Reader)
+		heartbeat := newTestHeartbeat(identity, c.primary, func(h *message.CtrlHeartbeat) {
+			h.Addresses = c.addresses
+		})
+		if code := statusOf(s.Heartbeat(remote, heartbeat)); code != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, code)
+		}
+		if stored := s.Peer(c.primary) != nil; stored != (c.expected == message.StatusCode_Success) {
+			t.Errorf("%s: peer stored %v", c.name, stored)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	stream := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2823}
+	remote := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2823}
+	s := newTestServer(t, "10.0.0.0/24")
+
+	// The peer unknown to the gateway is added by the registration, but its
+	// UDP address is unknown until the heartbeat accepted
+	if err := s.Register(stream, newTestHeartbeat(identity, "10.0.0.1", nil)); err != nil {
+		t.Fatalf("registration of the unknown peer rejected: %v", err)
+	}
+	peer := s.Peer("10.0.0.1")
+	if peer == nil {
+		t.Fatal("peer not added by the registration")
+	}
+	if peer.UDPAddress != "" || len(peer.AllCandidates()) != 0 {
+		t.Errorf("address of the control stream used by the peers: %s", peer.UDPAddress)
+	}
+	if err := s.Heartbeat(remote, newTestHeartbeat(identity, "10.0.0.1", nil)); err != nil {
+		t.Fatalf("heartbeat after the registration rejected: %v", err)
+	}
+	if peer := s.Peer("10.0.0.1"); peer.UDPAddress != remote.String() {
+		t.Errorf("expected UDP address %s, got %s", remote, peer.UDPAddress)
+	}
+
+	// The registrations are checked as the heartbeats
+	stale := newTestHeartbeat(identity, "10.0.0.1", func(h *message.CtrlHeartbeat) {
+		h.Timestamp = s.Peer("10.0.0.1").Timestamp
+	})
+	cases := []struct {
+		name      string
+		heartbeat *message.CtrlHeartbeat
+		expected  message.StatusCode
+	}{
+		{"stale", stale, message.StatusCode_KeyNotMatched},
+		{"owned by another identity", newTestHeartbeat(other, "10.0.0.1", nil), message.StatusCode_AddConflicted},
+		{"out of networks", newTestHeartbeat(other, "10.0.1.1", nil), message.StatusCode_AddOutOfNetwork},
+		{"incompatible", newTestHeartbeat(other, "10.0.0.2", func(h *message.CtrlHeartbeat) {
+			h.Version = "invalid"
+		}), message.StatusCode_InvalidVersion},
+	}
+	for _, c := range cases {
+		if code := statusOf(s.Register(stream, c.heartbeat)); code != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, code)
+		}
+	}
+	if s.Peer("10.0.1.1") != nil || s.Peer("10.0.0.2") != nil {
+		t.Error("peer added by the rejected registration")
+	}
+}
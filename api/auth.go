@@ -0,0 +1,136 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lonng/zetamesh/message"
+)
+
+// NewNonce returns a random hex string which is used to salt the signature
+func NewNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sign returns the HMAC-SHA256 signature of the fields with the gateway key
+func Sign(key, nonce string, fields ...string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write(canonical(append([]string{nonce}, fields...)))
+	return mac.Sum(nil)
+}
+
+// Verify reports whether the signature matches the fields signed by the key
+func Verify(key, nonce string, signature []byte, fields ...string) bool {
+	return hmac.Equal(Sign(key, nonce, fields...), signature)
+}
+
+// HeartbeatFields returns the fields of the heartbeat signed with the gateway
+// key, which are all fields the gateway acts on
+func HeartbeatFields(heartbeat *message.CtrlHeartbeat) []string {
+	relays := make([]string, 0, len(heartbeat.RelayLatencies))
+	for _, r := range heartbeat.RelayLatencies {
+		relays = append(relays, fmt.Sprintf("%s/%d", r.Address, r.Rtt))
+	}
+	return []string{
+		heartbeat.VirtAddress,
+		strconv.FormatInt(heartbeat.Timestamp, 10),
+		strings.Join(heartbeat.Addresses, ","),
+		heartbeat.Endpoint,
+		string(heartbeat.PublicKey),
+		heartbeat.Version,
+		heartbeat.NatType.String(),
+		CandidatesField(heartbeat.Candidates),
+		strings.Join(relays, ","),
+	}
+}
+
+// IdentityFields returns the fields of the heartbeat signed with the node
+// identity. The candidates are signed as well if reported, which is compatible
+// with the peers without candidates.
+func IdentityFields(heartbeat *message.CtrlHeartbeat) []string {
+	fields := []string{
+		heartbeat.VirtAddress,
+		strconv.FormatInt(heartbeat.Timestamp, 10),
+		strings.Join(heartbeat.Addresses, ","),
+		heartbeat.Version,
+		heartbeat.NatType.String(),
+	}
+	if len(heartbeat.Candidates) > 0 {
+		fields = append(fields, CandidatesField(heartbeat.Candidates))
+	}
+	return fields
+}
+
+// HeartbeatAckFields returns the fields of the heartbeat ack signed with the
+// gateway key
+func HeartbeatAckFields(ack *message.CtrlHeartbeatAck) []string {
+	return []string{
+		ack.VirtAddress,
+		strconv.FormatInt(ack.Timestamp, 10),
+		ack.Code.String(),
+		ack.Error,
+		strings.Join(ack.Networks, ","),
+		strconv.FormatUint(uint64(ack.BindingPort), 10),
+		strings.Join(ack.Relays, ","),
+		string(ack.RelayToken),
+		strconv.FormatInt(ack.RelayTokenExpiry, 10),
+		ack.HeartbeatNonce,
+	}
+}
+
+// RelayFields returns the fields of the relay packet signed with the gateway key
+func RelayFields(relay *message.CtrlRelay) []string {
+	return []string{relay.VirtAddress, relay.Source, strconv.FormatInt(relay.Timestamp, 10), string(relay.Data)}
+}
+
+// SignIdentity returns the Ed25519 signature of the fields with the node identity
+func SignIdentity(private ed25519.PrivateKey, fields ...string) []byte {
+	return ed25519.Sign(private, canonical(fields))
+}
+
+// VerifyIdentity reports whether the signature matches the fields signed by the
+// private key of the public key
+func VerifyIdentity(public ed25519.PublicKey, signature []byte, fields ...string) bool {
+	if len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(public, canonical(fields), signature)
+}
+
+// canonical encodes the fields with prefixing every field by its length, which
+// makes the signed content unambiguous.
+func canonical(fields []string) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(f)))
+		buf.Write(size[:])
+		buf.WriteString(f)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lonng/zetamesh/message"
+)
+
+// MaxCandidates represents the max count of candidates reported by a peer
+const MaxCandidates = 16
+
+// The type preferences of candidates, the host candidates are preferred
+// because they work without NAT traversal, e.g: peers in the same LAN.
+var typePreferences = map[message.CandidateType]uint32{
+	message.CandidateType_Host:            126,
+	message.CandidateType_Mapped:          110,
+	message.CandidateType_PeerReflexive:   105,
+	message.CandidateType_ServerReflexive: 100,
+}
+
+// CandidatePriority returns the priority of the candidate as ICE (RFC 8445),
+// the local preference distinguishes the candidates of the same type.
+func CandidatePriority(typ message.CandidateType, localPreference uint32) uint32 {
+	return typePreferences[typ]<<24 | (localPreference&0xffff)<<8 | 255
+}
+
+// CandidatesField returns the canonical form of the candidates to be signed
+func CandidatesField(candidates []*message.Candidate) string {
+	fields := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		fields = append(fields, fmt.Sprintf("%d/%d/%s", c.Type, c.Priority, c.Address))
+	}
+	return strings.Join(fields, ",")
+}
+
+// RoutableCandidate reports whether the IP of the candidate is reachable from
+// other hosts, the loopback, link-local, unspecified and multicast addresses
+// would make the peers probe themselves or their own links.
+func RoutableCandidate(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// validCandidates returns the well-formed and routable candidates (IP:PORT)
+// in priority order
+func validCandidates(candidates []*message.Candidate) []*message.Candidate {
+	var valid []*message.Candidate
+	for _, c := range candidates {
+		host, port, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil || !RoutableCandidate(ip) {
+			continue
+		}
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			continue
+		}
+		valid = append(valid, c)
+		if len(valid) >= MaxCandidates {
+			break
+		}
+	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].Priority > valid[j].Priority
+	})
+	return valid
+}
+
+// AllCandidates returns the candidates of the peer including the server reflexive
+// one observed by the gateway, which are sorted in priority order.
+func (p *PeerInfo) AllCandidates() []*message.Candidate {
+	candidates := make([]*message.Candidate, 0, len(p.Candidates)+1)
+	reflexive := true
+	for _, c := range p.Candidates {
+		if c.Address == p.UDPAddress {
+			reflexive = false
+		}
+		candidates = append(candidates, c)
+	}
+	// The UDP address is unknown if the peer is added by the control stream
+	if reflexive && p.UDPAddress != "" {
+		candidates = append(candidates, &message.Candidate{
+			Address:  p.UDPAddress,
+			Type:     message.CandidateType_ServerReflexive,
+			Priority: CandidatePriority(message.CandidateType_ServerReflexive, 0),
+		})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority > candidates[j].Priority
+	})
+	return candidates
+}
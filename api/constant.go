@@ -21,7 +21,17 @@ const (
 	KeyRawRequest = PluginKeyType("_plugin_key_request")
 )
 
+// AlgorithmHMACSHA256 represents the signature algorithm of HMAC-SHA256
+const AlgorithmHMACSHA256 = "hmac-sha256"
+
 // API path group
 const (
-	URIOpenTunnel = "/api/v1/tunnel"
+	URILease   = "/api/v1/lease"
+	URIPeers   = "/api/v1/peers"
+	URIPeer    = "/api/v1/peers/{address}"
+	URIPeerBan = "/api/v1/peers/{address}/ban"
+	URIBans    = "/api/v1/bans"
+	URIBan     = "/api/v1/bans/{key}"
+	URIStream  = "/api/v1/stream"
+	URIControl = "/api/v1/control"
 )
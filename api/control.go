@@ -0,0 +1,277 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrControlClosed is returned if the control stream closed before the message
+// acknowledged
+var ErrControlClosed = errors.New("control stream closed")
+
+// controlTransport represents both the client and server side of the gRPC stream
+type controlTransport interface {
+	Send(*message.ControlMessage) error
+	Recv() (*message.ControlMessage, error)
+}
+
+// ControlStream represents the persistent control stream between the node and
+// the gateway. The messages requiring an acknowledgement carry an id, and the
+// receiver answers them with the `CtrlAck` of the same id.
+type ControlStream struct {
+	transport controlTransport
+	socket    bool       // Carried by the WebSocket instead of gRPC
+	mu        sync.Mutex // Protect the concurrent sends
+	ids       atomic.Int64
+	pending   sync.Map // id -> chan *message.CtrlAck
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewControlStream returns the control stream of the gRPC stream
+func NewControlStream(transport controlTransport) *ControlStream {
+	return &ControlStream{
+		transport: transport,
+		done:      make(chan struct{}),
+	}
+}
+
+// Send sends the message without waiting for the acknowledgement, the stream
+// must not be sent after closed because the transport may have been released
+func (s *ControlStream) Send(msg *message.ControlMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return ErrControlClosed
+	default:
+	}
+	return errors.WithStack(s.transport.Send(msg))
+}
+
+// Request sends the message and waits for the acknowledgement, the error of
+// the acknowledgement is returned with its status code. Only the request fails
+// if no acknowledgement received in the timeout, the broken connection is
+// detected by the keepalive of the transport.
+func (s *ControlStream) Request(msg *message.ControlMessage, timeout time.Duration) error {
+	msg.Id = s.ids.Inc()
+	ch := make(chan *message.CtrlAck, 1)
+	s.pending.Store(msg.Id, ch)
+	defer s.pending.Delete(msg.Id)
+
+	if err := s.Send(msg); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ack := <-ch:
+		if ack.Code != message.StatusCode_Success {
+			return ErrorWithCode(ack.Code, errors.New(ack.Error))
+		}
+		return nil
+	case <-timer.C:
+		return errors.Errorf("no acknowledgement of control message in %s", timeout)
+	case <-s.done:
+		return ErrControlClosed
+	}
+}
+
+// Ack acknowledges the message of the id with the result
+func (s *ControlStream) Ack(id int64, err error) error {
+	ack := &message.CtrlAck{Id: id}
+	if err != nil {
+		ack.Code = message.StatusCode_ServerInternal
+		if e, ok := errors.Cause(err).(*Error); ok {
+			ack.Code = e.Code
+		}
+		ack.Error = err.Error()
+	}
+	return s.Send(&message.ControlMessage{
+		Payload: &message.ControlMessage_Ack{Ack: ack},
+	})
+}
+
+// Recv returns the next message except the acknowledgements, which are
+// delivered to the pending requests. The stream is closed if receiving failed.
+func (s *ControlStream) Recv() (*message.ControlMessage, error) {
+	for {
+		msg, err := s.transport.Recv()
+		if err != nil {
+			s.Close()
+			return nil, errors.WithStack(err)
+		}
+		ack := msg.GetAck()
+		if ack == nil {
+			return msg, nil
+		}
+		// The duplicated acknowledgement is dropped
+		if ch, found := s.pending.Load(ack.Id); found {
+			select {
+			case ch.(chan *message.CtrlAck) <- ack:
+			default:
+			}
+		}
+	}
+}
+
+// Socket reports whether the stream is carried by the WebSocket
+func (s *ControlStream) Socket() bool {
+	return s.socket
+}
+
+// Done returns the channel closed after the stream closed
+func (s *ControlStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the stream, the owner of the underlying gRPC stream must
+// release it once done
+func (s *ControlStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// DialControl dials the control stream to the gateway via the HTTP(S) port
+func (c *Client) DialControl(ctx context.Context) (*ControlStream, error) {
+	security := grpc.WithInsecure()
+	if c.tls {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.DialContext(ctx, c.gateway, security, grpc.WithBlock(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                constant.ControlKeepaliveInterval,
+			Timeout:             constant.ControlAckTimeout,
+			PermitWithoutStream: true,
+		}))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// The gRPC stream lives until the control stream closed
+	streamCtx, cancel := context.WithCancel(context.Background())
+	client, err := message.NewControlClient(conn).Connect(streamCtx)
+	if err != nil {
+		cancel()
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	stream := NewControlStream(client)
+	go func() {
+		<-stream.Done()
+		cancel()
+		_ = conn.Close()
+	}()
+	return stream, nil
+}
+
+// socketTransport carries the control messages in the binary messages of the
+// WebSocket connection, which is used if the gRPC stream cannot be connected,
+// e.g: the HTTP proxy between the node and the gateway only supports HTTP/1.1
+type socketTransport struct {
+	conn *websocket.Conn
+}
+
+// Send implements the controlTransport interface
+func (t *socketTransport) Send(msg *message.ControlMessage) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_ = t.conn.SetWriteDeadline(time.Now().Add(constant.StreamWriteTimeout))
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Recv implements the controlTransport interface
+func (t *socketTransport) Recv() (*message.ControlMessage, error) {
+	for {
+		typ, data, err := t.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		msg := &message.ControlMessage{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return msg, nil
+	}
+}
+
+// NewSocketControlStream returns the control stream of the WebSocket connection.
+// Both sides ping each other every ControlKeepaliveInterval, and the connection
+// is closed once the stream closed or no pong received in time.
+func NewSocketControlStream(conn *websocket.Conn) *ControlStream {
+	conn.SetReadLimit(constant.MaxBufferSize)
+	timeout := constant.ControlKeepaliveInterval + constant.ControlAckTimeout
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	stream := NewControlStream(&socketTransport{conn: conn})
+	stream.socket = true
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(constant.ControlKeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deadline := time.Now().Add(constant.ControlAckTimeout)
+				if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+					stream.Close()
+					return
+				}
+			case <-stream.Done():
+				return
+			}
+		}
+	}()
+	return stream
+}
+
+// DialControlSocket dials the control stream to the gateway via the WebSocket,
+// which is the fallback if the gRPC stream cannot be connected
+func (c *Client) DialControlSocket(ctx context.Context) (*ControlStream, error) {
+	scheme := "ws"
+	if c.tls {
+		scheme = "wss"
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, c.gateway, URIControl)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewSocketControlStream(conn), nil
+}
@@ -13,7 +13,11 @@
 
 package api
 
-import "github.com/lonng/zetamesh/message"
+import (
+	"net/http"
+
+	"github.com/lonng/zetamesh/message"
+)
 
 // Error represent a dedicated error type, which contain the API status code
 type Error struct {
@@ -30,6 +34,24 @@ func (e *Error) Error() string {
 	return e.Err.Error()
 }
 
+// StatusCode returns the HTTP status code of the error response
+func (e *Error) StatusCode() int {
+	switch e.Code {
+	case message.StatusCode_ServerInternal:
+		return http.StatusInternalServerError
+	case message.StatusCode_KeyNotMatched:
+		return http.StatusUnauthorized
+	case message.StatusCode_AddConflicted:
+		return http.StatusConflict
+	case message.StatusCode_PoolExhausted:
+		return http.StatusServiceUnavailable
+	case message.StatusCode_PeerOffline, message.StatusCode_PeerNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
 // ErrorWithCode returns a error with the specified error message and code
 func ErrorWithCode(code message.StatusCode, err error) error {
 	return &Error{
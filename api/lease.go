@@ -0,0 +1,187 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxLeaseScan represents the max count of addresses will be scanned when
+// allocating an address, which prevents a huge network scanning forever.
+const maxLeaseScan = 1 << 16
+
+// Lease represents an address allocated to the peer identity
+type Lease struct {
+	Address   string            `json:"address"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Expire    time.Time         `json:"expire"`
+}
+
+// leasePool allocates the addresses of the virtual network to the peers which
+// join without an address. The lease is sticky to the identity: an expired lease
+// is only reclaimed when no never-leased address is available, so a peer joins
+// again will get the same address back in most cases. The expired leases are
+// kept for another lease duration and removed by the reaper after that. The
+// leases are persisted into the storage and never modified in place.
+type leasePool struct {
+	network  *net.IPNet
+	duration time.Duration
+	storage  Storage
+
+	mu     sync.Mutex
+	cursor uint64
+	byKey  map[string]*Lease // public key -> lease
+	byAddr map[string]*Lease // address -> lease
+}
+
+func newLeasePool(network *net.IPNet, duration time.Duration, storage Storage) *leasePool {
+	p := &leasePool{
+		network:  network,
+		duration: duration,
+		storage:  storage,
+		byKey:    map[string]*Lease{},
+		byAddr:   map[string]*Lease{},
+	}
+	// Restore the leases of the network from the storage
+	for _, lease := range storage.Leases() {
+		if ip := net.ParseIP(lease.Address); ip != nil && network.Contains(ip) {
+			p.byKey[string(lease.PublicKey)] = lease
+			p.byAddr[lease.Address] = lease
+		}
+	}
+	return p
+}
+
+// allocate returns the lease of the identity. The inUse is used to skip the
+// addresses assigned statically and the reclaim will be called with the address
+// of the expired lease which is reassigned to the identity.
+func (p *leasePool) allocate(public ed25519.PublicKey, inUse func(addr string) bool, reclaim func(addr string)) (*Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if lease, found := p.byKey[string(public)]; found {
+		return p.bind(lease.Address, public, now), nil
+	}
+
+	ones, bits := p.network.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits < 2 {
+		return nil, ErrorWithCode(message.StatusCode_PoolExhausted, errors.Errorf("network %s is too small", p.network))
+	}
+	// Skip the network address and broadcast address
+	hosts := uint64(maxLeaseScan)
+	if hostBits < 63 && (uint64(1)<<hostBits)-2 < hosts {
+		hosts = (uint64(1) << hostBits) - 2
+	}
+
+	var expired *Lease
+	for i := uint64(0); i < hosts; i++ {
+		offset := (p.cursor+i)%hosts + 1
+		addr := ipAdd(p.network.IP, offset).String()
+		if lease, found := p.byAddr[addr]; found {
+			if lease.Expire.Before(now) && (expired == nil || lease.Expire.Before(expired.Expire)) {
+				expired = lease
+			}
+			continue
+		}
+		if inUse(addr) {
+			continue
+		}
+		p.cursor = offset
+		return p.bind(addr, public, now), nil
+	}
+
+	if expired == nil {
+		return nil, ErrorWithCode(message.StatusCode_PoolExhausted, errors.Errorf("no free address in network %s", p.network))
+	}
+	delete(p.byKey, string(expired.PublicKey))
+	delete(p.byAddr, expired.Address)
+	if err := p.storage.DeleteLease(expired.Address); err != nil {
+		zap.L().Error("Delete lease from storage failed", zap.String("address", expired.Address), zap.Error(err))
+	}
+	reclaim(expired.Address)
+	return p.bind(expired.Address, public, now), nil
+}
+
+func (p *leasePool) bind(addr string, public ed25519.PublicKey, now time.Time) *Lease {
+	lease := &Lease{
+		Address:   addr,
+		PublicKey: public,
+		Expire:    now.Add(p.duration),
+	}
+	p.byKey[string(public)] = lease
+	p.byAddr[addr] = lease
+	if err := p.storage.PutLease(lease); err != nil {
+		zap.L().Error("Persist lease failed", zap.String("address", addr), zap.Error(err))
+	}
+	return lease
+}
+
+// renew extends the lease of the address if it is owned by the identity. The
+// false will be returned if the address is leased to another identity.
+func (p *leasePool) renew(addr string, public ed25519.PublicKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lease, found := p.byAddr[addr]
+	if !found {
+		return true
+	}
+	if string(lease.PublicKey) != string(public) {
+		return false
+	}
+	p.bind(addr, public, time.Now())
+	return true
+}
+
+// reap removes the leases expired for more than the lease duration
+func (p *leasePool) reap(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, lease := range p.byAddr {
+		if now.Sub(lease.Expire) < p.duration {
+			continue
+		}
+		zap.L().Info("Remove expired lease", zap.String("address", addr), zap.Time("expire", lease.Expire))
+		delete(p.byKey, string(lease.PublicKey))
+		delete(p.byAddr, addr)
+		if err := p.storage.DeleteLease(addr); err != nil {
+			zap.L().Error("Delete lease from storage failed", zap.String("address", addr), zap.Error(err))
+		}
+	}
+}
+
+// ipAdd returns the IP of base plus the offset
+func ipAdd(base net.IP, offset uint64) net.IP {
+	if v4 := base.To4(); v4 != nil {
+		base = v4
+	}
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	for i := len(ip) - 1; i >= 0 && offset > 0; i-- {
+		sum := uint64(ip[i]) + offset&0xff
+		ip[i] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	return ip
+}
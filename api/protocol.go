@@ -13,7 +13,11 @@
 
 package api
 
-import "github.com/lonng/zetamesh/message"
+import (
+	"crypto/ed25519"
+
+	"github.com/lonng/zetamesh/message"
+)
 
 type (
 	// Result represent the common part of API response
@@ -23,20 +27,22 @@ type (
 		Data  interface{}        `json:"data,omitempty"`
 	}
 
-	// OpenTunnelRequest represents the request when trying to open
-	// a tunnel
-	OpenTunnelRequest struct {
-		Version     string `json:"version"`
-		Algorithm   string `json:"algorithm"`
-		Nonce       string `json:"nonce"`
-		Cipher      string `json:"cipher"`
-		Source      string `json:"source"`
-		Destination string `json:"destination"`
+	// LeaseRequest represents the request when a peer joins without an
+	// address and asks the gateway to allocate one for its identity
+	LeaseRequest struct {
+		Version   string            `json:"version"`
+		Algorithm string            `json:"algorithm"`
+		Nonce     string            `json:"nonce"`
+		Cipher    string            `json:"cipher"`
+		PublicKey ed25519.PublicKey `json:"public_key"`
+		Timestamp int64             `json:"timestamp"`
+		Proof     []byte            `json:"proof"`
 	}
 
-	// OpenTunnelResponse represent the response of trying to open
-	// a tunnel
-	OpenTunnelResponse struct {
-		Encrypt string `json:"encrypt"`
+	// LeaseResponse represents the addresses allocated to the peer, one
+	// address of each network in CIDR form (e.g: 10.0.0.1/16)
+	LeaseResponse struct {
+		Addresses []string `json:"addresses"`
+		Expire    int64    `json:"expire"`
 	}
 )
@@ -0,0 +1,74 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"strconv"
+	"time"
+
+	"github.com/lonng/zetamesh/message"
+)
+
+// MaxRelays represents the max count of relay servers reported by a peer
+const MaxRelays = 16
+
+// The nonce of the relay token, which separates the token from other signatures
+const relayTokenNonce = "relay-token"
+
+// relayBindLabel separates the relay bind signatures from other identity signatures
+const relayBindLabel = "zetamesh relay bind v1"
+
+// RelayToken returns the token which authorizes the peer of the virtual address
+// and the identity to bind the relay servers until the expiry (unix nano). The
+// token is signed by the secret shared by the gateway and the relay servers.
+func RelayToken(secret, virtAddress string, public ed25519.PublicKey, expiry int64) []byte {
+	return Sign(secret, relayTokenNonce, virtAddress, string(public), strconv.FormatInt(expiry, 10))
+}
+
+// VerifyRelayToken reports whether the token is signed by the secret and not expired
+func VerifyRelayToken(secret, virtAddress string, public ed25519.PublicKey, expiry int64, token []byte) bool {
+	if time.Now().UnixNano() >= expiry {
+		return false
+	}
+	return hmac.Equal(RelayToken(secret, virtAddress, public, expiry), token)
+}
+
+// RelayBindFields returns the fields of the relay bind signed with the node
+// identity, so the token leaked to others cannot be used to bind the relays.
+func RelayBindFields(bind *message.CtrlRelayBind) []string {
+	return []string{
+		relayBindLabel,
+		bind.VirtAddress,
+		string(bind.Token),
+		strconv.FormatInt(bind.Expiry, 10),
+		strconv.FormatInt(bind.Timestamp, 10),
+	}
+}
+
+// validRelays returns the relay latencies with positive round-trip time
+func validRelays(relays []*message.RelayLatency) []*message.RelayLatency {
+	var valid []*message.RelayLatency
+	for _, r := range relays {
+		if r.Address == "" || r.Rtt <= 0 {
+			continue
+		}
+		valid = append(valid, r)
+		if len(valid) >= MaxRelays {
+			break
+		}
+	}
+	return valid
+}
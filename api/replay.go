@@ -0,0 +1,119 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lonng/zetamesh/constant"
+)
+
+type (
+	// nonceWindow remembers the nonces of the signed packets of each peer, so
+	// the packets captured by others cannot be replayed. Each peer is locked
+	// separately, so the relayed packets don't contend with the heartbeats.
+	nonceWindow struct {
+		peers sync.Map // peer -> *peerNonces
+	}
+
+	// peerNonces represents the last MaxNonces nonces of a peer in arrival order,
+	// and the packets not newer than the forgotten nonces are rejected
+	peerNonces struct {
+		mu      sync.Mutex
+		seen    map[string]struct{}
+		order   []nonceEntry
+		floor   int64
+		updated time.Time
+		expired bool // Removed from the window, the nonces are remembered by a new one
+	}
+
+	nonceEntry struct {
+		nonce     string
+		timestamp int64
+	}
+)
+
+func newNonceWindow() *nonceWindow {
+	return &nonceWindow{}
+}
+
+// relayNonces returns the key of the nonces of the packets relayed for the
+// peer, which are kept apart from its heartbeats, so the relayed traffic never
+// pushes the heartbeat nonces out of the window
+func relayNonces(peer string) string {
+	return "relay/" + peer
+}
+
+// accept reports whether the nonce is fresh for the peer and remembers it
+func (w *nonceWindow) accept(peer, nonce string, timestamp int64) bool {
+	skew := time.Since(time.Unix(0, timestamp))
+	if skew > constant.NonceExpire || skew < -constant.NonceExpire {
+		return false
+	}
+
+	for {
+		value, found := w.peers.Load(peer)
+		if !found {
+			value, _ = w.peers.LoadOrStore(peer, &peerNonces{seen: map[string]struct{}{}})
+		}
+		p := value.(*peerNonces)
+		p.mu.Lock()
+		// Retry with the new one if removed by expire concurrently
+		if p.expired {
+			p.mu.Unlock()
+			continue
+		}
+		accepted := p.accept(nonce, timestamp)
+		p.mu.Unlock()
+		return accepted
+	}
+}
+
+// accept remembers the nonce if fresh, the caller must hold the lock
+func (p *peerNonces) accept(nonce string, timestamp int64) bool {
+	if timestamp <= p.floor {
+		return false
+	}
+	if _, found := p.seen[nonce]; found {
+		return false
+	}
+	p.seen[nonce] = struct{}{}
+	p.order = append(p.order, nonceEntry{nonce: nonce, timestamp: timestamp})
+	p.updated = time.Now()
+	if len(p.order) > constant.MaxNonces {
+		oldest := p.order[0]
+		p.order = p.order[1:]
+		delete(p.seen, oldest.nonce)
+		if oldest.timestamp > p.floor {
+			p.floor = oldest.timestamp
+		}
+	}
+	return true
+}
+
+// expire removes the nonces of the peers which sent no packet for NonceExpire,
+// the packets of them signed before are too old to be accepted anyway
+func (w *nonceWindow) expire(now time.Time) {
+	w.peers.Range(func(key, value interface{}) bool {
+		p := value.(*peerNonces)
+		p.mu.Lock()
+		if now.Sub(p.updated) >= constant.NonceExpire {
+			p.expired = true
+			w.peers.Delete(key)
+		}
+		p.mu.Unlock()
+		return true
+	})
+}
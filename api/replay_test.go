@@ -0,0 +1,119 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lonng/zetamesh/constant"
+)
+
+func TestNonceWindowReplay(t *testing.T) {
+	w := newNonceWindow()
+	now := time.Now().UnixNano()
+	if !w.accept("10.0.0.1", "a", now) {
+		t.Fatal("fresh nonce rejected")
+	}
+	if w.accept("10.0.0.1", "a", now) {
+		t.Error("replayed nonce accepted")
+	}
+	if w.accept("10.0.0.1", "a", now+1) {
+		t.Error("replayed nonce accepted with another timestamp")
+	}
+	if !w.accept("10.0.0.1", "b", now) {
+		t.Error("fresh nonce with the same timestamp rejected")
+	}
+}
+
+func TestNonceWindowExpire(t *testing.T) {
+	w := newNonceWindow()
+	now := time.Now()
+	cases := []struct {
+		name      string
+		timestamp time.Time
+		expected  bool
+	}{
+		{"now", now, true},
+		{"in skew", now.Add(-constant.NonceExpire / 2), true},
+		{"too old", now.Add(-constant.NonceExpire - time.Second), false},
+		{"too new", now.Add(constant.NonceExpire + time.Second), false},
+	}
+	for i, c := range cases {
+		if ok := w.accept("10.0.0.1", fmt.Sprint(i), c.timestamp.UnixNano()); ok != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, ok)
+		}
+	}
+
+	// The idle peers are forgotten, and the remembered nonces are too old to
+	// be accepted again after expired
+	w.expire(now.Add(constant.NonceExpire / 2))
+	if _, found := w.peers.Load("10.0.0.1"); !found {
+		t.Error("active peer expired")
+	}
+	w.expire(now.Add(constant.NonceExpire + time.Second))
+	if _, found := w.peers.Load("10.0.0.1"); found {
+		t.Error("idle peer not expired")
+	}
+	if !w.accept("10.0.0.1", "fresh", time.Now().UnixNano()) {
+		t.Error("fresh nonce rejected after expired")
+	}
+}
+
+func TestNonceWindowFloor(t *testing.T) {
+	w := newNonceWindow()
+	base := time.Now().UnixNano()
+	for i := 0; i <= constant.MaxNonces; i++ {
+		if !w.accept("10.0.0.1", fmt.Sprint(i), base+int64(i)) {
+			t.Fatalf("fresh nonce %d rejected", i)
+		}
+	}
+	// The oldest nonce is forgotten, but its packet cannot be replayed
+	// because it's not newer than the floor
+	if w.accept("10.0.0.1", "0", base) {
+		t.Error("forgotten nonce replayed")
+	}
+	if w.accept("10.0.0.1", "fresh", base) {
+		t.Error("nonce not newer than the floor accepted")
+	}
+	if !w.accept("10.0.0.1", "fresh", base+1) {
+		t.Error("nonce newer than the floor rejected")
+	}
+}
+
+func TestNonceWindowIsolation(t *testing.T) {
+	w := newNonceWindow()
+	heartbeat := time.Now().UnixNano()
+	if !w.accept("10.0.0.1", "heartbeat", heartbeat) {
+		t.Fatal("heartbeat rejected")
+	}
+
+	// Flooding the relayed packets of the peer raises the floor of its relay
+	// nonces only
+	for i := 0; i < 2*constant.MaxNonces; i++ {
+		if !w.accept(relayNonces("10.0.0.1"), fmt.Sprint(i), heartbeat+int64(i)+1) {
+			t.Fatalf("relay nonce %d rejected", i)
+		}
+	}
+	if w.accept("10.0.0.1", "heartbeat", heartbeat) {
+		t.Error("heartbeat replayed after the relay flood")
+	}
+	if !w.accept("10.0.0.1", "register", heartbeat+1) {
+		t.Error("heartbeat rejected after the relay flood")
+	}
+	if !w.accept("10.0.0.2", "heartbeat", heartbeat) {
+		t.Error("nonce of another peer rejected")
+	}
+}
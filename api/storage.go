@@ -0,0 +1,239 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Storage represents the registry storage of the gateway, which keeps the
+	// peers, the address leases and the bans. The stored values are never modified after
+	// being put into the storage, and a new value should be put instead.
+	Storage interface {
+		// Peer returns the peer of the primary virtual address
+		Peer(virtAddr string) (*PeerInfo, bool)
+		// Peers returns all peers in the storage
+		Peers() []*PeerInfo
+		// PutPeer inserts or replaces the peer
+		PutPeer(peer *PeerInfo) error
+		// LoadOrStorePeer returns the existing peer of the primary virtual address
+		// if present, otherwise it inserts the peer. The loaded result is true if
+		// the peer was loaded.
+		LoadOrStorePeer(peer *PeerInfo) (*PeerInfo, bool, error)
+		// DeletePeer removes the peer of the primary virtual address
+		DeletePeer(virtAddr string) error
+
+		// Leases returns all address leases in the storage
+		Leases() []*Lease
+		// PutLease inserts or replaces the lease of the address
+		PutLease(lease *Lease) error
+		// DeleteLease removes the lease of the address
+		DeleteLease(addr string) error
+
+		// Ban returns the ban of the identity
+		Ban(key string) (*Ban, bool)
+		// Bans returns all bans in the storage
+		Bans() []*Ban
+		// PutBan inserts or replaces the ban of the identity
+		PutBan(ban *Ban) error
+		// DeleteBan removes the ban of the identity
+		DeleteBan(key string) error
+
+		// Snapshot writes all the content of the storage to the writer
+		Snapshot(w io.Writer) error
+		// Restore replaces all the content of the storage with the snapshot
+		Restore(r io.Reader) error
+		// Close releases the resources of the storage
+		Close() error
+	}
+
+	// Snapshot represents the content of the registry storage
+	Snapshot struct {
+		Peers  []*PeerInfo `json:"peers"`
+		Leases []*Lease    `json:"leases"`
+		Bans   []*Ban      `json:"bans"`
+	}
+)
+
+// memoryStorage keeps the registry in memory and all of it will be lost
+// after the gateway restarted
+type memoryStorage struct {
+	peers  sync.Map // primary virtual address -> *PeerInfo
+	leases sync.Map // address -> *Lease
+	bans   sync.Map // identity key -> *Ban
+}
+
+// NewMemoryStorage returns a storage keeps all content in memory
+func NewMemoryStorage() Storage {
+	return &memoryStorage{}
+}
+
+func (m *memoryStorage) Peer(virtAddr string) (*PeerInfo, bool) {
+	val, found := m.peers.Load(virtAddr)
+	if !found {
+		return nil, false
+	}
+	return val.(*PeerInfo), true
+}
+
+func (m *memoryStorage) Peers() []*PeerInfo {
+	var peers []*PeerInfo
+	m.peers.Range(func(_, value interface{}) bool {
+		peers = append(peers, value.(*PeerInfo))
+		return true
+	})
+	return peers
+}
+
+func (m *memoryStorage) PutPeer(peer *PeerInfo) error {
+	m.peers.Store(peer.VirtAddress, peer)
+	return nil
+}
+
+func (m *memoryStorage) LoadOrStorePeer(peer *PeerInfo) (*PeerInfo, bool, error) {
+	actual, loaded := m.peers.LoadOrStore(peer.VirtAddress, peer)
+	return actual.(*PeerInfo), loaded, nil
+}
+
+func (m *memoryStorage) DeletePeer(virtAddr string) error {
+	m.peers.Delete(virtAddr)
+	return nil
+}
+
+func (m *memoryStorage) Leases() []*Lease {
+	var leases []*Lease
+	m.leases.Range(func(_, value interface{}) bool {
+		leases = append(leases, value.(*Lease))
+		return true
+	})
+	return leases
+}
+
+func (m *memoryStorage) PutLease(lease *Lease) error {
+	m.leases.Store(lease.Address, lease)
+	return nil
+}
+
+func (m *memoryStorage) DeleteLease(addr string) error {
+	m.leases.Delete(addr)
+	return nil
+}
+
+func (m *memoryStorage) Ban(key string) (*Ban, bool) {
+	val, found := m.bans.Load(key)
+	if !found {
+		return nil, false
+	}
+	return val.(*Ban), true
+}
+
+func (m *memoryStorage) Bans() []*Ban {
+	var bans []*Ban
+	m.bans.Range(func(_, value interface{}) bool {
+		bans = append(bans, value.(*Ban))
+		return true
+	})
+	return bans
+}
+
+func (m *memoryStorage) PutBan(ban *Ban) error {
+	m.bans.Store(ban.Key(), ban)
+	return nil
+}
+
+func (m *memoryStorage) DeleteBan(key string) error {
+	m.bans.Delete(key)
+	return nil
+}
+
+func (m *memoryStorage) Snapshot(w io.Writer) error {
+	return writeSnapshot(m, w)
+}
+
+func (m *memoryStorage) Restore(r io.Reader) error {
+	snapshot, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	m.reset(snapshot)
+	return nil
+}
+
+// reset replaces all content with the snapshot
+func (m *memoryStorage) reset(snapshot *Snapshot) {
+	m.peers.Range(func(key, _ interface{}) bool {
+		m.peers.Delete(key)
+		return true
+	})
+	m.leases.Range(func(key, _ interface{}) bool {
+		m.leases.Delete(key)
+		return true
+	})
+	m.bans.Range(func(key, _ interface{}) bool {
+		m.bans.Delete(key)
+		return true
+	})
+	for _, peer := range snapshot.Peers {
+		m.peers.Store(peer.VirtAddress, peer)
+	}
+	for _, lease := range snapshot.Leases {
+		m.leases.Store(lease.Address, lease)
+	}
+	for _, ban := range snapshot.Bans {
+		m.bans.Store(ban.Key(), ban)
+	}
+}
+
+func (m *memoryStorage) Close() error {
+	return nil
+}
+
+func writeSnapshot(s Storage, w io.Writer) error {
+	snapshot := &Snapshot{
+		Peers:  s.Peers(),
+		Leases: s.Leases(),
+		Bans:   s.Bans(),
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.WithStack(encoder.Encode(snapshot))
+}
+
+func readSnapshot(r io.Reader) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, errors.WithMessage(err, "malformed snapshot")
+	}
+	for _, peer := range snapshot.Peers {
+		if peer == nil || peer.VirtAddress == "" {
+			return nil, errors.New("malformed snapshot: peer without virtual address")
+		}
+	}
+	for _, lease := range snapshot.Leases {
+		if lease == nil || lease.Address == "" {
+			return nil, errors.New("malformed snapshot: lease without address")
+		}
+	}
+	for _, ban := range snapshot.Bans {
+		if ban == nil || len(ban.PublicKey) == 0 {
+			return nil, errors.New("malformed snapshot: ban without public key")
+		}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,339 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	bucketPeers  = []byte("peers")
+	bucketLeases = []byte("leases")
+	bucketBans   = []byte("bans")
+)
+
+// fileStorage persists the registry into a local embedded database file and
+// keeps a copy in memory, all reads are served by the memory copy. The writes
+// are applied to the memory copy at once and persisted by a background writer,
+// which coalesces the writes queued during a transaction into the next one, so
+// the heartbeats never wait for the disk.
+type fileStorage struct {
+	memory *memoryStorage
+	db     *bolt.DB
+
+	mu      sync.Mutex
+	pending map[pendingKey][]byte // The latest values to be written, nil means deletion
+	writing sync.Mutex            // Serializes the transactions of the writer and restore
+	wakeup  chan struct{}
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+type pendingKey struct {
+	bucket string
+	key    string
+}
+
+// NewFileStorage opens the registry database file and the file will be created
+// if not exists. The file is locked exclusively until the storage closed.
+func NewFileStorage(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errors.Errorf("storage %s is locked by another process, e.g: a running gateway", path)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "open storage %s", path)
+	}
+
+	s := &fileStorage{
+		memory:  &memoryStorage{},
+		db:      db,
+		pending: map[pendingKey][]byte{},
+		wakeup:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		_ = db.Close()
+		return nil, errors.WithMessagef(err, "load storage %s", path)
+	}
+	go s.writer()
+	return s, nil
+}
+
+// load reads all content of the database file into memory
+func (f *fileStorage) load() error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		peers, err := tx.CreateBucketIfNotExists(bucketPeers)
+		if err != nil {
+			return err
+		}
+		leases, err := tx.CreateBucketIfNotExists(bucketLeases)
+		if err != nil {
+			return err
+		}
+		bans, err := tx.CreateBucketIfNotExists(bucketBans)
+		if err != nil {
+			return err
+		}
+
+		err = peers.ForEach(func(_, value []byte) error {
+			peer := &PeerInfo{}
+			if err := json.Unmarshal(value, peer); err != nil {
+				return err
+			}
+			return f.memory.PutPeer(peer)
+		})
+		if err != nil {
+			return err
+		}
+		err = leases.ForEach(func(_, value []byte) error {
+			lease := &Lease{}
+			if err := json.Unmarshal(value, lease); err != nil {
+				return err
+			}
+			return f.memory.PutLease(lease)
+		})
+		if err != nil {
+			return err
+		}
+		return bans.ForEach(func(_, value []byte) error {
+			ban := &Ban{}
+			if err := json.Unmarshal(value, ban); err != nil {
+				return err
+			}
+			return f.memory.PutBan(ban)
+		})
+	})
+}
+
+func (f *fileStorage) put(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.enqueue(bucket, key, data)
+	return nil
+}
+
+func (f *fileStorage) delete(bucket []byte, key string) error {
+	f.enqueue(bucket, key, nil)
+	return nil
+}
+
+// enqueue replaces the pending value of the key and wakes up the writer
+func (f *fileStorage) enqueue(bucket []byte, key string, data []byte) {
+	f.mu.Lock()
+	f.pending[pendingKey{bucket: string(bucket), key: key}] = data
+	f.mu.Unlock()
+
+	select {
+	case f.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// writer persists the pending values until the storage closed
+func (f *fileStorage) writer() {
+	defer close(f.closed)
+	for {
+		select {
+		case <-f.wakeup:
+			if err := f.flush(); err != nil {
+				zap.L().Error("Persist registry failed", zap.Error(err))
+			}
+		case <-f.closing:
+			if err := f.flush(); err != nil {
+				zap.L().Error("Persist registry failed", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// flush writes all pending values in a single transaction
+func (f *fileStorage) flush() error {
+	f.writing.Lock()
+	defer f.writing.Unlock()
+
+	f.mu.Lock()
+	pending := f.pending
+	f.pending = map[pendingKey][]byte{}
+	f.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return errors.WithStack(f.db.Update(func(tx *bolt.Tx) error {
+		for k, data := range pending {
+			bucket := tx.Bucket([]byte(k.bucket))
+			if data == nil {
+				if err := bucket.Delete([]byte(k.key)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bucket.Put([]byte(k.key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (f *fileStorage) Peer(virtAddr string) (*PeerInfo, bool) {
+	return f.memory.Peer(virtAddr)
+}
+
+func (f *fileStorage) Peers() []*PeerInfo {
+	return f.memory.Peers()
+}
+
+func (f *fileStorage) PutPeer(peer *PeerInfo) error {
+	_ = f.memory.PutPeer(peer)
+	return f.put(bucketPeers, peer.VirtAddress, peer)
+}
+
+func (f *fileStorage) LoadOrStorePeer(peer *PeerInfo) (*PeerInfo, bool, error) {
+	actual, loaded, _ := f.memory.LoadOrStorePeer(peer)
+	if loaded {
+		return actual, true, nil
+	}
+	return actual, false, f.put(bucketPeers, peer.VirtAddress, peer)
+}
+
+func (f *fileStorage) DeletePeer(virtAddr string) error {
+	_ = f.memory.DeletePeer(virtAddr)
+	return f.delete(bucketPeers, virtAddr)
+}
+
+func (f *fileStorage) Leases() []*Lease {
+	return f.memory.Leases()
+}
+
+func (f *fileStorage) PutLease(lease *Lease) error {
+	_ = f.memory.PutLease(lease)
+	return f.put(bucketLeases, lease.Address, lease)
+}
+
+func (f *fileStorage) DeleteLease(addr string) error {
+	_ = f.memory.DeleteLease(addr)
+	return f.delete(bucketLeases, addr)
+}
+
+func (f *fileStorage) Ban(key string) (*Ban, bool) {
+	return f.memory.Ban(key)
+}
+
+func (f *fileStorage) Bans() []*Ban {
+	return f.memory.Bans()
+}
+
+func (f *fileStorage) PutBan(ban *Ban) error {
+	_ = f.memory.PutBan(ban)
+	return f.put(bucketBans, ban.Key(), ban)
+}
+
+func (f *fileStorage) DeleteBan(key string) error {
+	_ = f.memory.DeleteBan(key)
+	return f.delete(bucketBans, key)
+}
+
+func (f *fileStorage) Snapshot(w io.Writer) error {
+	return writeSnapshot(f, w)
+}
+
+// Restore replaces the content of the database file in a single transaction
+func (f *fileStorage) Restore(r io.Reader) error {
+	snapshot, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	// The pending values are replaced by the snapshot as well
+	f.writing.Lock()
+	defer f.writing.Unlock()
+	f.mu.Lock()
+	f.pending = map[pendingKey][]byte{}
+	f.mu.Unlock()
+
+	err = f.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketPeers, bucketLeases, bucketBans} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		peers, err := tx.CreateBucket(bucketPeers)
+		if err != nil {
+			return err
+		}
+		leases, err := tx.CreateBucket(bucketLeases)
+		if err != nil {
+			return err
+		}
+		bans, err := tx.CreateBucket(bucketBans)
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range snapshot.Peers {
+			data, err := json.Marshal(peer)
+			if err != nil {
+				return err
+			}
+			if err := peers.Put([]byte(peer.VirtAddress), data); err != nil {
+				return err
+			}
+		}
+		for _, lease := range snapshot.Leases {
+			data, err := json.Marshal(lease)
+			if err != nil {
+				return err
+			}
+			if err := leases.Put([]byte(lease.Address), data); err != nil {
+				return err
+			}
+		}
+		for _, ban := range snapshot.Bans {
+			data, err := json.Marshal(ban)
+			if err != nil {
+				return err
+			}
+			if err := bans.Put([]byte(ban.Key()), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f.memory.reset(snapshot)
+	return nil
+}
+
+// Close persists the pending values and closes the database file
+func (f *fileStorage) Close() error {
+	close(f.closing)
+	<-f.closed
+	return errors.WithStack(f.db.Close())
+}
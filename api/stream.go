@@ -0,0 +1,107 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/pkg/errors"
+)
+
+// StreamPrefix represents the prefix of the address of the peer connected via
+// the stream, which distinguishes it from the UDP addresses
+const StreamPrefix = "stream:"
+
+// IsStreamAddress reports whether the address is of a peer connected via the stream
+func IsStreamAddress(addr string) bool {
+	return strings.HasPrefix(addr, StreamPrefix)
+}
+
+// StreamAddr represents the address of the peer connected via the stream
+type StreamAddr string
+
+// Network implements the net.Addr interface
+func (a StreamAddr) Network() string {
+	return "stream"
+}
+
+// String implements the net.Addr interface
+func (a StreamAddr) String() string {
+	return StreamPrefix + string(a)
+}
+
+// Stream represents the WebSocket connection between the node and the gateway,
+// which is used if the UDP is blocked. Each binary message carries a packet in
+// the same encoding of the UDP packets.
+type Stream struct {
+	conn *websocket.Conn
+	mu   sync.Mutex // Protect the concurrent writes
+}
+
+// NewStream returns the stream of the WebSocket connection
+func NewStream(conn *websocket.Conn) *Stream {
+	return &Stream{conn: conn}
+}
+
+// Write writes the packet into the stream
+func (s *Stream) Write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(constant.StreamWriteTimeout))
+	return errors.WithStack(s.conn.WriteMessage(websocket.BinaryMessage, data))
+}
+
+// Read reads the next packet from the stream
+func (s *Stream) Read() ([]byte, error) {
+	for {
+		typ, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if typ == websocket.BinaryMessage && len(data) > 0 {
+			return data, nil
+		}
+	}
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close closes the stream
+func (s *Stream) Close() error {
+	return s.conn.Close()
+}
+
+// DialStream dials the stream to the gateway via the HTTP(S) port
+func (c *Client) DialStream(ctx context.Context) (*Stream, error) {
+	scheme := "ws"
+	if c.tls {
+		scheme = "wss"
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, c.gateway, URIStream)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewStream(conn), nil
+}
@@ -22,12 +22,198 @@ const HeartbeatInterval = 20
 // MaxBufferSize represents the max buffer size of read UDP packet
 const MaxBufferSize = 4096
 
-// MaxRetrySend represents the max tries of send notification to the peer
-const MaxRetrySend = 10
-
 // ConnectingRetryDuration represents the interval of retrying send
 // initial Ping packet to the peer
 const ConnectingRetryDuration = 100 * time.Millisecond
 
 // PeerKeepaliveDuration represents the interval of keepaliving heartbeat
 const PeerKeepaliveDuration = 5 * time.Second
+
+// RelayHandshakeDuration represents the interval of retrying send the handshake
+// to the peer via the gateway relay until the session established
+const RelayHandshakeDuration = time.Second
+
+// RegisterTimeout represents the max duration of waiting the gateway accepting
+// the first heartbeat before setting up the virtual network
+const RegisterTimeout = 3 * time.Second
+
+// DefaultNetworkPrefix represents the prefix length of the virtual network if
+// neither the address nor the gateway specifies the network
+const DefaultNetworkPrefix = 16
+
+// DefaultNetworkPrefix6 represents the prefix length of the IPv6 virtual network
+// if neither the address nor the gateway specifies the network
+const DefaultNetworkPrefix6 = 64
+
+// PeerReapInterval represents the interval of checking the peers which missed
+// heartbeats in the gateway
+const PeerReapInterval = 5 * time.Second
+
+// OfflineRetryDuration represents the interval of retrying to open the tunnel
+// to the peer which is reported offline by the gateway
+const OfflineRetryDuration = 5 * time.Second
+
+// ProbeTimeout represents the max duration of waiting the Pong message, the
+// Ping message will be counted as lost after the duration
+const ProbeTimeout = 2 * time.Second
+
+// MaxBufferedPackets represents the max count of packets buffered for each peer
+// while the tunnel is being established, the oldest packet will be dropped if full
+const MaxBufferedPackets = 32
+
+// BufferedPacketExpire represents the max duration of the packet buffered while
+// the tunnel is being established
+const BufferedPacketExpire = 3 * time.Second
+
+// CandidateNominationDuration represents the duration of checking the candidates
+// with higher priority than the selected one after the connection created
+const CandidateNominationDuration = 3 * time.Second
+
+// BindingTimeout represents the duration of waiting the response of a binding
+// request, which is retried for BindingRetries times
+const BindingTimeout = 500 * time.Millisecond
+
+// BindingRetries represents the max tries of sending a binding request
+const BindingRetries = 3
+
+// BindingPadding represents the size of padding in the binding request, the
+// gateway only answers the requests no smaller than the responses, which keeps
+// the binding port from amplifying the spoofed requests.
+const BindingPadding = 64
+
+// BindingRateLimit represents the max count of binding requests answered for
+// each source IP per second
+const BindingRateLimit = 20
+
+// PortPredictionRounds represents the max rounds of probing the predicted ports
+// of the peer behind a symmetric NAT, the round is repeated every interval of
+// PortPredictionInterval and the predicted paths are closed after all rounds
+const PortPredictionRounds = 10
+
+// PortPredictionInterval represents the interval of the port prediction rounds
+const PortPredictionInterval = 500 * time.Millisecond
+
+// PredictedPorts represents the count of ports following the server reflexive
+// port of the peer, which are probed for the NAT allocating ports sequentially
+const PredictedPorts = 16
+
+// BirthdayProbes represents the count of random ports of the peer probed in
+// each round of the port prediction, the ports are never probed twice, so
+// about 92% of the traversals succeed with the BirthdaySockets of the peer.
+const BirthdayProbes = 256
+
+// BirthdaySockets represents the count of extra local sockets opened to the
+// peer if the local node is behind a symmetric NAT, each of them is mapped to
+// a different public port which may collide with the probes of the peer
+const BirthdaySockets = 64
+
+// MaxLearnedPaths represents the max count of peer reflexive paths learned from
+// the Ping messages of unknown addresses for each connection
+const MaxLearnedPaths = 8
+
+// PortMappingLifetime represents the lifetime of the port mapping requested on
+// the router, which is renewed at the half of the lifetime granted
+const PortMappingLifetime = 2 * time.Hour
+
+// PortMappingTimeout represents the max duration of a port mapping request
+const PortMappingTimeout = 5 * time.Second
+
+// PortMappingRetryInterval represents the interval of retrying to map the port
+// if no router supports the port mapping
+const PortMappingRetryInterval = 5 * time.Minute
+
+// StreamWriteTimeout represents the max duration of writing a packet into the
+// stream between the node and the gateway
+const StreamWriteTimeout = 5 * time.Second
+
+// StreamQueueSize represents the max count of packets queued to be sent into
+// the stream of a node, the packets are dropped if the queue is full
+const StreamQueueSize = 256
+
+// TransportCheckInterval represents the interval of checking whether the node
+// should fallback to the stream or switch back to UDP
+const TransportCheckInterval = 5 * time.Second
+
+// RelayTokenDuration represents the validity of the token issued by the gateway
+// to bind the relay servers, which is renewed by every heartbeat
+const RelayTokenDuration = 3 * HeartbeatInterval * time.Second
+
+// RelayBindInterval represents the interval of binding the node to the relay
+// servers, which also measures the round-trip time to the relays
+const RelayBindInterval = 10 * time.Second
+
+// RelayBindExpire represents the duration after which the binding is removed by
+// the relay server, and the relay is considered unavailable by the node if not
+// answered for the duration
+const RelayBindExpire = 3 * RelayBindInterval
+
+// PathCheckInterval represents the interval of checking whether the direct path
+// and the relay of each connection still work
+const PathCheckInterval = time.Second
+
+// PathProbeInterval represents the interval of probing the direct paths in
+// background while the packets are relayed
+const PathProbeInterval = time.Second
+
+// PathProbingTimeout represents the max duration of probing the direct paths
+// before sending the packets via the relay
+const PathProbingTimeout = 5 * time.Second
+
+// PathDegradeTimeout represents the max duration without the Pong via the
+// direct path, after which the packets are sent via the relay
+const PathDegradeTimeout = PeerKeepaliveDuration + ProbeTimeout
+
+// PingExpire represents the max duration of waiting the Pong answering a Ping,
+// the Pong answering an expired Ping cannot prove the path available
+const PingExpire = PathDegradeTimeout
+
+// PathFailedTimeout represents the max duration without the Pong via the relay,
+// after which the connection is failed and the tunnel is reopened
+const PathFailedTimeout = 3 * PeerKeepaliveDuration
+
+// PathFailedExpire represents the max duration of a failed connection, which
+// is closed to release the resources after the duration
+const PathFailedExpire = time.Minute
+
+// HeartbeatRetryInterval represents the interval of retrying the heartbeat if
+// the previous one is unanswered by the gateway
+const HeartbeatRetryInterval = 5 * time.Second
+
+// GatewayLostTimeout represents the max duration without any heartbeat answered
+// by the gateway, after which the node rebinds the UDP socket
+const GatewayLostTimeout = HeartbeatInterval*time.Second + 2*HeartbeatRetryInterval
+
+// NetworkCheckInterval represents the interval of checking whether the local
+// network changed, e.g: the Wi-Fi switched or the DHCP lease renewed
+const NetworkCheckInterval = 2 * time.Second
+
+// RebindRetryInterval represents the min interval of rebinding the UDP socket
+const RebindRetryInterval = time.Second
+
+// ControlDialTimeout represents the timeout of dialing the control stream
+const ControlDialTimeout = 10 * time.Second
+
+// ControlAckTimeout represents the max duration waiting for the acknowledgement
+// of a control message, the message fails if exceeded
+const ControlAckTimeout = 5 * time.Second
+
+// ControlRetryInterval represents the interval of reconnecting the control
+// stream after it is closed
+const ControlRetryInterval = 3 * time.Second
+
+// ControlKeepaliveInterval represents the interval of the keepalive pings of
+// the control stream, which detect the broken connection
+const ControlKeepaliveInterval = 10 * time.Second
+
+// ControlConcurrency represents the max count of the control messages handled
+// concurrently for each node, the others are rejected
+const ControlConcurrency = 16
+
+// MaxNonces represents the max count of nonces remembered for each peer to
+// reject the replayed packets, the packets older than the forgotten nonces are
+// rejected as well
+const MaxNonces = 1024
+
+// NonceExpire represents the max clock skew of the signed packets, the packets
+// signed earlier are rejected, so the nonces are forgotten after the duration
+const NonceExpire = 5 * time.Minute
@@ -0,0 +1,116 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lonng/zetamesh/codec"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// binder answers the STUN-like binding requests with the address observed by
+// the gateway, which are used by the nodes to detect the NAT behavior. The
+// secondary port is used to answer from another port if requested, which
+// tells whether the NAT filters the packets by the source port.
+type binder struct {
+	primary   *net.UDPConn
+	secondary *net.UDPConn // Nil if the binding port is disabled
+
+	mu      sync.Mutex
+	window  time.Time      // The start of current rate limit window
+	answers map[string]int // source IP -> count of answers in current window
+}
+
+// port returns the secondary binding port, zero means disabled
+func (b *binder) port() uint32 {
+	if b.secondary == nil {
+		return 0
+	}
+	return uint32(b.secondary.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// allow reports whether the binding request of the source IP can be answered
+// within the rate limit
+func (b *binder) allow(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.window) >= time.Second {
+		b.window = now
+		b.answers = map[string]int{}
+	}
+	key := ip.String()
+	if b.answers[key] >= constant.BindingRateLimit {
+		return false
+	}
+	b.answers[key]++
+	return true
+}
+
+// answer replies the binding request of the size received by the local socket.
+// The response is never larger than the request and the requests are limited
+// for each source, so the spoofed requests cannot be amplified.
+func (b *binder) answer(local *net.UDPConn, remote *net.UDPAddr, req *message.CtrlBinding, size int) error {
+	if req.ChangePort {
+		if b.secondary == nil {
+			return nil
+		}
+		if local == b.primary {
+			local = b.secondary
+		} else {
+			local = b.primary
+		}
+	}
+
+	data := codec.Encode(message.PacketType_BindingAck, &message.CtrlBindingAck{
+		TransactionId: req.TransactionId,
+		MappedAddress: remote.String(),
+	})
+	if len(data) > size || !b.allow(remote.IP) {
+		return nil
+	}
+	_, err := local.WriteToUDP(data, remote)
+	return errors.WithStack(err)
+}
+
+// serve answers the binding requests received by the secondary port
+func (b *binder) serve() {
+	buffer := make([]byte, constant.MaxBufferSize)
+	for {
+		n, remote, err := b.secondary.ReadFromUDP(buffer)
+		if err != nil {
+			udpReadErrors.Inc()
+			zap.L().Error("Read UDP packet of binding port failed", zap.Error(err))
+			continue
+		}
+		if n < 1 || message.PacketType(buffer[0]) != message.PacketType_Binding {
+			continue
+		}
+		req := &message.CtrlBinding{}
+		if err := proto.Unmarshal(buffer[1:n], req); err != nil {
+			continue
+		}
+		if err := b.answer(b.secondary, remote, req, n); err != nil {
+			zap.L().Error("Answer binding request failed", zap.Stringer("remote", remote), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// controlServer serves the control streams of the nodes, each node keeps one
+// stream which carries the tunnel requests and the notifications to the node
+type controlServer struct {
+	server   *api.Server
+	notifier *notifier
+}
+
+// controlSession represents the registered control stream of a node, the
+// messages to and from the node are handled concurrently up to ControlConcurrency.
+// The goroutines using the stream are tracked, so the stream is not used after
+// the handler returned and the transport released.
+type controlSession struct {
+	stream *api.ControlStream
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+}
+
+func newControlSession(stream *api.ControlStream) *controlSession {
+	return &controlSession{
+		stream: stream,
+		slots:  make(chan struct{}, constant.ControlConcurrency),
+	}
+}
+
+// acquire reports false if ControlConcurrency messages are being handled
+func (s *controlSession) acquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release releases the slot acquired
+func (s *controlSession) release() {
+	<-s.slots
+}
+
+// spawn runs the function using the stream in a tracked goroutine, and reports
+// false if the session has been closed
+func (s *controlSession) spawn(fn func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		fn()
+	}()
+	return true
+}
+
+// close closes the stream and waits for the goroutines using the stream
+func (s *controlSession) close() {
+	s.stream.Close()
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.running.Wait()
+}
+
+// serveControl serves the control streams on the HTTP(S) port and the other
+// requests by the handler. HTTP/2 without TLS (h2c) is accepted as well because
+// gRPC requires HTTP/2.
+func serveControl(control *controlServer, handler http.Handler) http.Handler {
+	server := grpc.NewServer()
+	message.RegisterControlServer(server, control)
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+// serveControlSocket serves the control streams via the WebSocket, which is
+// used by the nodes that cannot connect the gRPC stream, e.g: behind the HTTP
+// proxy only supporting HTTP/1.1
+func serveControlSocket(control *controlServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			zap.L().Warn("Upgrade control stream failed", zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+		if err := control.serveStream(api.NewSocketControlStream(conn), r.RemoteAddr); err != nil {
+			zap.L().Info("Serve control stream failed", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		}
+	}
+}
+
+// Connect implements the message.ControlServer interface
+func (s *controlServer) Connect(transport message.Control_ConnectServer) error {
+	remote := "unknown"
+	if p, ok := peer.FromContext(transport.Context()); ok {
+		remote = p.Addr.String()
+	}
+	return s.serveStream(api.NewControlStream(transport), remote)
+}
+
+// serveStream authenticates the control stream and serves it until closed
+func (s *controlServer) serveStream(stream *api.ControlStream, remote string) error {
+	defer stream.Close()
+
+	// The stream is authenticated by the first message signed by the node
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	register := msg.GetRegister()
+	if register == nil {
+		return status.Error(codes.Unauthenticated, "the first control message must be the registration")
+	}
+	if err := s.server.Register(peerAddr(remote), register); err != nil {
+		zap.L().Warn("Reject control stream", zap.String("peer", register.VirtAddress), zap.String("remote", remote), zap.Error(err))
+		_ = stream.Ack(msg.Id, err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := stream.Ack(msg.Id, nil); err != nil {
+		return err
+	}
+
+	virtAddress := register.VirtAddress
+	session := newControlSession(stream)
+	defer session.close()
+	s.notifier.register(virtAddress, session)
+	defer s.notifier.unregister(virtAddress, session)
+	zap.L().Info("Control stream registered", zap.String("peer", virtAddress), zap.String("remote", remote))
+
+	// The stream is closed if replaced by a new one of the same peer, or any
+	// notification not acknowledged in time
+	received := make(chan error, 1)
+	go func() {
+		received <- s.serve(session, virtAddress)
+	}()
+	select {
+	case err := <-received:
+		zap.L().Info("Control stream closed", zap.String("peer", virtAddress), zap.String("remote", remote), zap.Error(err))
+	case <-stream.Done():
+		zap.L().Info("Control stream closed by gateway", zap.String("peer", virtAddress), zap.String("remote", remote))
+	}
+	return nil
+}
+
+// serve handles the messages from the peer until the stream closed
+func (s *controlServer) serve(session *controlSession, virtAddress string) error {
+	stream := session.stream
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch payload := msg.Payload.(type) {
+		case *message.ControlMessage_TunnelRequest:
+			// Waiting for the acknowledgements of the peers must not block
+			// receiving the acknowledgements from the stream, and the requests
+			// exceeding the concurrency are rejected instead of queued
+			if !session.acquire() {
+				controlDrops.Inc()
+				err := errors.Errorf("too many pending control messages of peer '%s'", virtAddress)
+				if err := stream.Ack(msg.Id, err); err != nil {
+					zap.L().Warn("Acknowledge tunnel request failed", zap.String("peer", virtAddress), zap.Error(err))
+				}
+				continue
+			}
+			id, dst := msg.Id, payload.TunnelRequest.Destination
+			spawned := session.spawn(func() {
+				defer session.release()
+				err := openTunnel(s.server, virtAddress, dst)
+				if err != nil {
+					zap.L().Warn("Open tunnel failed", zap.String("peer", virtAddress), zap.String("destination", dst), zap.Error(err))
+				}
+				if err := stream.Ack(id, err); err != nil {
+					zap.L().Warn("Acknowledge tunnel request failed", zap.String("peer", virtAddress), zap.Error(err))
+				}
+			})
+			if !spawned {
+				session.release()
+				return api.ErrControlClosed
+			}
+
+		default:
+			zap.L().Warn("Unexpected control message", zap.String("peer", virtAddress), zap.Int64("id", msg.Id))
+		}
+	}
+}
+
+// peerAddr represents the address of the peer connected via the control stream
+type peerAddr string
+
+// Network implements the net.Addr interface
+func (a peerAddr) Network() string {
+	return "tcp"
+}
+
+// String implements the net.Addr interface
+func (a peerAddr) String() string {
+	return string(a)
+}
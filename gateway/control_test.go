@@ -0,0 +1,104 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+// testTransport never acknowledges the messages sent, and counts the messages
+// sent after the transport released
+type testTransport struct {
+	sent     chan *message.ControlMessage
+	closed   chan struct{}
+	released atomic.Bool
+	misused  atomic.Int32
+}
+
+func newTestTransport() *testTransport {
+	return &testTransport{
+		sent:   make(chan *message.ControlMessage, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *testTransport) Send(msg *message.ControlMessage) error {
+	if t.released.Load() {
+		t.misused.Inc()
+	}
+	t.sent <- msg
+	return nil
+}
+
+func (t *testTransport) Recv() (*message.ControlMessage, error) {
+	<-t.closed
+	return nil, errors.New("transport closed")
+}
+
+func TestControlSessionClose(t *testing.T) {
+	n := newNotifier()
+	peers := []*api.PeerInfo{{VirtAddress: "10.0.0.1"}, {VirtAddress: "10.0.0.2"}}
+	transports := make([]*testTransport, len(peers))
+	sessions := make([]*controlSession, len(peers))
+	for i, peer := range peers {
+		transports[i] = newTestTransport()
+		sessions[i] = newControlSession(api.NewControlStream(transports[i]))
+		n.register(peer.VirtAddress, sessions[i])
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- n.OpenTunnel(peers[0], peers[1])
+	}()
+
+	// Close both sessions while the notifications are in flight, as the
+	// handlers of the streams return
+	for i, peer := range peers {
+		<-transports[i].sent
+		n.unregister(peer.VirtAddress, sessions[i])
+		sessions[i].close()
+		transports[i].released.Store(true)
+	}
+	select {
+	case err := <-opened:
+		if errors.Cause(err) != api.ErrControlClosed {
+			t.Errorf("expected the control stream closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("open tunnel not finished after the sessions closed")
+	}
+
+	// The closed sessions are never used even if referenced by others
+	for i, peer := range peers {
+		n.register(peer.VirtAddress, sessions[i])
+	}
+	n.UpdatePeer(&api.PeerInfo{VirtAddress: "10.0.0.3"})
+	if err := n.OpenTunnel(peers[0], peers[1]); err == nil {
+		t.Error("open tunnel via the closed session succeeded")
+	}
+	if err := sessions[0].stream.Send(&message.ControlMessage{}); err != api.ErrControlClosed {
+		t.Errorf("expected the control stream closed, got %v", err)
+	}
+	for i, transport := range transports {
+		if misused := transport.misused.Load(); misused > 0 {
+			t.Errorf("transport %d used %d times after released", i, misused)
+		}
+	}
+}
@@ -18,23 +18,37 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/constant"
 	"github.com/lonng/zetamesh/message"
 	"github.com/pingcap/fn"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
 // Options repsents the CLI arguments of Zetamesh gateway node
 type Options struct {
-	Host        string
-	Port        int
-	Concurrency int
-	Key         string
-	TLSCert     string
-	TLSKey      string
+	Host             string
+	Port             int
+	Concurrency      int
+	Key              string
+	AdminKey         string // The admin API is disabled if not specified
+	TLSCert          string
+	TLSKey           string
+	Networks         []string
+	LeaseDuration    time.Duration
+	MissedHeartbeats int           // The peer is marked offline after missing the count of heartbeats
+	PeerExpire       time.Duration // The peer is removed after missing heartbeats for the duration
+	Storage          string        // The registry storage type (memory/file)
+	DataPath         string        // The database file path of the file storage
+	AdminAddr        string        // The separate listen address of the admin API and metrics
+	BindingPort      int           // The secondary UDP port answering the binding requests, zero means disabled
+	Relays           []string      // The dedicated relay servers advertised to the peers
+	RelaySecret      string        // The secret shared with the relay servers to sign the relay tokens
 }
 
 // setupMiddleware is used to setting up all middlewares, e.g:
@@ -79,8 +93,80 @@ func setupMiddleware() {
 	})
 }
 
+// parseNetworks parses the virtual networks and at most one network of each
+// address family is allowed
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	families := map[bool]string{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid network %s", cidr)
+		}
+		ipv4 := network.IP.To4() != nil
+		if prev, found := families[ipv4]; found {
+			return nil, errors.Errorf("network %s and %s have the same address family", prev, cidr)
+		}
+		families[ipv4] = cidr
+		networks = append(networks, network)
+	}
+	if len(networks) == 0 {
+		return nil, errors.New("at least one network should be specified")
+	}
+	return networks, nil
+}
+
+// openStorage opens the registry storage of the specified type
+func openStorage(typ, path string) (api.Storage, error) {
+	switch typ {
+	case "memory":
+		return api.NewMemoryStorage(), nil
+	case "file":
+		return api.NewFileStorage(path)
+	default:
+		return nil, errors.Errorf("unsupported storage type '%s'", typ)
+	}
+}
+
+// listen serves the HTTP service on the address, and TLS is enabled if the
+// certificate specified
+func listen(addr string, opt Options, handler http.Handler) {
+	var err error
+	if len(opt.TLSCert) > 0 {
+		err = http.ListenAndServeTLS(addr, opt.TLSCert, opt.TLSKey, handler)
+	} else {
+		err = http.ListenAndServe(addr, handler)
+	}
+	if err != nil {
+		zap.L().Fatal("Listen HTTP port failed", zap.String("address", addr), zap.Error(err))
+	}
+}
+
 // Serve serves the gateway service
 func Serve(opt Options) error {
+	networks, err := parseNetworks(opt.Networks)
+	if err != nil {
+		return err
+	}
+	if opt.MissedHeartbeats < 1 {
+		return errors.Errorf("invalid missed heartbeats %d", opt.MissedHeartbeats)
+	}
+	offlineTimeout := time.Duration(opt.MissedHeartbeats) * constant.HeartbeatInterval * time.Second
+	if opt.PeerExpire < offlineTimeout {
+		return errors.Errorf("peer expire %s is shorter than the offline timeout %s", opt.PeerExpire, offlineTimeout)
+	}
+
+	relays, err := newRelayAuthority(opt.Relays, opt.RelaySecret)
+	if err != nil {
+		return err
+	}
+
+	storage, err := openStorage(opt.Storage, opt.DataPath)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
 	setupMiddleware()
 
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: opt.Port})
@@ -91,36 +177,77 @@ func Serve(opt Options) error {
 
 	zap.L().Info("Listen UDP successfully", zap.Int("port", opt.Port))
 
+	// The secondary port is used by the nodes to detect the NAT behavior
+	binder := &binder{primary: conn}
+	if opt.BindingPort > 0 {
+		secondary, err := net.ListenUDP("udp", &net.UDPAddr{Port: opt.BindingPort})
+		if err != nil {
+			return errors.WithMessagef(err, "listen binding port %d", opt.BindingPort)
+		}
+		defer secondary.Close()
+		binder.secondary = secondary
+		go binder.serve()
+	}
+
 	var (
-		notifier  = newNotifier()
-		server    = api.NewServer(notifier, opt.Key)
-		processor = newProcessor(server, notifier)
+		notifier = newNotifier()
+		server   = api.NewServer(notifier, api.ServerOptions{
+			Key:            opt.Key,
+			AdminKey:       opt.AdminKey,
+			Networks:       networks,
+			LeaseDuration:  opt.LeaseDuration,
+			OfflineTimeout: offlineTimeout,
+			ExpireTimeout:  opt.PeerExpire,
+			Storage:        storage,
+		})
+		processor = newProcessor(server, notifier, binder, relays)
 		buffer    = make([]byte, constant.MaxBufferSize)
 	)
 
+	// Expire the peers which missed heartbeats
+	go server.Reap(context.Background())
+
 	// Serve the notifier service
 	go notifier.start(conn, opt.Concurrency)
 
 	// Initialize the HTTP service and register all APIs
 	router := mux.NewRouter()
-	router.Handle(api.URIOpenTunnel, fn.Wrap(server.OpenTunnel)).Methods(http.MethodPost)
-
-	go func() {
-		var err error
-		addr := fmt.Sprintf("%s:%d", opt.Host, opt.Port)
-		if len(opt.TLSCert) > 0 {
-			err = http.ListenAndServeTLS(addr, opt.TLSCert, opt.TLSKey, router)
-		} else {
-			err = http.ListenAndServe(addr, router)
-		}
-		if err != nil {
-			zap.L().Fatal("Listen HTTP port failed", zap.Error(err))
-		}
-	}()
+	router.Handle(api.URILease, fn.Wrap(server.Lease)).Methods(http.MethodPost)
+	router.Handle(api.URIStream, serveStream(processor, notifier)).Methods(http.MethodGet)
+
+	// The control streams are served on the same port with the HTTP API, via
+	// gRPC or the WebSocket if the gRPC stream cannot be connected
+	control := &controlServer{server: server, notifier: notifier}
+	router.Handle(api.URIControl, serveControlSocket(control)).Methods(http.MethodGet)
+
+	// The admin API and metrics are served on the separate address if specified,
+	// which is usually only accessible to the administrator
+	admin := router
+	if opt.AdminAddr != "" {
+		admin = mux.NewRouter()
+	}
+	registerMetrics(storage)
+	admin.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	if opt.AdminKey != "" {
+		admin.Handle(api.URIPeers, fn.Wrap(server.ListPeers)).Methods(http.MethodGet)
+		admin.Handle(api.URIPeer, fn.Wrap(server.GetPeer)).Methods(http.MethodGet)
+		admin.Handle(api.URIPeer, fn.Wrap(server.EvictPeer)).Methods(http.MethodDelete)
+		admin.Handle(api.URIPeerBan, fn.Wrap(server.BanPeer)).Methods(http.MethodPost)
+		admin.Handle(api.URIBans, fn.Wrap(server.ListBans)).Methods(http.MethodGet)
+		admin.Handle(api.URIBan, fn.Wrap(server.Unban)).Methods(http.MethodDelete)
+	}
+	// The routes are registered before serving, the router isn't safe to modify
+	// concurrently with serving
+	if opt.AdminAddr != "" {
+		go listen(opt.AdminAddr, opt, admin)
+	}
+
+	go listen(fmt.Sprintf("%s:%d", opt.Host, opt.Port), opt, serveControl(control, router))
 
 	for {
 		n, remote, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			udpReadErrors.Inc()
 			zap.L().Error("Read UDP packet failed", zap.Error(err))
 			continue
 		}
@@ -0,0 +1,170 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "zetamesh"
+	metricsSubsystem = "gateway"
+)
+
+// Gateway metrics
+var (
+	openTunnelRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "open_tunnel_requests_total",
+		Help:      "The total count of OpenTunnel requests.",
+	})
+
+	openTunnelFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "open_tunnel_failures_total",
+		Help:      "The total count of failed OpenTunnel requests by status code.",
+	}, []string{"code"})
+
+	controlStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "control_streams",
+		Help:      "The count of nodes registered via the control stream.",
+	})
+
+	controlUnacknowledged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "control_unacknowledged_total",
+		Help:      "The total count of notifications not acknowledged by the peers.",
+	})
+
+	controlDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "control_dropped_total",
+		Help:      "The total count of control messages rejected or dropped because the peer has too many pending.",
+	})
+
+	relayPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "relay_packets_total",
+		Help:      "The total count of packets relayed between the peers.",
+	})
+
+	relayBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "relay_bytes_total",
+		Help:      "The total bytes of the payload relayed between the peers.",
+	})
+
+	udpReadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "udp_read_errors_total",
+		Help:      "The total count of errors reading the UDP socket.",
+	})
+
+	streamConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "stream_connections",
+		Help:      "The count of nodes connected via the stream fallback.",
+	})
+
+	streamDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "stream_drops_total",
+		Help:      "The total count of packets dropped due to the stream queue full.",
+	})
+)
+
+// registerMetrics registers the gateway metrics, which are only registered by
+// the gateway process to avoid exporting them in the node process
+func registerMetrics(storage api.Storage) {
+	prometheus.MustRegister(
+		newPeerCollector(storage),
+		openTunnelRequests,
+		openTunnelFailures,
+		controlStreams,
+		controlUnacknowledged,
+		controlDrops,
+		relayPackets,
+		relayBytes,
+		udpReadErrors,
+		streamConnections,
+		streamDrops,
+	)
+}
+
+// peerCollector collects the count of peers from the registry storage when scraped
+type peerCollector struct {
+	storage    api.Storage
+	registered *prometheus.Desc
+	online     *prometheus.Desc
+}
+
+func newPeerCollector(storage api.Storage) *peerCollector {
+	return &peerCollector{
+		storage: storage,
+		registered: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "peers_registered"),
+			"The count of peers registered in the gateway.", nil, nil),
+		online: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "peers_online"),
+			"The count of registered peers which are online.", nil, nil),
+	}
+}
+
+// Describe implements the prometheus.Collector interface
+func (c *peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.registered
+	ch <- c.online
+}
+
+// Collect implements the prometheus.Collector interface
+func (c *peerCollector) Collect(ch chan<- prometheus.Metric) {
+	peers := c.storage.Peers()
+	online := 0
+	for _, peer := range peers {
+		if !peer.Offline {
+			online++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.registered, prometheus.GaugeValue, float64(len(peers)))
+	ch <- prometheus.MustNewConstMetric(c.online, prometheus.GaugeValue, float64(online))
+}
+
+// openTunnel opens the tunnel requested by the peer and counts the requests
+// and failures
+func openTunnel(server *api.Server, src, dst string) error {
+	openTunnelRequests.Inc()
+	err := server.OpenTunnel(src, dst)
+	if err != nil {
+		code := message.StatusCode_ServerInternal
+		if e, ok := errors.Cause(err).(*api.Error); ok {
+			code = e.Code
+		}
+		openTunnelFailures.WithLabelValues(code.String()).Inc()
+	}
+	return err
+}
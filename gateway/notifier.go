@@ -14,15 +14,15 @@
 package gateway
 
 import (
+	"hash/fnv"
 	"net"
 	"sync"
-	"time"
 
 	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/codec"
 	"github.com/lonng/zetamesh/constant"
 	"github.com/lonng/zetamesh/message"
-	"go.uber.org/atomic"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
@@ -30,54 +30,49 @@ import (
 type packet struct {
 	destination string // IP:PORT
 	typ         message.PacketType
-	message     interface{}
-}
-
-type retryPacket struct {
-	packet
-	counter int64
+	message     proto.Message
 }
 
 type notifier struct {
 	queue chan packet
-	ackID atomic.Int64
 
-	mu   sync.Mutex
-	data map[int64]retryPacket
-	read chan struct{}
+	mu       sync.Mutex
+	sessions map[string]*controlSession // primary virtAddr -> control session
+
+	streams sync.Map // stream address -> *streamWriter
 }
 
 func newNotifier() *notifier {
 	return &notifier{
-		queue: make(chan packet, 16),
-		data:  map[int64]retryPacket{},
-		read:  make(chan struct{}, 16),
-	}
-}
-
-func (n *notifier) notify() {
-	select {
-	case n.read <- struct{}{}:
-	default:
+		queue:    make(chan packet, 16),
+		sessions: map[string]*controlSession{},
 	}
 }
 
 func (n *notifier) start(conn *net.UDPConn, concurrency int) {
 	worker := func(ch chan packet) {
 		for p := range ch {
+			data := codec.Encode(p.typ, p.message)
+
+			// The peer connected via the stream cannot receive UDP packets
+			if api.IsStreamAddress(p.destination) {
+				writer, found := n.streams.Load(p.destination)
+				if !found {
+					zap.L().Debug("Stream of destination closed", zap.String("destination", p.destination), zap.Stringer("type", p.typ))
+					continue
+				}
+				if !writer.(*streamWriter).send(data) {
+					streamDrops.Inc()
+					zap.L().Debug("Drop message due to stream queue full", zap.String("destination", p.destination), zap.Stringer("type", p.typ))
+				}
+				continue
+			}
+
 			dest, err := net.ResolveUDPAddr("udp", p.destination)
 			if err != nil {
 				zap.L().Error("Unexpected destination address", zap.String("destination", p.destination))
 				continue
 			}
-
-			var data []byte
-			switch payload := p.message.(type) {
-			case proto.Message:
-				data = codec.Encode(p.typ, payload)
-			case []byte:
-				data = codec.EncodeRaw(payload)
-			}
 			_, err = conn.WriteToUDP(data, dest)
 			if err != nil {
 				zap.L().Error("Send message failed", zap.String("destination", p.destination), zap.Stringer("type", p.typ), zap.Error(err))
@@ -86,78 +81,157 @@ func (n *notifier) start(conn *net.UDPConn, concurrency int) {
 		}
 	}
 
-	roundTrip := 0
 	chs := make([]chan packet, concurrency)
 	for i := 0; i < concurrency; i++ {
 		chs[i] = make(chan packet, 256)
 		go worker(chs[i])
 	}
 
-	// Dispatch a packet into send queue
+	// Dispatch a packet into send queue, the packets to the same destination are
+	// dispatched to the same worker to keep them in order, e.g: the relayed data
+	// must not overtake the handshake.
 	send := func(p packet) {
-		chs[roundTrip%len(chs)] <- p
-		roundTrip++
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(p.destination))
+		chs[h.Sum32()%uint32(len(chs))] <- p
 	}
 
-	// Retry will put the retryData into the queue
-	retry := func() {
-		n.mu.Lock()
-		defer n.mu.Unlock()
-		for ackID, rp := range n.data {
-			if rp.counter > constant.MaxRetrySend {
-				delete(n.data, ackID)
-				continue
-			}
-			send(rp.packet)
+	for p := range n.queue {
+		send(p)
+	}
+}
+
+// OpenTunnel notifies both peers via their control streams concurrently
+func (n *notifier) OpenTunnel(src, dst *api.PeerInfo) error {
+	peers := []*api.PeerInfo{src, dst}
+	sessions := make([]*controlSession, len(peers))
+	for i, p := range peers {
+		sessions[i] = n.session(p.VirtAddress)
+		if sessions[i] == nil {
+			err := errors.Errorf("peer '%s' has no control stream", p.VirtAddress)
+			return api.ErrorWithCode(message.StatusCode_PeerOffline, err)
 		}
 	}
 
-	retryTicker := time.NewTicker(300 * time.Millisecond)
-	defer retryTicker.Stop()
-	for {
-		select {
-		case <-retryTicker.C:
-			retry()
-		case <-n.read:
-			retry()
-		case p := <-n.queue:
-			send(p)
+	errs := make(chan error, len(peers))
+	for i, p := range peers {
+		session, peer, openTunnel := sessions[i], p.VirtAddress, tunnelOf(peers[1-i])
+		spawned := session.spawn(func() {
+			err := session.stream.Request(&message.ControlMessage{
+				Payload: &message.ControlMessage_OpenTunnel{OpenTunnel: openTunnel},
+			}, constant.ControlAckTimeout)
+			if err != nil {
+				controlUnacknowledged.Inc()
+				err = errors.WithMessagef(err, "notify peer '%s' failed", peer)
+			}
+			errs <- err
+		})
+		if !spawned {
+			errs <- errors.WithMessagef(api.ErrControlClosed, "notify peer '%s' failed", peer)
+		}
+	}
+	var err error
+	for range peers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
 		}
 	}
+	return err
 }
 
-func (n *notifier) OpenTunnel(src, dst *api.PeerInfo) {
+// UpdatePeer notifies the other peers via their control streams that the peer
+// has changed its network, and the peers connected to it open the tunnel to its
+// new candidates. The update is not acknowledged, and dropped for the busy peers.
+func (n *notifier) UpdatePeer(peer *api.PeerInfo) {
+	update := &message.ControlMessage{
+		Payload: &message.ControlMessage_PeerUpdate{PeerUpdate: tunnelOf(peer)},
+	}
 	n.mu.Lock()
-	peers := []*api.PeerInfo{src, dst}
-	for i, p := range peers {
-		ackID := n.ackID.Add(1)
-		n.data[ackID] = retryPacket{
-			packet: packet{
-				destination: p.UDPAddress,
-				typ:         message.PacketType_OpenTunnel,
-				message: &message.CtrlOpenTunnel{
-					AckId:       ackID,
-					VirtAddress: peers[1-i].VirtAddress,
-					UdpAddress:  peers[1-i].UDPAddress,
-				},
-			},
+	defer n.mu.Unlock()
+	for virtAddress, session := range n.sessions {
+		if virtAddress == peer.VirtAddress {
+			continue
+		}
+		if !session.acquire() {
+			controlDrops.Inc()
+			continue
+		}
+		session, virtAddress := session, virtAddress
+		spawned := session.spawn(func() {
+			defer session.release()
+			if err := session.stream.Send(update); err != nil {
+				zap.L().Debug("Send peer update failed", zap.String("peer", virtAddress), zap.Error(err))
+			}
+		})
+		if !spawned {
+			session.release()
 		}
 	}
-	defer n.mu.Unlock()
+}
 
-	n.notify()
+// tunnelOf returns the notification to open the tunnel to the peer
+func tunnelOf(peer *api.PeerInfo) *message.CtrlOpenTunnel {
+	return &message.CtrlOpenTunnel{
+		VirtAddress:    peer.VirtAddress,
+		UdpAddress:     peer.UDPAddress,
+		Addresses:      peer.Addresses,
+		Candidates:     peer.AllCandidates(),
+		NatType:        message.NATType(message.NATType_value[peer.NATType]),
+		RelayLatencies: peer.Relays,
+		PublicKey:      peer.PublicKey,
+	}
 }
 
-func (n *notifier) openTunnelAck(ackID int64) {
+// register replaces the control session of the peer, the previous one is closed
+func (n *notifier) register(virtAddress string, session *controlSession) {
 	n.mu.Lock()
-	delete(n.data, ackID)
+	prev := n.sessions[virtAddress]
+	n.sessions[virtAddress] = session
 	n.mu.Unlock()
+	if prev != nil {
+		prev.stream.Close()
+	} else {
+		controlStreams.Inc()
+	}
+}
+
+// unregister removes the control session of the peer if not replaced
+func (n *notifier) unregister(virtAddress string, session *controlSession) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sessions[virtAddress] == session {
+		delete(n.sessions, virtAddress)
+		controlStreams.Dec()
+	}
+}
+
+func (n *notifier) session(virtAddress string) *controlSession {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sessions[virtAddress]
+}
+
+func (n *notifier) Evict(peer *api.PeerInfo, ack *message.CtrlHeartbeatAck) {
+	n.heartbeatAck(peer.UDPAddress, ack)
+	if session := n.session(peer.VirtAddress); session != nil {
+		session.stream.Close()
+	}
+}
+
+func (n *notifier) heartbeatAck(dest string, ack *message.CtrlHeartbeatAck) {
+	n.queue <- packet{
+		destination: dest,
+		typ:         message.PacketType_HeartbeatAck,
+		message:     ack,
+	}
 }
 
-func (n *notifier) relay(dest string, data []byte) {
+func (n *notifier) relay(dest string, relay *message.CtrlRelay) {
+	relayPackets.Inc()
+	relayBytes.Add(float64(len(relay.Data)))
 	n.queue <- packet{
 		destination: dest,
-		typ:         message.PacketType_Data,
-		message:     data,
+		typ:         message.PacketType_Relay,
+		message:     relay,
 	}
 }
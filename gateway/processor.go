@@ -15,6 +15,7 @@ package gateway
 
 import (
 	"net"
+	"sync"
 
 	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/codec"
@@ -24,24 +25,37 @@ import (
 )
 
 var protos = [...]proto.Message{
-	message.PacketType_Heartbeat:     &message.CtrlHeartbeat{},
-	message.PacketType_OpenTunnelAck: &message.CtrlOpenTunnelAck{},
-	message.PacketType_Relay:         &message.CtrlRelay{},
+	message.PacketType_Heartbeat: &message.CtrlHeartbeat{},
+	message.PacketType_Relay:     &message.CtrlRelay{},
+	message.PacketType_Binding:   &message.CtrlBinding{},
 }
 
 type processor struct {
 	server   *api.Server
 	notifier *notifier
+	binder   *binder
+	relays   *relayAuthority
+
+	// The packets are processed one by one because the messages are reused,
+	// and the streams are processed concurrently with the UDP port
+	mu sync.Mutex
 }
 
-func newProcessor(server *api.Server, notifier *notifier) *processor {
+func newProcessor(server *api.Server, notifier *notifier, binder *binder, relays *relayAuthority) *processor {
 	return &processor{
 		server:   server,
 		notifier: notifier,
+		binder:   binder,
+		relays:   relays,
 	}
 }
 
-func (p *processor) process(addr *net.UDPAddr, data []byte) error {
+// process processes the packet from the UDP address, or the stream address
+// if the node connected via the stream
+func (p *processor) process(addr net.Addr, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	packetType := message.PacketType(data[0])
 	if int(packetType) >= len(protos) {
 		return errors.Errorf("unrecognized message type: %d", packetType)
@@ -63,19 +77,61 @@ func (p *processor) process(addr *net.UDPAddr, data []byte) error {
 		if heartbeat.VirtAddress == "" {
 			return nil
 		}
-		p.server.Heartbeat(addr, heartbeat)
+		err := p.server.Heartbeat(addr, heartbeat)
+		// Answer the peer explicitly if the heartbeat rejected, the stale or
+		// unauthenticated heartbeat is ignored silently because it may be
+		// replayed or spoofed by others. The ack echoes the heartbeat nonce, so
+		// the node only accepts the answers to its own heartbeats.
+		code := message.StatusCode_Success
+		if err != nil {
+			e, ok := err.(*api.Error)
+			if !ok {
+				return err
+			}
+			code = e.Code
+		}
+		ack := &message.CtrlHeartbeatAck{Code: code, BindingPort: p.binder.port(), HeartbeatNonce: heartbeat.Nonce}
+		for _, network := range p.server.Networks() {
+			ack.Networks = append(ack.Networks, network.String())
+		}
+		if err != nil {
+			ack.Error = err.Error()
+		} else {
+			p.relays.grant(ack, heartbeat.VirtAddress, heartbeat.PublicKey)
+		}
+		p.server.SignHeartbeatAck(heartbeat.VirtAddress, ack)
+		p.notifier.heartbeatAck(addr.String(), ack)
+		return err
 
-	case message.PacketType_OpenTunnelAck:
-		ack := protoType.(*message.CtrlOpenTunnelAck)
-		p.notifier.openTunnelAck(ack.AckId)
+	case message.PacketType_Binding:
+		// The NAT behavior can only be detected via UDP
+		remote, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return nil
+		}
+		return p.binder.answer(p.binder.primary, remote, protoType.(*message.CtrlBinding), len(data))
 
 	case message.PacketType_Relay:
 		relay := protoType.(*message.CtrlRelay)
+		if !p.server.AuthenticateRelay(relay) {
+			return errors.Errorf("relay packet from %s signed with mismatched key or replayed", addr)
+		}
+		// The source must be the peer registered at the remote address, which
+		// prevents the peers from impersonating others
+		src := p.server.Peer(relay.Source)
+		if src == nil || src.UDPAddress != addr.String() {
+			return errors.Errorf("relay packet from %s impersonates peer '%s'", addr, relay.Source)
+		}
 		dst := p.server.Peer(relay.VirtAddress)
-		if dst == nil {
-			return errors.Errorf("destination peer '%s' not found", relay.VirtAddress)
+		if dst == nil || dst.Offline || dst.UDPAddress == "" {
+			return errors.Errorf("destination peer '%s' is offline", relay.VirtAddress)
 		}
-		p.notifier.relay(dst.UDPAddress, relay.Data)
+		// The data is encrypted end-to-end and forwarded to the destination as is
+		p.notifier.relay(dst.UDPAddress, &message.CtrlRelay{
+			VirtAddress: relay.VirtAddress,
+			Source:      relay.Source,
+			Data:        relay.Data,
+		})
 	}
 
 	return nil
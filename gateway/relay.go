@@ -0,0 +1,59 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"crypto/ed25519"
+	"net"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+)
+
+// relayAuthority advertises the dedicated relay servers to the peers, and
+// issues the tokens which authorize the peers to bind the relay servers
+type relayAuthority struct {
+	relays []string
+	secret string // Shared with the relay servers to verify the tokens
+}
+
+func newRelayAuthority(relays []string, secret string) (*relayAuthority, error) {
+	if len(relays) == 0 {
+		return &relayAuthority{}, nil
+	}
+	if secret == "" {
+		return nil, errors.New("the relay secret must be specified with the relay servers")
+	}
+	for _, relay := range relays {
+		if _, err := net.ResolveUDPAddr("udp", relay); err != nil {
+			return nil, errors.WithMessagef(err, "invalid relay server %s", relay)
+		}
+	}
+	return &relayAuthority{relays: relays, secret: secret}, nil
+}
+
+// grant attaches the relay servers and the token of the peer to the heartbeat
+// ack, the token is bound to the identity of the peer
+func (r *relayAuthority) grant(ack *message.CtrlHeartbeatAck, virtAddress string, public ed25519.PublicKey) {
+	if len(r.relays) == 0 {
+		return
+	}
+	expiry := time.Now().Add(constant.RelayTokenDuration).UnixNano()
+	ack.Relays = r.relays
+	ack.RelayToken = api.RelayToken(r.secret, virtAddress, public, expiry)
+	ack.RelayTokenExpiry = expiry
+}
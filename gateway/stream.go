@@ -0,0 +1,115 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"go.uber.org/zap"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  constant.MaxBufferSize,
+	WriteBufferSize: constant.MaxBufferSize,
+}
+
+// streamWriter sends the packets into the stream of a node in its own goroutine,
+// so a slow node never blocks the notifier workers shared by other nodes.
+type streamWriter struct {
+	stream *api.Stream
+	queue  chan []byte
+	die    chan struct{}
+}
+
+func newStreamWriter(stream *api.Stream) *streamWriter {
+	return &streamWriter{
+		stream: stream,
+		queue:  make(chan []byte, constant.StreamQueueSize),
+		die:    make(chan struct{}),
+	}
+}
+
+// send queues the packet and reports false if the queue is full
+func (w *streamWriter) send(data []byte) bool {
+	select {
+	case w.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes the queued packets until the stream closed, the stream is closed
+// if any write failed, which also stops reading the stream.
+func (w *streamWriter) run() {
+	for {
+		select {
+		case data := <-w.queue:
+			if err := w.stream.Write(data); err != nil {
+				zap.L().Warn("Write stream failed", zap.Stringer("remote", w.stream.RemoteAddr()), zap.Error(err))
+				_ = w.stream.Close()
+				return
+			}
+		case <-w.die:
+			return
+		}
+	}
+}
+
+// close stops the writer, the queued packets are discarded
+func (w *streamWriter) close() {
+	close(w.die)
+}
+
+// serveStream serves the streams of the nodes which cannot reach the UDP port,
+// the packets are processed as the UDP packets from the stream address and the
+// packets to the stream address are sent via the stream by the notifier.
+func serveStream(processor *processor, notifier *notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			zap.L().Warn("Upgrade stream failed", zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+		conn.SetReadLimit(constant.MaxBufferSize)
+
+		stream := api.NewStream(conn)
+		addr := api.StreamAddr(r.RemoteAddr)
+		writer := newStreamWriter(stream)
+		go writer.run()
+		notifier.streams.Store(addr.String(), writer)
+		streamConnections.Inc()
+		defer func() {
+			notifier.streams.Delete(addr.String())
+			streamConnections.Dec()
+			writer.close()
+			_ = stream.Close()
+		}()
+
+		zap.L().Info("Stream connected", zap.String("remote", r.RemoteAddr))
+		for {
+			data, err := stream.Read()
+			if err != nil {
+				zap.L().Info("Stream closed", zap.String("remote", r.RemoteAddr), zap.Error(err))
+				return
+			}
+			if err := processor.process(addr, data); err != nil {
+				zap.L().Error("Process message failed", zap.Error(err))
+			}
+		}
+	}
+}
@@ -18,13 +18,16 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/gateway"
 	"github.com/lonng/zetamesh/node"
+	"github.com/lonng/zetamesh/relay"
 	"github.com/lonng/zetamesh/version"
 	"github.com/spf13/cobra"
 )
@@ -70,7 +73,14 @@ func execute() error {
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log", "info", "Specify the log level(error/warn/info/debug)")
 
 	rootCmd.AddCommand(newGatewayCmd())
+	rootCmd.AddCommand(newRelayCmd())
 	rootCmd.AddCommand(newJoinCmd())
+	rootCmd.AddCommand(newStatusCmd())
+	rootCmd.AddCommand(newPeersCmd())
+	rootCmd.AddCommand(newPingCmd())
+	rootCmd.AddCommand(newCountersCmd())
+	rootCmd.AddCommand(newSnapshotCmd())
+	rootCmd.AddCommand(newRestoreCmd())
 
 	return rootCmd.Execute()
 }
@@ -91,12 +101,43 @@ func newGatewayCmd() *cobra.Command {
 	gatewayCmd.Flags().IntVar(&opt.Port, "port", 2823, "The serve port of gateway server")
 	gatewayCmd.Flags().IntVarP(&opt.Concurrency, "concurrency", "c", 128, "The concurrency of sync peer information")
 	gatewayCmd.Flags().StringVar(&opt.Key, "key", "", "The key of the gateway, which is used to validate the peers")
+	gatewayCmd.Flags().StringVar(&opt.AdminKey, "admin-key", "", "The key of the admin API, which is disabled if not specified")
 	gatewayCmd.Flags().StringVar(&opt.TLSCert, "tls-cert", "", "The tls cert path")
 	gatewayCmd.Flags().StringVar(&opt.TLSKey, "tls-key", "", "The tls key path")
+	gatewayCmd.Flags().StringSliceVar(&opt.Networks, "network", []string{"10.0.0.0/16"}, "The virtual network CIDRs (at most one IPv4 and one IPv6 ULA, e.g: fd7a:7a6d::/64), which are used to allocate addresses for the peers joined without address")
+	gatewayCmd.Flags().DurationVar(&opt.LeaseDuration, "lease-duration", time.Hour, "The duration of allocated address lease, which is renewed by the peer heartbeat")
+	gatewayCmd.Flags().IntVar(&opt.MissedHeartbeats, "missed-heartbeats", 3, "The count of missed heartbeats before marking the peer offline")
+	gatewayCmd.Flags().DurationVar(&opt.PeerExpire, "peer-expire", 10*time.Minute, "The duration of missed heartbeats before removing the peer")
+	gatewayCmd.Flags().StringVar(&opt.Storage, "storage", "memory", "The storage type of the peer registry (memory/file), the file storage survives restarts")
+	gatewayCmd.Flags().StringVar(&opt.DataPath, "data", "zetamesh.db", "The database file path of the file storage")
+	gatewayCmd.Flags().IntVar(&opt.BindingPort, "binding-port", 2824, "The secondary UDP port used by the peers to detect the NAT type, which is disabled if zero")
+	gatewayCmd.Flags().StringSliceVar(&opt.Relays, "relay", nil, "The addresses (e.g: relay.example.com:2826) of the dedicated relay servers advertised to the peers")
+	gatewayCmd.Flags().StringVar(&opt.RelaySecret, "relay-secret", "", "The secret shared with the relay servers, which is used to authorize the peers binding the relays")
+	gatewayCmd.Flags().StringVar(&opt.AdminAddr, "admin-addr", "", "The separate listen address (e.g: 127.0.0.1:2825) of the admin API and /metrics, which are served on the gateway port if not specified")
 
 	return gatewayCmd
 }
 
+func newRelayCmd() *cobra.Command {
+	var opt relay.Options
+
+	relayCmd := &cobra.Command{
+		Use:     "relay",
+		Short:   "Startup a zetamesh relay server which only forwards the packets between the peers",
+		Version: version.NewVersion().String(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return relay.Serve(opt)
+		},
+	}
+
+	relayCmd.Flags().StringVar(&opt.Host, "host", "0.0.0.0", "The serve host of relay server")
+	relayCmd.Flags().IntVar(&opt.Port, "port", 2826, "The serve port of relay server")
+	relayCmd.Flags().StringVar(&opt.Secret, "secret", "", "The secret shared with the gateway (--relay-secret), which is used to authorize the peers")
+	relayCmd.Flags().StringVar(&opt.Metrics, "metrics-addr", "", "The listen address (e.g: 127.0.0.1:9826) of the Prometheus metrics, which are disabled if not specified")
+
+	return relayCmd
+}
+
 func newJoinCmd() *cobra.Command {
 	var opt node.Options
 
@@ -106,11 +147,6 @@ func newJoinCmd() *cobra.Command {
 		Version:      version.NewVersion().String(),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// TODO: support DHCP
-			if opt.Address == "" {
-				return cmd.Help()
-			}
-
 			node := node.New(opt)
 			defer node.Stop()
 
@@ -120,8 +156,275 @@ func newJoinCmd() *cobra.Command {
 
 	joinCmd.Flags().StringVarP(&opt.Gateway, "gateway", "g", "127.0.0.1:2823", "The gateway server address")
 	joinCmd.Flags().StringVarP(&opt.Key, "key", "k", "", "The key to connect to the gateway")
-	joinCmd.Flags().StringVarP(&opt.Address, "address", "a", "", "(Required)The address of local node")
+	joinCmd.Flags().StringSliceVarP(&opt.Address, "address", "a", nil, "The addresses of local node in IP or CIDR form (one IPv4 and one IPv6 at most), which will be allocated by the gateway if not specified")
 	joinCmd.Flags().BoolVar(&opt.TLS, "tls", false, "Enable the TLS")
+	joinCmd.Flags().StringVar(&opt.Identity, "identity", node.DefaultIdentityPath(), "The identity file of local node, which will be generated if not exists")
+	joinCmd.Flags().StringVar(&opt.Control, "control", node.DefaultControlPath(), "The control socket path of local node, which is used by the status/peers commands")
+	joinCmd.Flags().BoolVar(&opt.PortMapping, "port-mapping", true, "Map the node port on the router with PCP, NAT-PMP or UPnP, and offer the mapped address to the peers")
+	joinCmd.Flags().StringVar(&opt.Metrics, "metrics-addr", "", "The listen address (e.g: 127.0.0.1:9823) of the Prometheus metrics, which are disabled if not specified")
 
 	return joinCmd
 }
+
+func newStatusCmd() *cobra.Command {
+	var control string
+
+	statusCmd := &cobra.Command{
+		Use:          "status",
+		Short:        "Show the status of the local node",
+		Version:      version.NewVersion().String(),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := node.NewControlClient(control).Status()
+			if err != nil {
+				return err
+			}
+
+			gateway := "unreachable"
+			if status.GatewayReachable {
+				gateway = "reachable via " + status.Transport
+			}
+			if !status.LastHeartbeatAck.IsZero() {
+				gateway += fmt.Sprintf(", last heartbeat %s ago", time.Since(status.LastHeartbeatAck).Round(time.Second))
+			}
+			fmt.Printf("Address:   %s\n", strings.Join(status.Addresses, ", "))
+			fmt.Printf("Gateway:   %s (%s)\n", status.Gateway, gateway)
+			if status.Control {
+				fmt.Println("Control:   connected")
+			} else {
+				fmt.Println("Control:   disconnected")
+			}
+			fmt.Printf("NAT:       %s", strings.TrimPrefix(status.NATType, "NAT"))
+			if status.MappedAddress != "" {
+				fmt.Printf(" (mapped %s)", status.MappedAddress)
+			}
+			fmt.Println()
+			if status.PortMapping != "" {
+				fmt.Printf("Mapping:   %s\n", status.PortMapping)
+			}
+			for _, relay := range status.Relays {
+				state := "inactive"
+				if relay.Active {
+					state = fmt.Sprintf("rtt %s", relay.RTT.Round(time.Microsecond))
+				}
+				fmt.Printf("Relay:     %s (%s)\n", relay.Address, state)
+			}
+			return nil
+		},
+	}
+
+	statusCmd.Flags().StringVar(&control, "control", node.DefaultControlPath(), "The control socket path of local node")
+
+	return statusCmd
+}
+
+func newPeersCmd() *cobra.Command {
+	var control string
+
+	peersCmd := &cobra.Command{
+		Use:          "peers",
+		Short:        "Show the connections of the local node to the peers",
+		Version:      version.NewVersion().String(),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peers, err := node.NewControlClient(control).Peers()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PEER\tSTATE\tREMOTE\tRELAY\tLAST KEEPALIVE\tRTT\tJITTER\tLOSS")
+			for _, peer := range peers {
+				keepalive := fmt.Sprintf("%s ago", time.Since(peer.Keepalive).Round(time.Second))
+				latency := peer.Latency
+				relay := peer.Relay
+				if relay == "" {
+					relay = "gateway"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.1f%%\n", peer.VirtAddress, peer.State, peer.Remote, relay, keepalive,
+					latency.RTT.Round(time.Microsecond), latency.Jitter.Round(time.Microsecond), latency.Loss()*100)
+			}
+			return w.Flush()
+		},
+	}
+
+	peersCmd.Flags().StringVar(&control, "control", node.DefaultControlPath(), "The control socket path of local node")
+
+	return peersCmd
+}
+
+func newCountersCmd() *cobra.Command {
+	var control string
+
+	countersCmd := &cobra.Command{
+		Use:          "counters",
+		Short:        "Show the traffic counters of the local node to the peers",
+		Version:      version.NewVersion().String(),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			counters, err := node.NewControlClient(control).Counters()
+			if err != nil {
+				return err
+			}
+
+			traffic := func(t node.Traffic) string {
+				return fmt.Sprintf("%d/%dB", t.Packets, t.Bytes)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PEER\tSENT DIRECT\tSENT RELAYED\tRECV DIRECT\tRECV RELAYED\tDROP CHANNEL FULL\tDROP NO TUNNEL\tDROP SUBNET MISMATCH")
+			for _, peer := range counters.Peers {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", peer.Peer,
+					traffic(peer.SentDirect), traffic(peer.SentRelayed), traffic(peer.ReceivedDirect), traffic(peer.ReceivedRelayed),
+					peer.Drops.ChannelFull, peer.Drops.NoTunnel, peer.Drops.SubnetMismatch)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			fmt.Printf("\nUnroutable packets: %d\n", counters.Unroutable)
+			fmt.Printf("Unreachable packets: %d\n", counters.Unreachable)
+			return nil
+		},
+	}
+
+	countersCmd.Flags().StringVar(&control, "control", node.DefaultControlPath(), "The control socket path of local node")
+
+	return countersCmd
+}
+
+func newPingCmd() *cobra.Command {
+	var (
+		control  string
+		count    int
+		interval time.Duration
+	)
+
+	pingCmd := &cobra.Command{
+		Use:          "ping <virtual address>",
+		Short:        "Measure the round-trip time to the peer via the mesh tunnel",
+		Version:      version.NewVersion().String(),
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := node.NewControlClient(control)
+
+			var (
+				peer           = args[0]
+				sent, received int
+				min, max, sum  time.Duration
+				latency        node.LatencyStats
+			)
+			for i := 0; count <= 0 || i < count; i++ {
+				if i > 0 {
+					time.Sleep(interval)
+				}
+				sent++
+				result, err := client.Ping(peer)
+				if err != nil {
+					fmt.Printf("probe %s seq=%d: %v\n", peer, i, err)
+					continue
+				}
+				latency = result.Latency
+				if result.Error != "" {
+					fmt.Printf("probe %s seq=%d: %s\n", peer, i, result.Error)
+					continue
+				}
+
+				received++
+				path := "direct"
+				if result.Relayed {
+					path = "relayed"
+				}
+				fmt.Printf("reply from %s seq=%d path=%s time=%s\n", peer, i, path, result.RTT.Round(time.Microsecond))
+				sum += result.RTT
+				if min == 0 || result.RTT < min {
+					min = result.RTT
+				}
+				if result.RTT > max {
+					max = result.RTT
+				}
+			}
+
+			fmt.Printf("--- %s ping statistics ---\n", peer)
+			fmt.Printf("%d probes sent, %d received, %.1f%% loss\n", sent, received, float64(sent-received)*100/float64(sent))
+			if received > 0 {
+				avg := sum / time.Duration(received)
+				fmt.Printf("rtt min/avg/max = %s/%s/%s\n", min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+			}
+			if latency.Sent > 0 {
+				fmt.Printf("connection smoothed rtt = %s, jitter = %s, loss = %.1f%%\n",
+					latency.RTT.Round(time.Microsecond), latency.Jitter.Round(time.Microsecond), latency.Loss()*100)
+			}
+			return nil
+		},
+	}
+
+	pingCmd.Flags().StringVar(&control, "control", node.DefaultControlPath(), "The control socket path of local node")
+	pingCmd.Flags().IntVarP(&count, "count", "c", 4, "The count of probes, probe forever if not positive")
+	pingCmd.Flags().DurationVarP(&interval, "interval", "i", time.Second, "The interval between probes")
+
+	return pingCmd
+}
+
+func newSnapshotCmd() *cobra.Command {
+	var dataPath, output string
+
+	snapshotCmd := &cobra.Command{
+		Use:          "snapshot",
+		Short:        "Write the snapshot of the gateway file storage, the gateway should be stopped",
+		Version:      version.NewVersion().String(),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := api.NewFileStorage(dataPath)
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			if output == "" || output == "-" {
+				return storage.Snapshot(os.Stdout)
+			}
+			file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return storage.Snapshot(file)
+		},
+	}
+
+	snapshotCmd.Flags().StringVar(&dataPath, "data", "zetamesh.db", "The database file path of the file storage")
+	snapshotCmd.Flags().StringVarP(&output, "output", "o", "", "The snapshot file path, the snapshot is written to stdout if not specified")
+
+	return snapshotCmd
+}
+
+func newRestoreCmd() *cobra.Command {
+	var dataPath, input string
+
+	restoreCmd := &cobra.Command{
+		Use:          "restore",
+		Short:        "Replace the gateway file storage with the snapshot, the gateway should be stopped",
+		Version:      version.NewVersion().String(),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			storage, err := api.NewFileStorage(dataPath)
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+			return storage.Restore(file)
+		},
+	}
+
+	restoreCmd.Flags().StringVar(&dataPath, "data", "zetamesh.db", "The database file path of the file storage")
+	restoreCmd.Flags().StringVarP(&input, "input", "i", "", "The snapshot file path")
+	_ = restoreCmd.MarkFlagRequired("input")
+
+	return restoreCmd
+}
@@ -20,7 +20,11 @@
 package message
 
 import (
+	context "context"
 	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	reflect "reflect"
@@ -43,23 +47,33 @@ type PacketType int32
 const (
 	PacketType_Heartbeat     PacketType = 0
 	PacketType_Relay         PacketType = 1
-	PacketType_OpenTunnel    PacketType = 2
-	PacketType_OpenTunnelAck PacketType = 3
+	PacketType_OpenTunnel    PacketType = 2 // Replaced by the control stream
+	PacketType_OpenTunnelAck PacketType = 3 // Replaced by the control stream
 	PacketType_Ping          PacketType = 4
 	PacketType_Pong          PacketType = 5
 	PacketType_Data          PacketType = 6
+	PacketType_HeartbeatAck  PacketType = 7
+	PacketType_Binding       PacketType = 8
+	PacketType_BindingAck    PacketType = 9
+	PacketType_RelayBind     PacketType = 10
+	PacketType_RelayBindAck  PacketType = 11
 )
 
 // Enum value maps for PacketType.
 var (
 	PacketType_name = map[int32]string{
-		0: "Heartbeat",
-		1: "Relay",
-		2: "OpenTunnel",
-		3: "OpenTunnelAck",
-		4: "Ping",
-		5: "Pong",
-		6: "Data",
+		0:  "Heartbeat",
+		1:  "Relay",
+		2:  "OpenTunnel",
+		3:  "OpenTunnelAck",
+		4:  "Ping",
+		5:  "Pong",
+		6:  "Data",
+		7:  "HeartbeatAck",
+		8:  "Binding",
+		9:  "BindingAck",
+		10: "RelayBind",
+		11: "RelayBindAck",
 	}
 	PacketType_value = map[string]int32{
 		"Heartbeat":     0,
@@ -69,6 +83,11 @@ var (
 		"Ping":          4,
 		"Pong":          5,
 		"Data":          6,
+		"HeartbeatAck":  7,
+		"Binding":       8,
+		"BindingAck":    9,
+		"RelayBind":     10,
+		"RelayBindAck":  11,
 	}
 )
 
@@ -99,34 +118,159 @@ func (PacketType) EnumDescriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{0}
 }
 
+type CandidateType int32
+
+const (
+	CandidateType_Host            CandidateType = 0
+	CandidateType_ServerReflexive CandidateType = 1
+	CandidateType_Mapped          CandidateType = 2
+	CandidateType_PeerReflexive   CandidateType = 3
+)
+
+// Enum value maps for CandidateType.
+var (
+	CandidateType_name = map[int32]string{
+		0: "Host",
+		1: "ServerReflexive",
+		2: "Mapped",
+		3: "PeerReflexive",
+	}
+	CandidateType_value = map[string]int32{
+		"Host":            0,
+		"ServerReflexive": 1,
+		"Mapped":          2,
+		"PeerReflexive":   3,
+	}
+)
+
+func (x CandidateType) Enum() *CandidateType {
+	p := new(CandidateType)
+	*p = x
+	return p
+}
+
+func (x CandidateType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CandidateType) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_proto_enumTypes[1].Descriptor()
+}
+
+func (CandidateType) Type() protoreflect.EnumType {
+	return &file_api_proto_enumTypes[1]
+}
+
+func (x CandidateType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CandidateType.Descriptor instead.
+func (CandidateType) EnumDescriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{1}
+}
+
+type NATType int32
+
+const (
+	NATType_NATUnknown             NATType = 0
+	NATType_NATOpen                NATType = 1
+	NATType_NATEndpointIndependent NATType = 2
+	NATType_NATPortRestricted      NATType = 3
+	NATType_NATSymmetric           NATType = 4
+)
+
+// Enum value maps for NATType.
+var (
+	NATType_name = map[int32]string{
+		0: "NATUnknown",
+		1: "NATOpen",
+		2: "NATEndpointIndependent",
+		3: "NATPortRestricted",
+		4: "NATSymmetric",
+	}
+	NATType_value = map[string]int32{
+		"NATUnknown":             0,
+		"NATOpen":                1,
+		"NATEndpointIndependent": 2,
+		"NATPortRestricted":      3,
+		"NATSymmetric":           4,
+	}
+)
+
+func (x NATType) Enum() *NATType {
+	p := new(NATType)
+	*p = x
+	return p
+}
+
+func (x NATType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (NATType) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_proto_enumTypes[2].Descriptor()
+}
+
+func (NATType) Type() protoreflect.EnumType {
+	return &file_api_proto_enumTypes[2]
+}
+
+func (x NATType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use NATType.Descriptor instead.
+func (NATType) EnumDescriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{2}
+}
+
 type StatusCode int32
 
 const (
-	StatusCode_Success        StatusCode = 0
-	StatusCode_ServerInternal StatusCode = 1
-	StatusCode_InvalidVersion StatusCode = 2
-	StatusCode_AddConflicted  StatusCode = 3
-	StatusCode_VersionTooOld  StatusCode = 4
-	StatusCode_KeyNotMatched  StatusCode = 5
+	StatusCode_Success         StatusCode = 0
+	StatusCode_ServerInternal  StatusCode = 1
+	StatusCode_InvalidVersion  StatusCode = 2
+	StatusCode_AddConflicted   StatusCode = 3
+	StatusCode_VersionTooOld   StatusCode = 4
+	StatusCode_KeyNotMatched   StatusCode = 5
+	StatusCode_PoolExhausted   StatusCode = 6
+	StatusCode_PeerOffline     StatusCode = 7
+	StatusCode_PeerEvicted     StatusCode = 8
+	StatusCode_PeerBanned      StatusCode = 9
+	StatusCode_PeerNotFound    StatusCode = 10
+	StatusCode_AddOutOfNetwork StatusCode = 11
 )
 
 // Enum value maps for StatusCode.
 var (
 	StatusCode_name = map[int32]string{
-		0: "Success",
-		1: "ServerInternal",
-		2: "InvalidVersion",
-		3: "AddConflicted",
-		4: "VersionTooOld",
-		5: "KeyNotMatched",
+		0:  "Success",
+		1:  "ServerInternal",
+		2:  "InvalidVersion",
+		3:  "AddConflicted",
+		4:  "VersionTooOld",
+		5:  "KeyNotMatched",
+		6:  "PoolExhausted",
+		7:  "PeerOffline",
+		8:  "PeerEvicted",
+		9:  "PeerBanned",
+		10: "PeerNotFound",
+		11: "AddOutOfNetwork",
 	}
 	StatusCode_value = map[string]int32{
-		"Success":        0,
-		"ServerInternal": 1,
-		"InvalidVersion": 2,
-		"AddConflicted":  3,
-		"VersionTooOld":  4,
-		"KeyNotMatched":  5,
+		"Success":         0,
+		"ServerInternal":  1,
+		"InvalidVersion":  2,
+		"AddConflicted":   3,
+		"VersionTooOld":   4,
+		"KeyNotMatched":   5,
+		"PoolExhausted":   6,
+		"PeerOffline":     7,
+		"PeerEvicted":     8,
+		"PeerBanned":      9,
+		"PeerNotFound":    10,
+		"AddOutOfNetwork": 11,
 	}
 )
 
@@ -141,11 +285,11 @@ func (x StatusCode) String() string {
 }
 
 func (StatusCode) Descriptor() protoreflect.EnumDescriptor {
-	return file_api_proto_enumTypes[1].Descriptor()
+	return file_api_proto_enumTypes[3].Descriptor()
 }
 
 func (StatusCode) Type() protoreflect.EnumType {
-	return &file_api_proto_enumTypes[1]
+	return &file_api_proto_enumTypes[3]
 }
 
 func (x StatusCode) Number() protoreflect.EnumNumber {
@@ -154,7 +298,7 @@ func (x StatusCode) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use StatusCode.Descriptor instead.
 func (StatusCode) EnumDescriptor() ([]byte, []int) {
-	return file_api_proto_rawDescGZIP(), []int{1}
+	return file_api_proto_rawDescGZIP(), []int{3}
 }
 
 type CtrlHeartbeat struct {
@@ -162,7 +306,18 @@ type CtrlHeartbeat struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	VirtAddress    string          `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	Nonce          string          `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Signature      []byte          `protobuf:"bytes,3,opt,name=signature,proto3" json:"signature,omitempty"`
+	PublicKey      []byte          `protobuf:"bytes,4,opt,name=publicKey,proto3" json:"publicKey,omitempty"`
+	Timestamp      int64           `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Proof          []byte          `protobuf:"bytes,6,opt,name=proof,proto3" json:"proof,omitempty"`
+	Addresses      []string        `protobuf:"bytes,7,rep,name=addresses,proto3" json:"addresses,omitempty"`
+	Version        string          `protobuf:"bytes,8,opt,name=version,proto3" json:"version,omitempty"`
+	Candidates     []*Candidate    `protobuf:"bytes,9,rep,name=candidates,proto3" json:"candidates,omitempty"`
+	NatType        NATType         `protobuf:"varint,10,opt,name=natType,proto3,enum=NATType" json:"natType,omitempty"`
+	RelayLatencies []*RelayLatency `protobuf:"bytes,11,rep,name=relayLatencies,proto3" json:"relayLatencies,omitempty"`
+	Endpoint       string          `protobuf:"bytes,12,opt,name=endpoint,proto3" json:"endpoint,omitempty"` // The address of the node observed by the gateway, empty if unknown yet
 }
 
 func (x *CtrlHeartbeat) Reset() {
@@ -204,17 +359,95 @@ func (x *CtrlHeartbeat) GetVirtAddress() string {
 	return ""
 }
 
-type CtrlPing struct {
+func (x *CtrlHeartbeat) GetNonce() string {
+	if x != nil {
+		return x.Nonce
+	}
+	return ""
+}
+
+func (x *CtrlHeartbeat) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeat) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeat) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *CtrlHeartbeat) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeat) GetAddresses() []string {
+	if x != nil {
+		return x.Addresses
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeat) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *CtrlHeartbeat) GetCandidates() []*Candidate {
+	if x != nil {
+		return x.Candidates
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeat) GetNatType() NATType {
+	if x != nil {
+		return x.NatType
+	}
+	return NATType_NATUnknown
+}
+
+func (x *CtrlHeartbeat) GetRelayLatencies() []*RelayLatency {
+	if x != nil {
+		return x.RelayLatencies
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeat) GetEndpoint() string {
+	if x != nil {
+		return x.Endpoint
+	}
+	return ""
+}
+
+type Candidate struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
-	Nonce       string `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Address  string        `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	Type     CandidateType `protobuf:"varint,2,opt,name=type,proto3,enum=CandidateType" json:"type,omitempty"`
+	Priority uint32        `protobuf:"varint,3,opt,name=priority,proto3" json:"priority,omitempty"`
 }
 
-func (x *CtrlPing) Reset() {
-	*x = CtrlPing{}
+func (x *Candidate) Reset() {
+	*x = Candidate{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_api_proto_msgTypes[1]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -222,13 +455,13 @@ func (x *CtrlPing) Reset() {
 	}
 }
 
-func (x *CtrlPing) String() string {
+func (x *Candidate) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CtrlPing) ProtoMessage() {}
+func (*Candidate) ProtoMessage() {}
 
-func (x *CtrlPing) ProtoReflect() protoreflect.Message {
+func (x *Candidate) ProtoReflect() protoreflect.Message {
 	mi := &file_api_proto_msgTypes[1]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -240,36 +473,53 @@ func (x *CtrlPing) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CtrlPing.ProtoReflect.Descriptor instead.
-func (*CtrlPing) Descriptor() ([]byte, []int) {
+// Deprecated: Use Candidate.ProtoReflect.Descriptor instead.
+func (*Candidate) Descriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{1}
 }
 
-func (x *CtrlPing) GetVirtAddress() string {
+func (x *Candidate) GetAddress() string {
 	if x != nil {
-		return x.VirtAddress
+		return x.Address
 	}
 	return ""
 }
 
-func (x *CtrlPing) GetNonce() string {
+func (x *Candidate) GetType() CandidateType {
 	if x != nil {
-		return x.Nonce
+		return x.Type
 	}
-	return ""
+	return CandidateType_Host
 }
 
-type CtrlPong struct {
+func (x *Candidate) GetPriority() uint32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+type CtrlHeartbeatAck struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
-	Nonce       string `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Code             StatusCode `protobuf:"varint,1,opt,name=code,proto3,enum=StatusCode" json:"code,omitempty"`
+	Error            string     `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	Networks         []string   `protobuf:"bytes,3,rep,name=networks,proto3" json:"networks,omitempty"`
+	BindingPort      uint32     `protobuf:"varint,4,opt,name=bindingPort,proto3" json:"bindingPort,omitempty"`
+	Relays           []string   `protobuf:"bytes,5,rep,name=relays,proto3" json:"relays,omitempty"`
+	RelayToken       []byte     `protobuf:"bytes,6,opt,name=relayToken,proto3" json:"relayToken,omitempty"`
+	RelayTokenExpiry int64      `protobuf:"varint,7,opt,name=relayTokenExpiry,proto3" json:"relayTokenExpiry,omitempty"`
+	VirtAddress      string     `protobuf:"bytes,8,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"` // The peer which the ack is sent to
+	Timestamp        int64      `protobuf:"varint,9,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Nonce            string     `protobuf:"bytes,10,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Signature        []byte     `protobuf:"bytes,11,opt,name=signature,proto3" json:"signature,omitempty"`           // The signature by the gateway key
+	HeartbeatNonce   string     `protobuf:"bytes,12,opt,name=heartbeatNonce,proto3" json:"heartbeatNonce,omitempty"` // The nonce of the heartbeat answered, or the last one accepted if unsolicited
 }
 
-func (x *CtrlPong) Reset() {
-	*x = CtrlPong{}
+func (x *CtrlHeartbeatAck) Reset() {
+	*x = CtrlHeartbeatAck{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_api_proto_msgTypes[2]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -277,13 +527,13 @@ func (x *CtrlPong) Reset() {
 	}
 }
 
-func (x *CtrlPong) String() string {
+func (x *CtrlHeartbeatAck) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CtrlPong) ProtoMessage() {}
+func (*CtrlHeartbeatAck) ProtoMessage() {}
 
-func (x *CtrlPong) ProtoReflect() protoreflect.Message {
+func (x *CtrlHeartbeatAck) ProtoReflect() protoreflect.Message {
 	mi := &file_api_proto_msgTypes[2]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -295,37 +545,106 @@ func (x *CtrlPong) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CtrlPong.ProtoReflect.Descriptor instead.
-func (*CtrlPong) Descriptor() ([]byte, []int) {
+// Deprecated: Use CtrlHeartbeatAck.ProtoReflect.Descriptor instead.
+func (*CtrlHeartbeatAck) Descriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{2}
 }
 
-func (x *CtrlPong) GetVirtAddress() string {
+func (x *CtrlHeartbeatAck) GetCode() StatusCode {
+	if x != nil {
+		return x.Code
+	}
+	return StatusCode_Success
+}
+
+func (x *CtrlHeartbeatAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *CtrlHeartbeatAck) GetNetworks() []string {
+	if x != nil {
+		return x.Networks
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeatAck) GetBindingPort() uint32 {
+	if x != nil {
+		return x.BindingPort
+	}
+	return 0
+}
+
+func (x *CtrlHeartbeatAck) GetRelays() []string {
+	if x != nil {
+		return x.Relays
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeatAck) GetRelayToken() []byte {
+	if x != nil {
+		return x.RelayToken
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeatAck) GetRelayTokenExpiry() int64 {
+	if x != nil {
+		return x.RelayTokenExpiry
+	}
+	return 0
+}
+
+func (x *CtrlHeartbeatAck) GetVirtAddress() string {
 	if x != nil {
 		return x.VirtAddress
 	}
 	return ""
 }
 
-func (x *CtrlPong) GetNonce() string {
+func (x *CtrlHeartbeatAck) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *CtrlHeartbeatAck) GetNonce() string {
 	if x != nil {
 		return x.Nonce
 	}
 	return ""
 }
 
-type CtrlOpenTunnel struct {
+func (x *CtrlHeartbeatAck) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *CtrlHeartbeatAck) GetHeartbeatNonce() string {
+	if x != nil {
+		return x.HeartbeatNonce
+	}
+	return ""
+}
+
+type RelayLatency struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	AckId       int64  `protobuf:"varint,1,opt,name=ackId,proto3" json:"ackId,omitempty"`
-	VirtAddress string `protobuf:"bytes,2,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
-	UdpAddress  string `protobuf:"bytes,3,opt,name=udpAddress,proto3" json:"udpAddress,omitempty"`
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	Rtt     int64  `protobuf:"varint,2,opt,name=rtt,proto3" json:"rtt,omitempty"` // The smoothed round-trip time in microseconds
 }
 
-func (x *CtrlOpenTunnel) Reset() {
-	*x = CtrlOpenTunnel{}
+func (x *RelayLatency) Reset() {
+	*x = RelayLatency{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_api_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -333,13 +652,13 @@ func (x *CtrlOpenTunnel) Reset() {
 	}
 }
 
-func (x *CtrlOpenTunnel) String() string {
+func (x *RelayLatency) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CtrlOpenTunnel) ProtoMessage() {}
+func (*RelayLatency) ProtoMessage() {}
 
-func (x *CtrlOpenTunnel) ProtoReflect() protoreflect.Message {
+func (x *RelayLatency) ProtoReflect() protoreflect.Message {
 	mi := &file_api_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -351,42 +670,40 @@ func (x *CtrlOpenTunnel) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CtrlOpenTunnel.ProtoReflect.Descriptor instead.
-func (*CtrlOpenTunnel) Descriptor() ([]byte, []int) {
+// Deprecated: Use RelayLatency.ProtoReflect.Descriptor instead.
+func (*RelayLatency) Descriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{3}
 }
 
-func (x *CtrlOpenTunnel) GetAckId() int64 {
-	if x != nil {
-		return x.AckId
-	}
-	return 0
-}
-
-func (x *CtrlOpenTunnel) GetVirtAddress() string {
+func (x *RelayLatency) GetAddress() string {
 	if x != nil {
-		return x.VirtAddress
+		return x.Address
 	}
 	return ""
 }
 
-func (x *CtrlOpenTunnel) GetUdpAddress() string {
+func (x *RelayLatency) GetRtt() int64 {
 	if x != nil {
-		return x.UdpAddress
+		return x.Rtt
 	}
-	return ""
+	return 0
 }
 
-type CtrlOpenTunnelAck struct {
+type CtrlRelayBind struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	AckId int64 `protobuf:"varint,1,opt,name=ackId,proto3" json:"ackId,omitempty"`
+	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	Token       []byte `protobuf:"bytes,2,opt,name=token,proto3" json:"token,omitempty"`
+	Expiry      int64  `protobuf:"varint,3,opt,name=expiry,proto3" json:"expiry,omitempty"`
+	Timestamp   int64  `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	PublicKey   []byte `protobuf:"bytes,5,opt,name=publicKey,proto3" json:"publicKey,omitempty"` // The identity of the node which the token is issued to
+	Signature   []byte `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"` // The signature of the bind by the node identity
 }
 
-func (x *CtrlOpenTunnelAck) Reset() {
-	*x = CtrlOpenTunnelAck{}
+func (x *CtrlRelayBind) Reset() {
+	*x = CtrlRelayBind{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_api_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -394,13 +711,13 @@ func (x *CtrlOpenTunnelAck) Reset() {
 	}
 }
 
-func (x *CtrlOpenTunnelAck) String() string {
+func (x *CtrlRelayBind) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CtrlOpenTunnelAck) ProtoMessage() {}
+func (*CtrlRelayBind) ProtoMessage() {}
 
-func (x *CtrlOpenTunnelAck) ProtoReflect() protoreflect.Message {
+func (x *CtrlRelayBind) ProtoReflect() protoreflect.Message {
 	mi := &file_api_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -412,29 +729,64 @@ func (x *CtrlOpenTunnelAck) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CtrlOpenTunnelAck.ProtoReflect.Descriptor instead.
-func (*CtrlOpenTunnelAck) Descriptor() ([]byte, []int) {
+// Deprecated: Use CtrlRelayBind.ProtoReflect.Descriptor instead.
+func (*CtrlRelayBind) Descriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{4}
 }
 
-func (x *CtrlOpenTunnelAck) GetAckId() int64 {
+func (x *CtrlRelayBind) GetVirtAddress() string {
+	if x != nil {
+		return x.VirtAddress
+	}
+	return ""
+}
+
+func (x *CtrlRelayBind) GetToken() []byte {
+	if x != nil {
+		return x.Token
+	}
+	return nil
+}
+
+func (x *CtrlRelayBind) GetExpiry() int64 {
 	if x != nil {
-		return x.AckId
+		return x.Expiry
 	}
 	return 0
 }
 
-type CtrlRelay struct {
+func (x *CtrlRelayBind) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *CtrlRelayBind) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *CtrlRelayBind) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+type CtrlRelayBindAck struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
-	Data        []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Timestamp int64      `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Code      StatusCode `protobuf:"varint,2,opt,name=code,proto3,enum=StatusCode" json:"code,omitempty"`
 }
 
-func (x *CtrlRelay) Reset() {
-	*x = CtrlRelay{}
+func (x *CtrlRelayBindAck) Reset() {
+	*x = CtrlRelayBindAck{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_api_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -442,13 +794,13 @@ func (x *CtrlRelay) Reset() {
 	}
 }
 
-func (x *CtrlRelay) String() string {
+func (x *CtrlRelayBindAck) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CtrlRelay) ProtoMessage() {}
+func (*CtrlRelayBindAck) ProtoMessage() {}
 
-func (x *CtrlRelay) ProtoReflect() protoreflect.Message {
+func (x *CtrlRelayBindAck) ProtoReflect() protoreflect.Message {
 	mi := &file_api_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -460,70 +812,973 @@ func (x *CtrlRelay) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CtrlRelay.ProtoReflect.Descriptor instead.
-func (*CtrlRelay) Descriptor() ([]byte, []int) {
+// Deprecated: Use CtrlRelayBindAck.ProtoReflect.Descriptor instead.
+func (*CtrlRelayBindAck) Descriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{5}
 }
 
-func (x *CtrlRelay) GetVirtAddress() string {
+func (x *CtrlRelayBindAck) GetTimestamp() int64 {
 	if x != nil {
-		return x.VirtAddress
+		return x.Timestamp
 	}
-	return ""
+	return 0
 }
 
-func (x *CtrlRelay) GetData() []byte {
+func (x *CtrlRelayBindAck) GetCode() StatusCode {
+	if x != nil {
+		return x.Code
+	}
+	return StatusCode_Success
+}
+
+type CtrlBinding struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TransactionId int64  `protobuf:"varint,1,opt,name=transactionId,proto3" json:"transactionId,omitempty"`
+	ChangePort    bool   `protobuf:"varint,2,opt,name=changePort,proto3" json:"changePort,omitempty"`
+	Padding       []byte `protobuf:"bytes,3,opt,name=padding,proto3" json:"padding,omitempty"` // Makes the request no smaller than the response
+}
+
+func (x *CtrlBinding) Reset() {
+	*x = CtrlBinding{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlBinding) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlBinding) ProtoMessage() {}
+
+func (x *CtrlBinding) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlBinding.ProtoReflect.Descriptor instead.
+func (*CtrlBinding) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CtrlBinding) GetTransactionId() int64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+func (x *CtrlBinding) GetChangePort() bool {
+	if x != nil {
+		return x.ChangePort
+	}
+	return false
+}
+
+func (x *CtrlBinding) GetPadding() []byte {
+	if x != nil {
+		return x.Padding
+	}
+	return nil
+}
+
+type CtrlBindingAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TransactionId int64  `protobuf:"varint,1,opt,name=transactionId,proto3" json:"transactionId,omitempty"`
+	MappedAddress string `protobuf:"bytes,2,opt,name=mappedAddress,proto3" json:"mappedAddress,omitempty"`
+}
+
+func (x *CtrlBindingAck) Reset() {
+	*x = CtrlBindingAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlBindingAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlBindingAck) ProtoMessage() {}
+
+func (x *CtrlBindingAck) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlBindingAck.ProtoReflect.Descriptor instead.
+func (*CtrlBindingAck) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CtrlBindingAck) GetTransactionId() int64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+func (x *CtrlBindingAck) GetMappedAddress() string {
+	if x != nil {
+		return x.MappedAddress
+	}
+	return ""
+}
+
+type CtrlPing struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	Nonce       string `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	PublicKey   []byte `protobuf:"bytes,3,opt,name=publicKey,proto3" json:"publicKey,omitempty"` // The ephemeral X25519 public key of the connection
+	Timestamp   int64  `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Created     int64  `protobuf:"varint,5,opt,name=created,proto3" json:"created,omitempty"` // The creation time of the ephemeral key in unix nano
+	Proof       []byte `protobuf:"bytes,6,opt,name=proof,proto3" json:"proof,omitempty"`      // The signature of the ephemeral key by the node identity
+}
+
+func (x *CtrlPing) Reset() {
+	*x = CtrlPing{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlPing) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlPing) ProtoMessage() {}
+
+func (x *CtrlPing) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlPing.ProtoReflect.Descriptor instead.
+func (*CtrlPing) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *CtrlPing) GetVirtAddress() string {
+	if x != nil {
+		return x.VirtAddress
+	}
+	return ""
+}
+
+func (x *CtrlPing) GetNonce() string {
+	if x != nil {
+		return x.Nonce
+	}
+	return ""
+}
+
+func (x *CtrlPing) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *CtrlPing) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *CtrlPing) GetCreated() int64 {
+	if x != nil {
+		return x.Created
+	}
+	return 0
+}
+
+func (x *CtrlPing) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+type CtrlPong struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	Nonce       string `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	PublicKey   []byte `protobuf:"bytes,3,opt,name=publicKey,proto3" json:"publicKey,omitempty"` // The ephemeral X25519 public key of the connection
+	Timestamp   int64  `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Created     int64  `protobuf:"varint,5,opt,name=created,proto3" json:"created,omitempty"`    // The creation time of the ephemeral key in unix nano
+	Proof       []byte `protobuf:"bytes,6,opt,name=proof,proto3" json:"proof,omitempty"`         // The signature of the ephemeral key by the node identity
+	PingNonce   string `protobuf:"bytes,7,opt,name=pingNonce,proto3" json:"pingNonce,omitempty"` // The nonce of the Ping answered
+	Response    []byte `protobuf:"bytes,8,opt,name=response,proto3" json:"response,omitempty"`   // The MAC of the Ping nonce by the session, which proves the Pong sent by the peer
+}
+
+func (x *CtrlPong) Reset() {
+	*x = CtrlPong{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlPong) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlPong) ProtoMessage() {}
+
+func (x *CtrlPong) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlPong.ProtoReflect.Descriptor instead.
+func (*CtrlPong) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *CtrlPong) GetVirtAddress() string {
+	if x != nil {
+		return x.VirtAddress
+	}
+	return ""
+}
+
+func (x *CtrlPong) GetNonce() string {
+	if x != nil {
+		return x.Nonce
+	}
+	return ""
+}
+
+func (x *CtrlPong) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *CtrlPong) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *CtrlPong) GetCreated() int64 {
+	if x != nil {
+		return x.Created
+	}
+	return 0
+}
+
+func (x *CtrlPong) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+func (x *CtrlPong) GetPingNonce() string {
+	if x != nil {
+		return x.PingNonce
+	}
+	return ""
+}
+
+func (x *CtrlPong) GetResponse() []byte {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+type CtrlOpenTunnel struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	VirtAddress    string          `protobuf:"bytes,2,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	UdpAddress     string          `protobuf:"bytes,3,opt,name=udpAddress,proto3" json:"udpAddress,omitempty"`
+	Addresses      []string        `protobuf:"bytes,4,rep,name=addresses,proto3" json:"addresses,omitempty"`
+	Candidates     []*Candidate    `protobuf:"bytes,5,rep,name=candidates,proto3" json:"candidates,omitempty"`
+	NatType        NATType         `protobuf:"varint,6,opt,name=natType,proto3,enum=NATType" json:"natType,omitempty"`
+	RelayLatencies []*RelayLatency `protobuf:"bytes,7,rep,name=relayLatencies,proto3" json:"relayLatencies,omitempty"`
+	PublicKey      []byte          `protobuf:"bytes,8,opt,name=publicKey,proto3" json:"publicKey,omitempty"` // The identity of the peer attested by the gateway
+}
+
+func (x *CtrlOpenTunnel) Reset() {
+	*x = CtrlOpenTunnel{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlOpenTunnel) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlOpenTunnel) ProtoMessage() {}
+
+func (x *CtrlOpenTunnel) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlOpenTunnel.ProtoReflect.Descriptor instead.
+func (*CtrlOpenTunnel) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CtrlOpenTunnel) GetVirtAddress() string {
+	if x != nil {
+		return x.VirtAddress
+	}
+	return ""
+}
+
+func (x *CtrlOpenTunnel) GetUdpAddress() string {
+	if x != nil {
+		return x.UdpAddress
+	}
+	return ""
+}
+
+func (x *CtrlOpenTunnel) GetAddresses() []string {
+	if x != nil {
+		return x.Addresses
+	}
+	return nil
+}
+
+func (x *CtrlOpenTunnel) GetCandidates() []*Candidate {
+	if x != nil {
+		return x.Candidates
+	}
+	return nil
+}
+
+func (x *CtrlOpenTunnel) GetNatType() NATType {
+	if x != nil {
+		return x.NatType
+	}
+	return NATType_NATUnknown
+}
+
+func (x *CtrlOpenTunnel) GetRelayLatencies() []*RelayLatency {
+	if x != nil {
+		return x.RelayLatencies
+	}
+	return nil
+}
+
+func (x *CtrlOpenTunnel) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+type CtrlRelay struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	VirtAddress string `protobuf:"bytes,1,opt,name=virtAddress,proto3" json:"virtAddress,omitempty"`
+	Data        []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Nonce       string `protobuf:"bytes,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Signature   []byte `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+	Source      string `protobuf:"bytes,5,opt,name=source,proto3" json:"source,omitempty"`
+	Timestamp   int64  `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (x *CtrlRelay) Reset() {
+	*x = CtrlRelay{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlRelay) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlRelay) ProtoMessage() {}
+
+func (x *CtrlRelay) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlRelay.ProtoReflect.Descriptor instead.
+func (*CtrlRelay) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *CtrlRelay) GetVirtAddress() string {
+	if x != nil {
+		return x.VirtAddress
+	}
+	return ""
+}
+
+func (x *CtrlRelay) GetData() []byte {
 	if x != nil {
 		return x.Data
 	}
 	return nil
 }
 
+func (x *CtrlRelay) GetNonce() string {
+	if x != nil {
+		return x.Nonce
+	}
+	return ""
+}
+
+func (x *CtrlRelay) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *CtrlRelay) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *CtrlRelay) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+type ControlMessage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"` // The receiver must acknowledge the message with the id if non-zero
+	// Types that are assignable to Payload:
+	//	*ControlMessage_Register
+	//	*ControlMessage_TunnelRequest
+	//	*ControlMessage_OpenTunnel
+	//	*ControlMessage_Ack
+	//	*ControlMessage_PeerUpdate
+	Payload isControlMessage_Payload `protobuf_oneof:"payload"`
+}
+
+func (x *ControlMessage) Reset() {
+	*x = ControlMessage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ControlMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ControlMessage) ProtoMessage() {}
+
+func (x *ControlMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ControlMessage.ProtoReflect.Descriptor instead.
+func (*ControlMessage) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ControlMessage) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (m *ControlMessage) GetPayload() isControlMessage_Payload {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetRegister() *CtrlHeartbeat {
+	if x, ok := x.GetPayload().(*ControlMessage_Register); ok {
+		return x.Register
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetTunnelRequest() *CtrlTunnelRequest {
+	if x, ok := x.GetPayload().(*ControlMessage_TunnelRequest); ok {
+		return x.TunnelRequest
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetOpenTunnel() *CtrlOpenTunnel {
+	if x, ok := x.GetPayload().(*ControlMessage_OpenTunnel); ok {
+		return x.OpenTunnel
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetAck() *CtrlAck {
+	if x, ok := x.GetPayload().(*ControlMessage_Ack); ok {
+		return x.Ack
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetPeerUpdate() *CtrlOpenTunnel {
+	if x, ok := x.GetPayload().(*ControlMessage_PeerUpdate); ok {
+		return x.PeerUpdate
+	}
+	return nil
+}
+
+type isControlMessage_Payload interface {
+	isControlMessage_Payload()
+}
+
+type ControlMessage_Register struct {
+	Register *CtrlHeartbeat `protobuf:"bytes,2,opt,name=register,proto3,oneof"` // node -> gateway
+}
+
+type ControlMessage_TunnelRequest struct {
+	TunnelRequest *CtrlTunnelRequest `protobuf:"bytes,3,opt,name=tunnelRequest,proto3,oneof"` // node -> gateway
+}
+
+type ControlMessage_OpenTunnel struct {
+	OpenTunnel *CtrlOpenTunnel `protobuf:"bytes,4,opt,name=openTunnel,proto3,oneof"` // gateway -> node
+}
+
+type ControlMessage_Ack struct {
+	Ack *CtrlAck `protobuf:"bytes,5,opt,name=ack,proto3,oneof"`
+}
+
+type ControlMessage_PeerUpdate struct {
+	PeerUpdate *CtrlOpenTunnel `protobuf:"bytes,6,opt,name=peerUpdate,proto3,oneof"` // gateway -> node, the peer has changed its network
+}
+
+func (*ControlMessage_Register) isControlMessage_Payload() {}
+
+func (*ControlMessage_TunnelRequest) isControlMessage_Payload() {}
+
+func (*ControlMessage_OpenTunnel) isControlMessage_Payload() {}
+
+func (*ControlMessage_Ack) isControlMessage_Payload() {}
+
+func (*ControlMessage_PeerUpdate) isControlMessage_Payload() {}
+
+type CtrlTunnelRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Destination string `protobuf:"bytes,1,opt,name=destination,proto3" json:"destination,omitempty"`
+}
+
+func (x *CtrlTunnelRequest) Reset() {
+	*x = CtrlTunnelRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlTunnelRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlTunnelRequest) ProtoMessage() {}
+
+func (x *CtrlTunnelRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlTunnelRequest.ProtoReflect.Descriptor instead.
+func (*CtrlTunnelRequest) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *CtrlTunnelRequest) GetDestination() string {
+	if x != nil {
+		return x.Destination
+	}
+	return ""
+}
+
+type CtrlAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id    int64      `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Code  StatusCode `protobuf:"varint,2,opt,name=code,proto3,enum=StatusCode" json:"code,omitempty"`
+	Error string     `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *CtrlAck) Reset() {
+	*x = CtrlAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[14]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CtrlAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CtrlAck) ProtoMessage() {}
+
+func (x *CtrlAck) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[14]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CtrlAck.ProtoReflect.Descriptor instead.
+func (*CtrlAck) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *CtrlAck) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *CtrlAck) GetCode() StatusCode {
+	if x != nil {
+		return x.Code
+	}
+	return StatusCode_Success
+}
+
+func (x *CtrlAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
 var File_api_proto protoreflect.FileDescriptor
 
 var file_api_proto_rawDesc = []byte{
-	0x0a, 0x09, 0x61, 0x70, 0x69, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x31, 0x0a, 0x0d, 0x43,
-	0x74, 0x72, 0x6c, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12, 0x20, 0x0a, 0x0b,
-	0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x22, 0x42,
-	0x0a, 0x08, 0x43, 0x74, 0x72, 0x6c, 0x50, 0x69, 0x6e, 0x67, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69,
-	0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x14, 0x0a, 0x05,
-	0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x6f, 0x6e,
-	0x63, 0x65, 0x22, 0x42, 0x0a, 0x08, 0x43, 0x74, 0x72, 0x6c, 0x50, 0x6f, 0x6e, 0x67, 0x12, 0x20,
-	0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
-	0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x22, 0x68, 0x0a, 0x0e, 0x43, 0x74, 0x72, 0x6c, 0x4f, 0x70,
-	0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x63, 0x6b, 0x49,
-	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x61, 0x63, 0x6b, 0x49, 0x64, 0x12, 0x20,
-	0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
-	0x12, 0x1e, 0x0a, 0x0a, 0x75, 0x64, 0x70, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x75, 0x64, 0x70, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
-	0x22, 0x29, 0x0a, 0x11, 0x43, 0x74, 0x72, 0x6c, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e,
-	0x65, 0x6c, 0x41, 0x63, 0x6b, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x63, 0x6b, 0x49, 0x64, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x61, 0x63, 0x6b, 0x49, 0x64, 0x22, 0x41, 0x0a, 0x09, 0x43,
-	0x74, 0x72, 0x6c, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74,
-	0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76,
-	0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61,
-	0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x2a, 0x67,
-	0x0a, 0x0a, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0d, 0x0a, 0x09,
-	0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x10, 0x00, 0x12, 0x09, 0x0a, 0x05, 0x52,
-	0x65, 0x6c, 0x61, 0x79, 0x10, 0x01, 0x12, 0x0e, 0x0a, 0x0a, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75,
-	0x6e, 0x6e, 0x65, 0x6c, 0x10, 0x02, 0x12, 0x11, 0x0a, 0x0d, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75,
-	0x6e, 0x6e, 0x65, 0x6c, 0x41, 0x63, 0x6b, 0x10, 0x03, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x69, 0x6e,
-	0x67, 0x10, 0x04, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x6f, 0x6e, 0x67, 0x10, 0x05, 0x12, 0x08, 0x0a,
-	0x04, 0x44, 0x61, 0x74, 0x61, 0x10, 0x06, 0x2a, 0x7a, 0x0a, 0x0a, 0x53, 0x74, 0x61, 0x74, 0x75,
-	0x73, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73,
-	0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x49, 0x6e, 0x74, 0x65,
-	0x72, 0x6e, 0x61, 0x6c, 0x10, 0x01, 0x12, 0x12, 0x0a, 0x0e, 0x49, 0x6e, 0x76, 0x61, 0x6c, 0x69,
-	0x64, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x10, 0x02, 0x12, 0x11, 0x0a, 0x0d, 0x41, 0x64,
-	0x64, 0x43, 0x6f, 0x6e, 0x66, 0x6c, 0x69, 0x63, 0x74, 0x65, 0x64, 0x10, 0x03, 0x12, 0x11, 0x0a,
-	0x0d, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x54, 0x6f, 0x6f, 0x4f, 0x6c, 0x64, 0x10, 0x04,
-	0x12, 0x11, 0x0a, 0x0d, 0x4b, 0x65, 0x79, 0x4e, 0x6f, 0x74, 0x4d, 0x61, 0x74, 0x63, 0x68, 0x65,
-	0x64, 0x10, 0x05, 0x42, 0x0a, 0x5a, 0x08, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x62,
-	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x0a, 0x09, 0x61, 0x70, 0x69, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x92, 0x03, 0x0a, 0x0d,
+	0x43, 0x74, 0x72, 0x6c, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12, 0x20, 0x0a,
+	0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12,
+	0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75,
+	0x72, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65,
+	0x79, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x05,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12,
+	0x14, 0x0a, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05,
+	0x70, 0x72, 0x6f, 0x6f, 0x66, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
+	0x65, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73,
+	0x73, 0x65, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2a, 0x0a,
+	0x0a, 0x63, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x0a, 0x2e, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x52, 0x0a, 0x63,
+	0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x07, 0x6e, 0x61, 0x74,
+	0x54, 0x79, 0x70, 0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x08, 0x2e, 0x4e, 0x41, 0x54,
+	0x54, 0x79, 0x70, 0x65, 0x52, 0x07, 0x6e, 0x61, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x35, 0x0a,
+	0x0e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x4c, 0x61, 0x74, 0x65, 0x6e, 0x63, 0x69, 0x65, 0x73, 0x18,
+	0x0b, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x4c, 0x61, 0x74,
+	0x65, 0x6e, 0x63, 0x79, 0x52, 0x0e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x4c, 0x61, 0x74, 0x65, 0x6e,
+	0x63, 0x69, 0x65, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74,
+	0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74,
+	0x22, 0x65, 0x0a, 0x09, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x12, 0x18, 0x0a,
+	0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
+	0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x22, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0e, 0x2e, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74,
+	0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x70,
+	0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x70,
+	0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x22, 0x87, 0x03, 0x0a, 0x10, 0x43, 0x74, 0x72, 0x6c,
+	0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x41, 0x63, 0x6b, 0x12, 0x1f, 0x0a, 0x04,
+	0x63, 0x6f, 0x64, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0b, 0x2e, 0x53, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x43, 0x6f, 0x64, 0x65, 0x52, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x12, 0x14, 0x0a,
+	0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72,
+	0x72, 0x6f, 0x72, 0x12, 0x1a, 0x0a, 0x08, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x73, 0x18,
+	0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x73, 0x12,
+	0x20, 0x0a, 0x0b, 0x62, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x6f, 0x72, 0x74, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x62, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x6f, 0x72,
+	0x74, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28,
+	0x09, 0x52, 0x06, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x72, 0x65, 0x6c,
+	0x61, 0x79, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x72,
+	0x65, 0x6c, 0x61, 0x79, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x2a, 0x0a, 0x10, 0x72, 0x65, 0x6c,
+	0x61, 0x79, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x45, 0x78, 0x70, 0x69, 0x72, 0x79, 0x18, 0x07, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x10, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x45,
+	0x78, 0x70, 0x69, 0x72, 0x79, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64,
+	0x72, 0x65, 0x73, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74,
+	0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x18, 0x09, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65,
+	0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x0a,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x73,
+	0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09,
+	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x26, 0x0a, 0x0e, 0x68, 0x65, 0x61,
+	0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x4e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0e, 0x68, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x4e, 0x6f, 0x6e, 0x63,
+	0x65, 0x22, 0x3a, 0x0a, 0x0c, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x4c, 0x61, 0x74, 0x65, 0x6e, 0x63,
+	0x79, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x10, 0x0a, 0x03, 0x72,
+	0x74, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x03, 0x72, 0x74, 0x74, 0x22, 0xb9, 0x01,
+	0x0a, 0x0d, 0x43, 0x74, 0x72, 0x6c, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x42, 0x69, 0x6e, 0x64, 0x12,
+	0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73,
+	0x73, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x65, 0x78, 0x70, 0x69, 0x72,
+	0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x65, 0x78, 0x70, 0x69, 0x72, 0x79, 0x12,
+	0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x1c, 0x0a,
+	0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x1c, 0x0a, 0x09, 0x73,
+	0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09,
+	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x22, 0x51, 0x0a, 0x10, 0x43, 0x74, 0x72,
+	0x6c, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x42, 0x69, 0x6e, 0x64, 0x41, 0x63, 0x6b, 0x12, 0x1c, 0x0a,
+	0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x1f, 0x0a, 0x04, 0x63,
+	0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0b, 0x2e, 0x53, 0x74, 0x61, 0x74,
+	0x75, 0x73, 0x43, 0x6f, 0x64, 0x65, 0x52, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x22, 0x6d, 0x0a, 0x0b,
+	0x43, 0x74, 0x72, 0x6c, 0x42, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x24, 0x0a, 0x0d, 0x74,
+	0x72, 0x61, 0x6e, 0x73, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0d, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49,
+	0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50, 0x6f, 0x72, 0x74, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50, 0x6f, 0x72,
+	0x74, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x22, 0x5c, 0x0a, 0x0e, 0x43,
+	0x74, 0x72, 0x6c, 0x42, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x41, 0x63, 0x6b, 0x12, 0x24, 0x0a,
+	0x0d, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x61, 0x63, 0x74, 0x69, 0x6f,
+	0x6e, 0x49, 0x64, 0x12, 0x24, 0x0a, 0x0d, 0x6d, 0x61, 0x70, 0x70, 0x65, 0x64, 0x41, 0x64, 0x64,
+	0x72, 0x65, 0x73, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x6d, 0x61, 0x70, 0x70,
+	0x65, 0x64, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x22, 0xae, 0x01, 0x0a, 0x08, 0x43, 0x74,
+	0x72, 0x6c, 0x50, 0x69, 0x6e, 0x67, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64,
+	0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72,
+	0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63,
+	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x1c,
+	0x0a, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x1c, 0x0a, 0x09,
+	0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x72,
+	0x65, 0x61, 0x74, 0x65, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x63, 0x72, 0x65,
+	0x61, 0x74, 0x65, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x22, 0xe8, 0x01, 0x0a, 0x08, 0x43,
+	0x74, 0x72, 0x6c, 0x50, 0x6f, 0x6e, 0x67, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41,
+	0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69,
+	0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e,
+	0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12,
+	0x1c, 0x0a, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x1c, 0x0a,
+	0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x18, 0x0a, 0x07, 0x63,
+	0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x63, 0x72,
+	0x65, 0x61, 0x74, 0x65, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x12, 0x1c, 0x0a, 0x09, 0x70,
+	0x69, 0x6e, 0x67, 0x4e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09,
+	0x70, 0x69, 0x6e, 0x67, 0x4e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x08, 0x72, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x9b, 0x02, 0x0a, 0x0e, 0x43, 0x74, 0x72, 0x6c, 0x4f, 0x70,
+	0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74,
+	0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76,
+	0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x75, 0x64,
+	0x70, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a,
+	0x75, 0x64, 0x70, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x64,
+	0x64, 0x72, 0x65, 0x73, 0x73, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x61,
+	0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x65, 0x73, 0x12, 0x2a, 0x0a, 0x0a, 0x63, 0x61, 0x6e, 0x64,
+	0x69, 0x64, 0x61, 0x74, 0x65, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x43,
+	0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x52, 0x0a, 0x63, 0x61, 0x6e, 0x64, 0x69, 0x64,
+	0x61, 0x74, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x07, 0x6e, 0x61, 0x74, 0x54, 0x79, 0x70, 0x65, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x08, 0x2e, 0x4e, 0x41, 0x54, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x07, 0x6e, 0x61, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x35, 0x0a, 0x0e, 0x72, 0x65, 0x6c, 0x61,
+	0x79, 0x4c, 0x61, 0x74, 0x65, 0x6e, 0x63, 0x69, 0x65, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x0d, 0x2e, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x4c, 0x61, 0x74, 0x65, 0x6e, 0x63, 0x79, 0x52,
+	0x0e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x4c, 0x61, 0x74, 0x65, 0x6e, 0x63, 0x69, 0x65, 0x73, 0x12,
+	0x1c, 0x0a, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x18, 0x08, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x4a, 0x04, 0x08,
+	0x01, 0x10, 0x02, 0x22, 0xab, 0x01, 0x0a, 0x09, 0x43, 0x74, 0x72, 0x6c, 0x52, 0x65, 0x6c, 0x61,
+	0x79, 0x12, 0x20, 0x0a, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x76, 0x69, 0x72, 0x74, 0x41, 0x64, 0x64, 0x72,
+	0x65, 0x73, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x1c, 0x0a,
+	0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x73,
+	0x6f, 0x75, 0x72, 0x63, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x22, 0x99, 0x02, 0x0a, 0x0e, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x4d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x02, 0x69, 0x64, 0x12, 0x2c, 0x0a, 0x08, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x43, 0x74, 0x72, 0x6c, 0x48, 0x65, 0x61,
+	0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x48, 0x00, 0x52, 0x08, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74,
+	0x65, 0x72, 0x12, 0x3a, 0x0a, 0x0d, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x43, 0x74, 0x72, 0x6c,
+	0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52,
+	0x0d, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x31,
+	0x0a, 0x0a, 0x6f, 0x70, 0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x43, 0x74, 0x72, 0x6c, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x48, 0x00, 0x52, 0x0a, 0x6f, 0x70, 0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x12, 0x1c, 0x0a, 0x03, 0x61, 0x63, 0x6b, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x08,
+	0x2e, 0x43, 0x74, 0x72, 0x6c, 0x41, 0x63, 0x6b, 0x48, 0x00, 0x52, 0x03, 0x61, 0x63, 0x6b, 0x12,
+	0x31, 0x0a, 0x0a, 0x70, 0x65, 0x65, 0x72, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x43, 0x74, 0x72, 0x6c, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x48, 0x00, 0x52, 0x0a, 0x70, 0x65, 0x65, 0x72, 0x55, 0x70, 0x64, 0x61,
+	0x74, 0x65, 0x42, 0x09, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x22, 0x35, 0x0a,
+	0x11, 0x43, 0x74, 0x72, 0x6c, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x64, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x64, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x22, 0x50, 0x0a, 0x07, 0x43, 0x74, 0x72, 0x6c, 0x41, 0x63, 0x6b, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x1f, 0x0a, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0b, 0x2e,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x43, 0x6f, 0x64, 0x65, 0x52, 0x04, 0x63, 0x6f, 0x64, 0x65,
+	0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x2a, 0xb7, 0x01, 0x0a, 0x0a, 0x50, 0x61, 0x63, 0x6b, 0x65,
+	0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0d, 0x0a, 0x09, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65,
+	0x61, 0x74, 0x10, 0x00, 0x12, 0x09, 0x0a, 0x05, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x10, 0x01, 0x12,
+	0x0e, 0x0a, 0x0a, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x10, 0x02, 0x12,
+	0x11, 0x0a, 0x0d, 0x4f, 0x70, 0x65, 0x6e, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x41, 0x63, 0x6b,
+	0x10, 0x03, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x69, 0x6e, 0x67, 0x10, 0x04, 0x12, 0x08, 0x0a, 0x04,
+	0x50, 0x6f, 0x6e, 0x67, 0x10, 0x05, 0x12, 0x08, 0x0a, 0x04, 0x44, 0x61, 0x74, 0x61, 0x10, 0x06,
+	0x12, 0x10, 0x0a, 0x0c, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x41, 0x63, 0x6b,
+	0x10, 0x07, 0x12, 0x0b, 0x0a, 0x07, 0x42, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x10, 0x08, 0x12,
+	0x0e, 0x0a, 0x0a, 0x42, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x41, 0x63, 0x6b, 0x10, 0x09, 0x12,
+	0x0d, 0x0a, 0x09, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x42, 0x69, 0x6e, 0x64, 0x10, 0x0a, 0x12, 0x10,
+	0x0a, 0x0c, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x42, 0x69, 0x6e, 0x64, 0x41, 0x63, 0x6b, 0x10, 0x0b,
+	0x2a, 0x4d, 0x0a, 0x0d, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x54, 0x79, 0x70,
+	0x65, 0x12, 0x08, 0x0a, 0x04, 0x48, 0x6f, 0x73, 0x74, 0x10, 0x00, 0x12, 0x13, 0x0a, 0x0f, 0x53,
+	0x65, 0x72, 0x76, 0x65, 0x72, 0x52, 0x65, 0x66, 0x6c, 0x65, 0x78, 0x69, 0x76, 0x65, 0x10, 0x01,
+	0x12, 0x0a, 0x0a, 0x06, 0x4d, 0x61, 0x70, 0x70, 0x65, 0x64, 0x10, 0x02, 0x12, 0x11, 0x0a, 0x0d,
+	0x50, 0x65, 0x65, 0x72, 0x52, 0x65, 0x66, 0x6c, 0x65, 0x78, 0x69, 0x76, 0x65, 0x10, 0x03, 0x2a,
+	0x6b, 0x0a, 0x07, 0x4e, 0x41, 0x54, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0e, 0x0a, 0x0a, 0x4e, 0x41,
+	0x54, 0x55, 0x6e, 0x6b, 0x6e, 0x6f, 0x77, 0x6e, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x4e, 0x41,
+	0x54, 0x4f, 0x70, 0x65, 0x6e, 0x10, 0x01, 0x12, 0x1a, 0x0a, 0x16, 0x4e, 0x41, 0x54, 0x45, 0x6e,
+	0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x49, 0x6e, 0x64, 0x65, 0x70, 0x65, 0x6e, 0x64, 0x65, 0x6e,
+	0x74, 0x10, 0x02, 0x12, 0x15, 0x0a, 0x11, 0x4e, 0x41, 0x54, 0x50, 0x6f, 0x72, 0x74, 0x52, 0x65,
+	0x73, 0x74, 0x72, 0x69, 0x63, 0x74, 0x65, 0x64, 0x10, 0x03, 0x12, 0x10, 0x0a, 0x0c, 0x4e, 0x41,
+	0x54, 0x53, 0x79, 0x6d, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x10, 0x04, 0x2a, 0xe6, 0x01, 0x0a,
+	0x0a, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x53,
+	0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x53, 0x65, 0x72, 0x76,
+	0x65, 0x72, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x10, 0x01, 0x12, 0x12, 0x0a, 0x0e,
+	0x49, 0x6e, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x10, 0x02,
+	0x12, 0x11, 0x0a, 0x0d, 0x41, 0x64, 0x64, 0x43, 0x6f, 0x6e, 0x66, 0x6c, 0x69, 0x63, 0x74, 0x65,
+	0x64, 0x10, 0x03, 0x12, 0x11, 0x0a, 0x0d, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x54, 0x6f,
+	0x6f, 0x4f, 0x6c, 0x64, 0x10, 0x04, 0x12, 0x11, 0x0a, 0x0d, 0x4b, 0x65, 0x79, 0x4e, 0x6f, 0x74,
+	0x4d, 0x61, 0x74, 0x63, 0x68, 0x65, 0x64, 0x10, 0x05, 0x12, 0x11, 0x0a, 0x0d, 0x50, 0x6f, 0x6f,
+	0x6c, 0x45, 0x78, 0x68, 0x61, 0x75, 0x73, 0x74, 0x65, 0x64, 0x10, 0x06, 0x12, 0x0f, 0x0a, 0x0b,
+	0x50, 0x65, 0x65, 0x72, 0x4f, 0x66, 0x66, 0x6c, 0x69, 0x6e, 0x65, 0x10, 0x07, 0x12, 0x0f, 0x0a,
+	0x0b, 0x50, 0x65, 0x65, 0x72, 0x45, 0x76, 0x69, 0x63, 0x74, 0x65, 0x64, 0x10, 0x08, 0x12, 0x0e,
+	0x0a, 0x0a, 0x50, 0x65, 0x65, 0x72, 0x42, 0x61, 0x6e, 0x6e, 0x65, 0x64, 0x10, 0x09, 0x12, 0x10,
+	0x0a, 0x0c, 0x50, 0x65, 0x65, 0x72, 0x4e, 0x6f, 0x74, 0x46, 0x6f, 0x75, 0x6e, 0x64, 0x10, 0x0a,
+	0x12, 0x13, 0x0a, 0x0f, 0x41, 0x64, 0x64, 0x4f, 0x75, 0x74, 0x4f, 0x66, 0x4e, 0x65, 0x74, 0x77,
+	0x6f, 0x72, 0x6b, 0x10, 0x0b, 0x32, 0x3a, 0x0a, 0x07, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x12, 0x2f, 0x0a, 0x07, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x12, 0x0f, 0x2e, 0x43, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x1a, 0x0f, 0x2e, 0x43,
+	0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x28, 0x01, 0x30,
+	0x01, 0x42, 0x0a, 0x5a, 0x08, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -538,24 +1793,52 @@ func file_api_proto_rawDescGZIP() []byte {
 	return file_api_proto_rawDescData
 }
 
-var file_api_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_api_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_api_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_api_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
 var file_api_proto_goTypes = []interface{}{
 	(PacketType)(0),           // 0: PacketType
-	(StatusCode)(0),           // 1: StatusCode
-	(*CtrlHeartbeat)(nil),     // 2: CtrlHeartbeat
-	(*CtrlPing)(nil),          // 3: CtrlPing
-	(*CtrlPong)(nil),          // 4: CtrlPong
-	(*CtrlOpenTunnel)(nil),    // 5: CtrlOpenTunnel
-	(*CtrlOpenTunnelAck)(nil), // 6: CtrlOpenTunnelAck
-	(*CtrlRelay)(nil),         // 7: CtrlRelay
+	(CandidateType)(0),        // 1: CandidateType
+	(NATType)(0),              // 2: NATType
+	(StatusCode)(0),           // 3: StatusCode
+	(*CtrlHeartbeat)(nil),     // 4: CtrlHeartbeat
+	(*Candidate)(nil),         // 5: Candidate
+	(*CtrlHeartbeatAck)(nil),  // 6: CtrlHeartbeatAck
+	(*RelayLatency)(nil),      // 7: RelayLatency
+	(*CtrlRelayBind)(nil),     // 8: CtrlRelayBind
+	(*CtrlRelayBindAck)(nil),  // 9: CtrlRelayBindAck
+	(*CtrlBinding)(nil),       // 10: CtrlBinding
+	(*CtrlBindingAck)(nil),    // 11: CtrlBindingAck
+	(*CtrlPing)(nil),          // 12: CtrlPing
+	(*CtrlPong)(nil),          // 13: CtrlPong
+	(*CtrlOpenTunnel)(nil),    // 14: CtrlOpenTunnel
+	(*CtrlRelay)(nil),         // 15: CtrlRelay
+	(*ControlMessage)(nil),    // 16: ControlMessage
+	(*CtrlTunnelRequest)(nil), // 17: CtrlTunnelRequest
+	(*CtrlAck)(nil),           // 18: CtrlAck
 }
 var file_api_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	5,  // 0: CtrlHeartbeat.candidates:type_name -> Candidate
+	2,  // 1: CtrlHeartbeat.natType:type_name -> NATType
+	7,  // 2: CtrlHeartbeat.relayLatencies:type_name -> RelayLatency
+	1,  // 3: Candidate.type:type_name -> CandidateType
+	3,  // 4: CtrlHeartbeatAck.code:type_name -> StatusCode
+	3,  // 5: CtrlRelayBindAck.code:type_name -> StatusCode
+	5,  // 6: CtrlOpenTunnel.candidates:type_name -> Candidate
+	2,  // 7: CtrlOpenTunnel.natType:type_name -> NATType
+	7,  // 8: CtrlOpenTunnel.relayLatencies:type_name -> RelayLatency
+	4,  // 9: ControlMessage.register:type_name -> CtrlHeartbeat
+	17, // 10: ControlMessage.tunnelRequest:type_name -> CtrlTunnelRequest
+	14, // 11: ControlMessage.openTunnel:type_name -> CtrlOpenTunnel
+	18, // 12: ControlMessage.ack:type_name -> CtrlAck
+	14, // 13: ControlMessage.peerUpdate:type_name -> CtrlOpenTunnel
+	3,  // 14: CtrlAck.code:type_name -> StatusCode
+	16, // 15: Control.Connect:input_type -> ControlMessage
+	16, // 16: Control.Connect:output_type -> ControlMessage
+	16, // [16:17] is the sub-list for method output_type
+	15, // [15:16] is the sub-list for method input_type
+	15, // [15:15] is the sub-list for extension type_name
+	15, // [15:15] is the sub-list for extension extendee
+	0,  // [0:15] is the sub-list for field type_name
 }
 
 func init() { file_api_proto_init() }
@@ -577,7 +1860,7 @@ func file_api_proto_init() {
 			}
 		}
 		file_api_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CtrlPing); i {
+			switch v := v.(*Candidate); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -589,7 +1872,7 @@ func file_api_proto_init() {
 			}
 		}
 		file_api_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CtrlPong); i {
+			switch v := v.(*CtrlHeartbeatAck); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -601,7 +1884,7 @@ func file_api_proto_init() {
 			}
 		}
 		file_api_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CtrlOpenTunnel); i {
+			switch v := v.(*RelayLatency); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -613,7 +1896,7 @@ func file_api_proto_init() {
 			}
 		}
 		file_api_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CtrlOpenTunnelAck); i {
+			switch v := v.(*CtrlRelayBind); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -625,6 +1908,78 @@ func file_api_proto_init() {
 			}
 		}
 		file_api_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlRelayBindAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlBinding); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlBindingAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlPing); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlPong); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlOpenTunnel); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*CtrlRelay); i {
 			case 0:
 				return &v.state
@@ -636,16 +1991,59 @@ func file_api_proto_init() {
 				return nil
 			}
 		}
+		file_api_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ControlMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlTunnelRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CtrlAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_api_proto_msgTypes[12].OneofWrappers = []interface{}{
+		(*ControlMessage_Register)(nil),
+		(*ControlMessage_TunnelRequest)(nil),
+		(*ControlMessage_OpenTunnel)(nil),
+		(*ControlMessage_Ack)(nil),
+		(*ControlMessage_PeerUpdate)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_api_proto_rawDesc,
-			NumEnums:      2,
-			NumMessages:   6,
+			NumEnums:      4,
+			NumMessages:   15,
 			NumExtensions: 0,
-			NumServices:   0,
+			NumServices:   1,
 		},
 		GoTypes:           file_api_proto_goTypes,
 		DependencyIndexes: file_api_proto_depIdxs,
@@ -657,3 +2055,119 @@ func file_api_proto_init() {
 	file_api_proto_goTypes = nil
 	file_api_proto_depIdxs = nil
 }
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ControlClient interface {
+	// Connect opens the control stream of the node, the first message sent by
+	// the node must be the registration
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Control_ConnectClient, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Control_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Control_serviceDesc.Streams[0], "/Control/Connect", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlConnectClient{stream}
+	return x, nil
+}
+
+type Control_ConnectClient interface {
+	Send(*ControlMessage) error
+	Recv() (*ControlMessage, error)
+	grpc.ClientStream
+}
+
+type controlConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlConnectClient) Send(m *ControlMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *controlConnectClient) Recv() (*ControlMessage, error) {
+	m := new(ControlMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ControlServer is the server API for Control service.
+type ControlServer interface {
+	// Connect opens the control stream of the node, the first message sent by
+	// the node must be the registration
+	Connect(Control_ConnectServer) error
+}
+
+// UnimplementedControlServer can be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (*UnimplementedControlServer) Connect(Control_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+
+func RegisterControlServer(s *grpc.Server, srv ControlServer) {
+	s.RegisterService(&_Control_serviceDesc, srv)
+}
+
+func _Control_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ControlServer).Connect(&controlConnectServer{stream})
+}
+
+type Control_ConnectServer interface {
+	Send(*ControlMessage) error
+	Recv() (*ControlMessage, error)
+	grpc.ServerStream
+}
+
+type controlConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlConnectServer) Send(m *ControlMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *controlConnectServer) Recv() (*ControlMessage, error) {
+	m := new(ControlMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Control_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Control_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "api.proto",
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// virtualAddress represents an address of current node in the virtual network.
+// The network will be determined after registered to the gateway if the address
+// is not specified in CIDR form.
+type virtualAddress struct {
+	ip      net.IP
+	network *net.IPNet
+}
+
+// ipNet returns the address with the network prefix
+func (v *virtualAddress) ipNet() *net.IPNet {
+	return &net.IPNet{IP: v.ip, Mask: v.network.Mask}
+}
+
+// parseAddress parses the address in IP or CIDR form
+func parseAddress(addr string) (*virtualAddress, error) {
+	if strings.Contains(addr, "/") {
+		ip, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid address %s", addr)
+		}
+		return &virtualAddress{ip: normalizeIP(ip), network: network}, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.Errorf("invalid address %s", addr)
+	}
+	return &virtualAddress{ip: normalizeIP(ip)}, nil
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// setupNetwork determines the network prefix of every address. The network
+// specified by the address has the highest priority, and then the network of
+// the same address family defined by the gateway, and the default network
+// prefix is used if the gateway is unreachable.
+func (n *Node) setupNetwork() error {
+	// The gateway networks are only available after registered
+	var gatewayNetworks []*net.IPNet
+	select {
+	case <-n.registered:
+		for _, cidr := range n.gatewayNetworks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return errors.WithMessagef(err, "invalid network %s defined by gateway", cidr)
+			}
+			gatewayNetworks = append(gatewayNetworks, network)
+		}
+	default:
+	}
+
+	for _, addr := range n.addresses {
+		var gatewayNetwork *net.IPNet
+		for _, network := range gatewayNetworks {
+			if isIPv4(network.IP) == isIPv4(addr.ip) {
+				gatewayNetwork = network
+			}
+		}
+
+		switch {
+		case addr.network != nil:
+			if gatewayNetwork != nil && gatewayNetwork.String() != addr.network.String() {
+				zap.L().Warn("Network mismatches the gateway", zap.Stringer("network", addr.network), zap.Stringer("gateway", gatewayNetwork))
+			}
+		case gatewayNetwork != nil:
+			addr.network = gatewayNetwork
+		default:
+			prefix, bits := constant.DefaultNetworkPrefix, 8*net.IPv4len
+			if !isIPv4(addr.ip) {
+				prefix, bits = constant.DefaultNetworkPrefix6, 8*net.IPv6len
+			}
+			mask := net.CIDRMask(prefix, bits)
+			addr.network = &net.IPNet{IP: addr.ip.Mask(mask), Mask: mask}
+			zap.L().Warn("Use the default network prefix", zap.Stringer("network", addr.network))
+		}
+
+		if !addr.network.Contains(addr.ip) {
+			return errors.Errorf("address %s is out of the network %s", addr.ip, addr.network)
+		}
+	}
+	return nil
+}
+
+// isLocal reports whether the IP is one of the addresses of current node
+func (n *Node) isLocal(ip net.IP) bool {
+	for _, addr := range n.addresses {
+		if addr.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// routable reports whether the packet to the IP should be sent to the peers.
+// The link-local and multicast traffic (e.g: IPv6 router solicitation and MLD
+// report) and the broadcast of IPv4 network are never sent to the peers.
+func (n *Node) routable(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, addr := range n.addresses {
+		network := addr.network
+		if !network.Contains(ip) {
+			continue
+		}
+		// The network and broadcast address of IPv4 network
+		if v4 := ip.To4(); v4 != nil {
+			ones, bits := network.Mask.Size()
+			if bits-ones >= 2 {
+				broadcast := make(net.IP, net.IPv4len)
+				for i := range broadcast {
+					broadcast[i] = network.IP.To4()[i] | ^network.Mask[len(network.Mask)-net.IPv4len+i]
+				}
+				if v4.Equal(network.IP) || v4.Equal(broadcast) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// destination returns the destination address of the IPv4 or IPv6 packet
+func destination(data []byte) net.IP {
+	if len(data) < 1 {
+		return nil
+	}
+	options := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	switch data[0] >> 4 {
+	case 4:
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, options)
+		if ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+			return ipv4.DstIP
+		}
+	case 6:
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv6, options)
+		if ipv6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			return ipv6.DstIP
+		}
+	}
+	return nil
+}
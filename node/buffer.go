@@ -0,0 +1,168 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"time"
+
+	"github.com/lonng/zetamesh/constant"
+	"go.uber.org/zap"
+)
+
+type bufferedPacket struct {
+	data     []byte
+	deadline time.Time
+}
+
+// packetQueue buffers the packets to the peer while the tunnel is being
+// established, which avoids losing the first packets (e.g: TCP SYN and DNS
+// query) to a new peer. The queue is guarded by the buffers lock of the node
+// until it is taken out of the buffers.
+type packetQueue struct {
+	packets []bufferedPacket
+}
+
+// push appends a copy of the packet and returns the count of dropped packets
+// which are either expired or the oldest one if the queue is full
+func (q *packetQueue) push(data []byte) int {
+	now := time.Now()
+	dropped := q.expire(now)
+	if len(q.packets) >= constant.MaxBufferedPackets {
+		q.packets = q.packets[1:]
+		dropped++
+	}
+
+	dataCopy := make([]byte, len(data))
+	copy(dataCopy, data)
+	q.packets = append(q.packets, bufferedPacket{
+		data:     dataCopy,
+		deadline: now.Add(constant.BufferedPacketExpire),
+	})
+	return dropped
+}
+
+// drain removes all packets from the queue, and returns the unexpired packets
+// and the count of expired packets
+func (q *packetQueue) drain() ([][]byte, int) {
+	expired := q.expire(time.Now())
+	packets := make([][]byte, 0, len(q.packets))
+	for _, p := range q.packets {
+		packets = append(packets, p.data)
+	}
+	q.packets = nil
+	return packets, expired
+}
+
+// expire drops the expired packets from the head of the queue
+func (q *packetQueue) expire(now time.Time) int {
+	i := 0
+	for i < len(q.packets) && q.packets[i].deadline.Before(now) {
+		i++
+	}
+	q.packets = q.packets[i:]
+	return i
+}
+
+// buffer keeps the packet to the peer until the session established, the queue
+// is removed once all its packets expired if the session never established.
+func (n *Node) buffer(virtAddress string, data []byte) {
+	n.buffersMu.Lock()
+	queue, found := n.buffers[virtAddress]
+	if !found {
+		queue = &packetQueue{}
+		n.buffers[virtAddress] = queue
+		time.AfterFunc(constant.BufferedPacketExpire, func() {
+			n.expireBuffer(virtAddress, queue)
+		})
+	}
+	dropped := queue.push(data)
+	n.buffersMu.Unlock()
+
+	if dropped > 0 {
+		n.dropUnsent(virtAddress, dropped)
+	}
+}
+
+// expireBuffer removes the queue if all its packets expired, otherwise checks
+// the queue again after the last packet expires
+func (n *Node) expireBuffer(virtAddress string, queue *packetQueue) {
+	n.buffersMu.Lock()
+	// The queue has been flushed or discarded
+	if n.buffers[virtAddress] != queue {
+		n.buffersMu.Unlock()
+		return
+	}
+	now := time.Now()
+	expired := queue.expire(now)
+	if len(queue.packets) == 0 {
+		delete(n.buffers, virtAddress)
+	} else {
+		time.AfterFunc(queue.packets[len(queue.packets)-1].deadline.Sub(now), func() {
+			n.expireBuffer(virtAddress, queue)
+		})
+	}
+	n.buffersMu.Unlock()
+
+	if expired > 0 {
+		n.dropUnsent(virtAddress, expired)
+	}
+}
+
+// take removes the queue of the peer from the buffers and returns it
+func (n *Node) take(virtAddress string) *packetQueue {
+	n.buffersMu.Lock()
+	defer n.buffersMu.Unlock()
+
+	queue, found := n.buffers[virtAddress]
+	if !found {
+		return nil
+	}
+	delete(n.buffers, virtAddress)
+	return queue
+}
+
+// flush sends the buffered packets to the peer after the session established,
+// the packets are sent via the gateway relay until the direct path established.
+func (n *Node) flush(conn *connection) {
+	queue := n.take(conn.peerVirtAddr)
+	if queue == nil {
+		return
+	}
+
+	packets, expired := queue.drain()
+	for ; expired > 0; expired-- {
+		conn.counters.drop(dropNoTunnel)
+	}
+	if len(packets) == 0 {
+		return
+	}
+
+	zap.L().Debug("Flush buffered packets", zap.String("peer", conn.peerVirtAddr), zap.Int("count", len(packets)))
+	for _, data := range packets {
+		n.send(conn, data)
+	}
+}
+
+// discard drops all buffered packets to the peer, e.g: the peer is offline
+func (n *Node) discard(virtAddress string) {
+	queue := n.take(virtAddress)
+	if queue == nil {
+		return
+	}
+
+	packets, expired := queue.drain()
+	if dropped := len(packets) + expired; dropped > 0 {
+		n.dropUnsent(virtAddress, dropped)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/message"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// candidatePath represents the path from the local node to a candidate of the
+// peer, all paths share the same local port so the NAT mapping is reused.
+type candidatePath struct {
+	candidate *message.Candidate
+	socket    atomic.Value // net.Conn, which is replaced after the node rebinds
+	priority  uint64       // The pair priority, which prefers the candidates on the local links
+	predicted bool         // The path is opened by the port prediction and closed after it finished
+	closed    atomic.Bool  // The path is closed before the connection closed
+	mu        sync.Mutex   // Serialize the migration and the closing
+}
+
+func newCandidatePath(candidate *message.Candidate, conn net.Conn, priority uint64) *candidatePath {
+	path := &candidatePath{candidate: candidate, priority: priority}
+	path.socket.Store(conn)
+	return path
+}
+
+func (p *candidatePath) conn() net.Conn {
+	return p.socket.Load().(net.Conn)
+}
+
+// remote returns the remote address of the socket, which the Pings via the
+// path are sent to and the Pongs are received from
+func (p *candidatePath) remote() string {
+	return p.conn().RemoteAddr().String()
+}
+
+func (p *candidatePath) send(data []byte) {
+	if _, err := p.conn().Write(data); err != nil {
+		zap.L().Debug("Send message failed", zap.String("candidate", p.candidate.Address), zap.Error(err))
+	}
+}
+
+func (p *candidatePath) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed.Store(true)
+	_ = p.conn().Close()
+}
+
+// migrate replaces the socket with a new one dialed to the same remote address,
+// which is bound to the current local address after the local network changed
+func (p *candidatePath) migrate(dial func(address string) (net.Conn, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.Load() {
+		return nil
+	}
+	conn, err := dial(p.conn().RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	prev := p.conn()
+	p.socket.Store(conn)
+	_ = prev.Close()
+	return nil
+}
+
+// gatherCandidates returns the host candidates of the local interfaces, the
+// server reflexive candidate is observed by the gateway. The addresses of the
+// virtual networks are excluded to avoid tunneling the tunnel.
+func (n *Node) gatherCandidates() []*message.Candidate {
+	port := n.dialer.LocalAddr.(*net.UDPAddr).Port
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		zap.L().Warn("List interface addresses failed", zap.Error(err))
+		return nil
+	}
+
+	var candidates []*message.Candidate
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		// The local dialer only supports IPv4 paths
+		ip := ipNet.IP.To4()
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || n.isVirtual(ip) {
+			continue
+		}
+		candidates = append(candidates, &message.Candidate{
+			Address:  net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+			Type:     message.CandidateType_Host,
+			Priority: api.CandidatePriority(message.CandidateType_Host, uint32(0xffff-len(candidates))),
+		})
+		if len(candidates) >= api.MaxCandidates-1 {
+			break
+		}
+	}
+	return candidates
+}
+
+// isVirtual reports whether the IP is in the virtual networks
+func (n *Node) isVirtual(ip net.IP) bool {
+	for _, addr := range n.addresses {
+		if addr.network != nil && addr.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialCandidates dials the IPv4 candidates of the peer in priority order, the
+// server reflexive address is used if the gateway reports no candidates.
+func (n *Node) dialCandidates(openTunnel *message.CtrlOpenTunnel) []*candidatePath {
+	candidates := openTunnel.Candidates
+	if len(candidates) == 0 {
+		candidates = []*message.Candidate{{
+			Address:  openTunnel.UdpAddress,
+			Type:     message.CandidateType_ServerReflexive,
+			Priority: api.CandidatePriority(message.CandidateType_ServerReflexive, 0),
+		}}
+	}
+
+	var paths []*candidatePath
+	for _, candidate := range candidates {
+		addr, err := net.ResolveUDPAddr("udp", candidate.Address)
+		if err != nil || addr.IP.To4() == nil || !api.RoutableCandidate(addr.IP) {
+			continue
+		}
+		conn, err := n.dialer.Dial("udp", candidate.Address)
+		if err != nil {
+			zap.L().Debug("Dial candidate failed", zap.String("candidate", candidate.Address), zap.Error(err))
+			continue
+		}
+		priority := uint64(candidate.Priority)
+		if onLink(addr.IP) {
+			priority |= 1 << 32
+		}
+		paths = append(paths, newCandidatePath(candidate, conn, priority))
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return paths[i].priority > paths[j].priority
+	})
+	return paths
+}
+
+// onLink reports whether the IP is in the subnets of the local interfaces
+func onLink(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// controlStream returns the registered control stream, nil if disconnected
+func (n *Node) controlStream() *api.ControlStream {
+	stream, _ := n.control.Load().(*api.ControlStream)
+	return stream
+}
+
+// keepControl keeps the control stream to the gateway, which is connected
+// again after closed, e.g: the gateway restarted or the network changed. The
+// stream is registered after the gateway accepted the heartbeat of the node.
+func (n *Node) keepControl(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-n.registered:
+	}
+	for {
+		if err := n.connectControl(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Warn("Control stream disconnected", zap.String("gateway", n.opt.Gateway), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(constant.ControlRetryInterval):
+		}
+	}
+}
+
+// dialControl dials the gRPC control stream, or the WebSocket one if the gRPC
+// stream cannot be connected, e.g: the HTTP proxy only supports HTTP/1.1. The
+// transport connected last time is dialed first.
+func (n *Node) dialControl(ctx context.Context) (*api.ControlStream, error) {
+	dials := []func(context.Context) (*api.ControlStream, error){
+		n.apiClient.DialControl,
+		n.apiClient.DialControlSocket,
+	}
+	if n.controlSocket.Load() {
+		dials[0], dials[1] = dials[1], dials[0]
+	}
+
+	var err error
+	for _, dial := range dials {
+		dialCtx, cancel := context.WithTimeout(ctx, constant.ControlDialTimeout)
+		var stream *api.ControlStream
+		stream, err = dial(dialCtx)
+		cancel()
+		if err == nil {
+			n.controlSocket.Store(stream.Socket())
+			return stream, nil
+		}
+		zap.L().Debug("Dial control stream failed", zap.Error(err))
+	}
+	return nil, err
+}
+
+// connectControl dials the control stream and registers it with the signed
+// heartbeat, then handles the messages from the gateway until it is closed
+func (n *Node) connectControl(ctx context.Context) error {
+	stream, err := n.dialControl(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "dial control stream failed")
+	}
+	defer stream.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-stream.Done():
+		}
+	}()
+
+	// The acknowledgements are received by the reader
+	received := make(chan error, 1)
+	go func() {
+		received <- n.readControl(stream)
+	}()
+
+	err = stream.Request(&message.ControlMessage{
+		Payload: &message.ControlMessage_Register{Register: n.heartbeatMessage()},
+	}, constant.ControlAckTimeout)
+	if err != nil {
+		return errors.WithMessage(err, "register control stream failed")
+	}
+	n.control.Store(stream)
+	n.controlRegistered.Store(time.Now().UnixNano())
+	zap.L().Info("Control stream registered", zap.String("gateway", n.opt.Gateway))
+
+	err = <-received
+	n.control.Store((*api.ControlStream)(nil))
+	return err
+}
+
+// readControl handles the messages from the gateway until the stream closed.
+// Opening the tunnels dials the candidates, so the notifications are handled
+// in order by the worker instead of blocking receiving the acknowledgements.
+func (n *Node) readControl(stream *api.ControlStream) error {
+	tunnels := make(chan *message.ControlMessage, constant.ControlConcurrency)
+	defer close(tunnels)
+	go n.serveTunnels(stream, tunnels)
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch payload := msg.Payload.(type) {
+		case *message.ControlMessage_OpenTunnel, *message.ControlMessage_PeerUpdate:
+			select {
+			case tunnels <- msg:
+				continue
+			default:
+			}
+			// The update is not acknowledged, only the tunnel request fails
+			zap.L().Warn("Drop control message due to queue full", zap.Int64("id", msg.Id))
+			if open, ok := payload.(*message.ControlMessage_OpenTunnel); ok {
+				err := errors.Errorf("too many pending tunnels to open, drop peer '%s'", open.OpenTunnel.VirtAddress)
+				if err := stream.Ack(msg.Id, err); err != nil {
+					zap.L().Error("Acknowledge open tunnel failed", zap.Error(err))
+				}
+			}
+
+		default:
+			zap.L().Warn("Unexpected control message", zap.Int64("id", msg.Id))
+		}
+	}
+}
+
+// serveTunnels opens the tunnels notified via the control stream until the
+// channel closed
+func (n *Node) serveTunnels(stream *api.ControlStream, tunnels <-chan *message.ControlMessage) {
+	for msg := range tunnels {
+		switch payload := msg.Payload.(type) {
+		case *message.ControlMessage_OpenTunnel:
+			err := n.onOpenTunnel(payload.OpenTunnel)
+			if err != nil {
+				zap.L().Error("Open tunnel failed", zap.String("peer", payload.OpenTunnel.VirtAddress), zap.Error(err))
+			}
+			if err := stream.Ack(msg.Id, err); err != nil {
+				zap.L().Error("Acknowledge open tunnel failed", zap.Error(err))
+			}
+
+		case *message.ControlMessage_PeerUpdate:
+			// Only the connected peers are updated, the others are opened on demand
+			update := payload.PeerUpdate
+			if _, found := n.connections.Load(update.VirtAddress); !found {
+				continue
+			}
+			zap.L().Info("Peer network changed", zap.String("peer", update.VirtAddress), zap.String("udp", update.UdpAddress))
+			if err := n.onOpenTunnel(update); err != nil {
+				zap.L().Error("Update peer failed", zap.String("peer", update.VirtAddress), zap.Error(err))
+			}
+		}
+	}
+}
+
+// requestTunnel requests the gateway to open the tunnel to the peer, which is
+// acknowledged after both peers acknowledged the notifications
+func (n *Node) requestTunnel(virtAddress string) error {
+	stream := n.controlStream()
+	if stream == nil {
+		return errors.New("control stream not connected")
+	}
+	err := stream.Request(&message.ControlMessage{
+		Payload: &message.ControlMessage_TunnelRequest{
+			TunnelRequest: &message.CtrlTunnelRequest{Destination: virtAddress},
+		},
+	}, 2*constant.ControlAckTimeout)
+	return errors.WithMessage(err, "open tunnel failed")
+}
@@ -14,38 +14,58 @@
 package node
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/codec"
 	"github.com/lonng/zetamesh/constant"
 	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
 type handler interface {
-	handlePacket(remote net.Addr, data []byte)
+	handlePeerPacket(conn *connection, path *candidatePath, data []byte)
 	handleClosed(conn *connection)
+	relay(virtAddress string, data []byte)
+	probe(addr *net.UDPAddr, data []byte)
+	reopen(virtAddress string)
 }
 
 type connectionState byte
 
 const (
-	// StateConnecting represents the state of connecting to the peer
-	StateConnecting connectionState = 1
-	// StateEstablished represents the state of connection has been established
-	StateEstablished connectionState = 2
+	// StateProbing represents the state of checking the direct paths to the
+	// peer, the packets are relayed until any direct path works
+	StateProbing connectionState = 1
+	// StateDirect represents the state of sending packets via the direct path
+	StateDirect connectionState = 2
+	// StateRelayed represents the state of sending packets via the relay because
+	// no direct path works, the direct paths keep being probed in background
+	StateRelayed connectionState = 3
+	// StateFailed represents the state of neither the direct paths nor the relay
+	// answering, the tunnel is reopened via the gateway
+	StateFailed connectionState = 4
 )
 
 // String implements the fmt.Stringer interface
 func (s connectionState) String() string {
 	switch s {
-	case StateConnecting:
-		return "StateConnecting"
-	case StateEstablished:
-		return "StateEstablished"
+	case StateProbing:
+		return "StateProbing"
+	case StateDirect:
+		return "StateDirect"
+	case StateRelayed:
+		return "StateRelayed"
+	case StateFailed:
+		return "StateFailed"
 	default:
 		return fmt.Sprintf("UnknowState(%d)", s)
 	}
@@ -54,13 +74,58 @@ func (s connectionState) String() string {
 type connection struct {
 	selfVirtAddr string
 	peerVirtAddr string
+	peerIdentity ed25519.PublicKey // The identity of the peer attested by the gateway
 	handler      handler
 	once         atomic.Bool
-	state        connectionState
-	peer         net.Conn
+	state        atomic.Uint32    // The connectionState
+	established  atomic.Bool      // Any direct path has ever worked
+	paths        []*candidatePath // The paths to the candidates of the peer in priority order
+	candidates   string           // The canonical form of the candidates of the peer
 	pipeline     chan []byte
-	keepalive    time.Time
+	counters     *peerCounters
+	created      time.Time
 	die          chan struct{}
+
+	// The unix nano of the last Pong received via the selected direct path and
+	// via the relay, which tell whether the paths still work
+	keepalive  atomic.Int64
+	relayAlive atomic.Int64
+	upgraded   atomic.Int64 // The unix nano of the last transition to StateDirect
+	fellBack   time.Time    // The time of the last fallback from the direct path, only accessed by the loop
+	probing    time.Time    // The time the paths started to be probed, only accessed by the loop
+
+	// The handshake is exchanged by Ping/Pong both via the direct path and the
+	// gateway relay, so the relayed data can be encrypted before the direct
+	// path is established.
+	handshake *handshake
+	mu        sync.RWMutex
+	session   *session
+	selected  *candidatePath // The working path with highest priority
+
+	// The round-trip statistics of the keepalive and on-demand probes
+	stats probeStats
+
+	// The port prediction to traverse the symmetric NAT, and the peer reflexive
+	// paths learned from the handshakes received by the node listener
+	traversal    *traversal
+	learned      chan *candidatePath
+	learnedPaths sync.Map // remote address -> *candidatePath
+	learnedCount atomic.Int32
+
+	// The Pings sent via the direct paths, which must be answered by the Pongs
+	// from the same remote addresses before the paths are learned or nominated
+	challenges sync.Map // Ping nonce -> *pingChallenge
+
+	// The paths are migrated by the loop after the node rebinds the local port
+	migration chan *net.Dialer
+
+	// The failed connection probes all paths and the relay again after the
+	// gateway reopened the tunnel with the unchanged candidates
+	reprobe chan struct{}
+
+	// The relay server selected for the peer, empty means the gateway
+	peerRelays atomic.Value // []*message.RelayLatency reported by the peer
+	relay      atomic.String
 }
 
 func (c *connection) loop() {
@@ -76,66 +141,364 @@ func (c *connection) loop() {
 		keepalive = time.NewTicker(constant.PeerKeepaliveDuration)
 
 		send = func(data []byte) {
-			if _, err := c.peer.Write(data); err != nil {
-				zap.L().Error("Send message failed", zap.Error(err), zap.Int("state", int(c.state)))
+			if path := c.selectedPath(); path != nil {
+				path.send(data)
 			}
 		}
 
-		ping = func() {
-			data := codec.Encode(message.PacketType_Ping, &message.CtrlPing{
-				VirtAddress: c.selfVirtAddr,
-				Nonce:       randseq(128),
-			})
-			send(data)
+		// Ping the selected path to keep alive and measure the round-trip time
+		keepaliveSelected = func() {
+			if path := c.selectedPath(); path != nil {
+				path.send(c.ping(c.stats.send(nil), path.remote()))
+			}
 		}
+
+		// Exchange the handshake via gateway in case of the direct path unavailable
+		handshake = time.After(0)
+
+		// Probe the predicted ports of the peer behind the symmetric NAT
+		predict <-chan time.Time
+
+		// Monitor the paths and switch between the direct path and the relay
+		monitor = time.NewTicker(constant.PathCheckInterval)
+		reopen  time.Time
 	)
+	if c.traversal != nil {
+		predict = time.After(0)
+	}
+
+	c.probing = c.created
 
 	defer keepalive.Stop()
+	defer monitor.Stop()
 	defer c.handler.handleClosed(c)
 
-	go c.read()
+	for _, path := range c.paths {
+		go c.read(path)
+	}
 
 	for {
 		select {
 		case <-connecting:
-			if c.state != StateConnecting {
+			// The direct paths are probed less frequently in background after
+			// falling back to the relay
+			interval := constant.PathProbeInterval
+			if state := c.currentState(); state == StateProbing || state == StateDirect && c.nominating() {
+				interval = constant.ConnectingRetryDuration
+			}
+			connecting = time.After(interval)
+			for _, path := range c.checklist() {
+				path.send(c.ping(0, path.remote()))
+			}
+
+		case <-handshake:
+			// The relay is probed until it answers even if the session has
+			// been established via the direct path, otherwise the connection
+			// cannot fall back to the relay before any direct path works
+			if c.currentSession() != nil && c.relayAlive.Load() != 0 {
 				continue
 			}
-			connecting = time.After(constant.ConnectingRetryDuration)
-			ping()
+			handshake = time.After(constant.RelayHandshakeDuration)
+			c.handler.relay(c.peerVirtAddr, c.ping(0, ""))
 
 		case <-keepalive.C:
-			// Keepalive timeout and close currently connection to wait reconnect
-			if c.keepalive.Add(constant.PeerKeepaliveDuration * 2).Before(time.Now()) {
-				c.close()
-				continue
+			// Keepalive via the relay if the direct path unavailable, which
+			// tells whether the relay still works
+			if c.currentState() == StateDirect {
+				keepaliveSelected()
+			} else if c.currentSession() != nil {
+				c.handler.relay(c.peerVirtAddr, c.ping(c.stats.send(nil), ""))
 			}
-			if c.state != StateEstablished {
+
+		case now := <-monitor.C:
+			c.expireChallenges(now)
+			switch c.check(now) {
+			case StateDirect:
+				// Probe the selected path again if the keepalive is late, so a
+				// lost Pong doesn't make the connection fallback to the relay
+				if now.Sub(time.Unix(0, c.keepalive.Load())) > constant.PeerKeepaliveDuration {
+					keepaliveSelected()
+				}
+			case StateFailed:
+				if c.failedSince(now) > constant.PathFailedExpire {
+					c.close()
+					continue
+				}
+				// Request the gateway to reopen the tunnel, which refreshes
+				// the candidates if the peer has changed its network
+				if now.Sub(reopen) > constant.OfflineRetryDuration {
+					reopen = now
+					c.handler.reopen(c.peerVirtAddr)
+				}
+			}
+
+		case <-predict:
+			addrs, ok := c.traversal.next()
+			if !ok || c.currentState() == StateDirect {
+				predict = nil
+				c.prune()
 				continue
 			}
-			ping()
+			predict = time.After(constant.PortPredictionInterval)
+			for _, addr := range addrs {
+				c.handler.probe(addr, c.ping(0, addr.String()))
+			}
+
+		case path := <-c.learned:
+			c.paths = append(c.paths, path)
+			go c.read(path)
 
 		case data := <-c.pipeline:
 			send(data)
 
+		case dialer := <-c.migration:
+			c.migrate(dialer)
+
+		case <-c.reprobe:
+			if c.currentState() != StateFailed {
+				continue
+			}
+			zap.L().Info("Probe the failed connection again", zap.String("peer", c.peerVirtAddr))
+			c.probing = time.Now()
+			c.transit(StateProbing)
+			connecting = time.After(0)
+			handshake = time.After(0)
+
 		case <-c.die:
-			_ = c.peer.Close()
-			zap.L().Info("Connection closed", zap.String("peer", c.peerVirtAddr), zap.Stringer("desination", c.peer.RemoteAddr()))
+			for _, path := range c.paths {
+				path.close()
+			}
+			zap.L().Info("Connection closed", zap.String("peer", c.peerVirtAddr), zap.String("destination", c.remote()))
 			return
 		}
 	}
 }
 
-func (c *connection) read() {
+// ping returns the Ping message, the timestamp is echoed by the Pong message
+// to measure the round-trip time and zero means the Ping is not measured. The
+// Ping sent directly to the remote address is remembered as a challenge, and
+// the empty remote means the Ping is relayed.
+func (c *connection) ping(timestamp int64, remote string) []byte {
+	nonce := randseq(128)
+	if remote != "" {
+		c.challenges.Store(nonce, &pingChallenge{remote: remote, sent: time.Now().UnixNano()})
+	}
+	return codec.Encode(message.PacketType_Ping, &message.CtrlPing{
+		VirtAddress: c.selfVirtAddr,
+		Nonce:       nonce,
+		PublicKey:   c.handshake.public[:],
+		Timestamp:   timestamp,
+		Created:     c.handshake.created,
+		Proof:       c.handshake.proof,
+	})
+}
+
+// probe sends a Ping message to the peer via the direct path if established,
+// otherwise via the gateway relay, and waits for the Pong message until the deadline.
+func (c *connection) probe(deadline time.Time) (*probeResult, error) {
+	done := make(chan probeResult, 1)
+	timestamp := c.stats.send(done)
+	if path := c.selectedPath(); path != nil && c.currentState() == StateDirect {
+		data := c.ping(timestamp, path.remote())
+		select {
+		case c.pipeline <- data:
+		default:
+			c.stats.cancel(timestamp)
+			return nil, errors.New("channel full")
+		}
+	} else {
+		c.handler.relay(c.peerVirtAddr, c.ping(timestamp, ""))
+	}
+
+	select {
+	case result := <-done:
+		return &result, nil
+	case <-time.After(time.Until(deadline)):
+		c.stats.cancel(timestamp)
+		return nil, errors.New("timeout")
+	case <-c.die:
+		return nil, errors.New("connection closed")
+	}
+}
+
+// pingChallenge represents a Ping sent directly to the remote address
+type pingChallenge struct {
+	remote string
+	sent   int64 // The unix nano of the Ping sent
+}
+
+// answered reports whether the Pong answers a Ping sent to the remote address
+// which the Pong is received from, and the response is computed by the peer
+// with the current session. The Pongs replayed from other addresses or the
+// Pongs answering expired Pings cannot prove the path available.
+func (c *connection) answered(remote string, pong *message.CtrlPong) bool {
+	value, found := c.challenges.Load(pong.PingNonce)
+	if !found {
+		return false
+	}
+	challenge := value.(*pingChallenge)
+	if challenge.remote != remote || time.Since(time.Unix(0, challenge.sent)) > constant.PingExpire {
+		return false
+	}
+	s := c.currentSession()
+	return s != nil && s.verifyResponse(c.peerVirtAddr, pong.PingNonce, pong.Response)
+}
+
+// expireChallenges forgets the Pings unanswered for PingExpire
+func (c *connection) expireChallenges(now time.Time) {
+	c.challenges.Range(func(key, value interface{}) bool {
+		if now.Sub(time.Unix(0, value.(*pingChallenge).sent)) > constant.PingExpire {
+			c.challenges.Delete(key)
+		}
+		return true
+	})
+}
+
+func (c *connection) read(path *candidatePath) {
 	buffer := make([]byte, 4096)
 	for {
-		n, err := c.peer.Read(buffer)
+		conn := path.conn()
+		n, err := conn.Read(buffer)
+		if path.closed.Load() {
+			return
+		}
+		// Read the new socket after the path migrated
+		if err != nil && conn != path.conn() {
+			continue
+		}
+		// The ICMP port unreachable is reported when the peer hasn't opened
+		// its NAT mapping yet, which shouldn't stop the hole punching
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			zap.L().Debug("Peer connection refused", zap.String("peer", c.peerVirtAddr))
+			continue
+		}
 		if err != nil {
 			zap.L().Info("Read peer connection failed", zap.Error(err))
 			return
 		}
-		c.handler.handlePacket(c.peer.RemoteAddr(), buffer[:n])
+		c.handler.handlePeerPacket(c, path, buffer[:n])
+	}
+}
+
+// establish derives the session from the ephemeral public key of the peer, which
+// must be signed by the identity of the peer attested by the gateway. The session
+// is kept if the peer public key is unchanged, and only replaced by a newer key
+// of the peer, so the handshakes replayed by others cannot force a rekey.
+func (c *connection) establish(peerPublic []byte, created int64, proof []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session != nil && bytes.Equal(c.session.peerPublic, peerPublic) {
+		if !bytes.Equal(c.session.peerProof, proof) {
+			return errors.New("handshake proof mismatched")
+		}
+		return nil
+	}
+	if !c.verify(peerPublic, created, proof) {
+		return errors.New("handshake not signed by the peer identity")
+	}
+	if c.session != nil && created <= c.session.peerCreated {
+		return errors.New("stale handshake of the peer")
+	}
+	s, err := c.handshake.derive(peerPublic)
+	if err != nil {
+		return err
+	}
+	s.peerCreated = created
+	s.peerProof = append([]byte{}, proof...)
+	c.session = s
+	return nil
+}
+
+// verify reports whether the ephemeral public key of the peer is signed by the
+// identity of the peer attested by the gateway
+func (c *connection) verify(peerPublic []byte, created int64, proof []byte) bool {
+	fields := handshakeFields(c.peerVirtAddr, c.selfVirtAddr, peerPublic, created)
+	return api.VerifyIdentity(c.peerIdentity, proof, fields...)
+}
+
+// checklist returns the paths should be checked by Ping messages. All paths are
+// checked until any of them works, and the paths with higher priority than the
+// selected one keep being checked for a while to prefer the better path.
+func (c *connection) checklist() []*candidatePath {
+	if c.currentState() != StateDirect {
+		return c.paths
+	}
+	if !c.nominating() {
+		return nil
+	}
+	selected := c.selectedPath()
+	var paths []*candidatePath
+	for _, path := range c.paths {
+		if selected == nil || path.priority > selected.priority {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// nominating reports whether the paths with higher priority than the selected
+// one are still being checked after upgraded to the direct path
+func (c *connection) nominating() bool {
+	return time.Since(time.Unix(0, c.upgraded.Load())) <= constant.CandidateNominationDuration
+}
+
+// nominate selects the path if it has higher priority than the selected one,
+// and reports whether the path is selected
+func (c *connection) nominate(path *candidatePath) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.selected != nil && c.selected.priority >= path.priority {
+		return false
+	}
+	c.selected = path
+	return true
+}
+
+// unselect clears the selected path which stops working, so any working path
+// can be nominated regardless of the priority
+func (c *connection) unselect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selected = nil
+}
+
+func (c *connection) selectedPath() *candidatePath {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.selected
+}
+
+// remote returns the remote address of the selected path
+func (c *connection) remote() string {
+	if path := c.selectedPath(); path != nil {
+		return path.candidate.Address
+	}
+	return "-"
+}
+
+func (c *connection) currentSession() *session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
+// seal encrypts the raw IP packet into a data packet
+func (c *connection) seal(data []byte) ([]byte, error) {
+	s := c.currentSession()
+	if s == nil {
+		return nil, errors.New("session not established")
+	}
+	return codec.EncodeRaw(s.seal(data)), nil
+}
+
+// open decrypts the payload of a data packet into the raw IP packet
+func (c *connection) open(payload []byte) ([]byte, error) {
+	s := c.currentSession()
+	if s == nil {
+		return nil, errors.New("session not established")
 	}
+	return s.open(payload)
 }
 
 func (c *connection) close() {
@@ -145,3 +508,120 @@ func (c *connection) close() {
 		close(c.die)
 	}
 }
+
+func (c *connection) currentState() connectionState {
+	return connectionState(c.state.Load())
+}
+
+// transit changes the state of the connection and reports whether changed
+func (c *connection) transit(state connectionState) bool {
+	prev := connectionState(c.state.Swap(uint32(state)))
+	if prev == state {
+		return false
+	}
+	pathTransitions.WithLabelValues(state.String()).Inc()
+	zap.L().Info("Connection state changed", zap.String("peer", c.peerVirtAddr),
+		zap.Stringer("from", prev), zap.Stringer("to", state))
+	return true
+}
+
+// upgrade switches the connection to the direct path after the Pong received
+// via the selected path
+func (c *connection) upgrade() {
+	now := time.Now()
+	c.keepalive.Store(now.UnixNano())
+	if c.currentState() == StateDirect || !c.transit(StateDirect) {
+		return
+	}
+	c.upgraded.Store(now.UnixNano())
+	if !c.established.Swap(true) {
+		tunnelEstablish.WithLabelValues("success").Inc()
+		tunnelEstablishDuration.Observe(now.Sub(c.created).Seconds())
+	}
+}
+
+// relayed records the authenticated packet received via the relay, and the
+// failed connection recovers to use the relay
+func (c *connection) relayed() {
+	c.relayAlive.Store(time.Now().UnixNano())
+	if c.currentState() == StateFailed {
+		c.transit(StateRelayed)
+	}
+}
+
+// check transits the state according to the last Pong received via the direct
+// path and the relay, and returns the current state
+func (c *connection) check(now time.Time) connectionState {
+	state := c.currentState()
+	switch state {
+	case StateProbing:
+		if now.Sub(c.probing) > constant.PathProbingTimeout {
+			state = c.fallback(now)
+		}
+
+	case StateDirect:
+		if now.Sub(time.Unix(0, c.keepalive.Load())) > constant.PathDegradeTimeout {
+			zap.L().Warn("Direct path degraded, fallback to the relay", zap.String("peer", c.peerVirtAddr), zap.String("remote", c.remote()))
+			c.unselect()
+			// The relay is not probed while the direct path works, so it is
+			// assumed available until no Pong received for PathFailedTimeout
+			c.fellBack = now
+			c.handler.relay(c.peerVirtAddr, c.ping(c.stats.send(nil), ""))
+			state = c.fallback(now)
+		}
+
+	case StateRelayed:
+		state = c.fallback(now)
+	}
+	return state
+}
+
+// fallback transits the connection to the relay if the relay answered recently,
+// otherwise the connection is failed
+func (c *connection) fallback(now time.Time) connectionState {
+	state := StateRelayed
+	last := time.Unix(0, c.relayAlive.Load())
+	if c.fellBack.After(last) {
+		last = c.fellBack
+	}
+	if now.Sub(last) > constant.PathFailedTimeout {
+		state = StateFailed
+	}
+	c.transit(state)
+	return state
+}
+
+// failedSince returns the duration since neither the direct path nor the
+// relay answered
+func (c *connection) failedSince(now time.Time) time.Duration {
+	last := c.keepalive.Load()
+	if alive := c.relayAlive.Load(); alive > last {
+		last = alive
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// migrate dials the paths again with the dialer after the local network changed,
+// the predicted paths are dialed from random ports as they were opened. The
+// paths are probed immediately because the NAT mappings may have changed.
+func (c *connection) migrate(dialer *net.Dialer) {
+	for _, path := range c.paths {
+		dial := func(address string) (net.Conn, error) {
+			return dialer.Dial("udp", address)
+		}
+		if path.predicted {
+			dial = func(address string) (net.Conn, error) {
+				return net.Dial("udp4", address)
+			}
+		}
+		if err := path.migrate(dial); err != nil {
+			zap.L().Debug("Migrate path failed", zap.String("candidate", path.candidate.Address), zap.Error(err))
+			continue
+		}
+		path.send(c.ping(0, path.remote()))
+	}
+	if c.currentSession() != nil {
+		c.handler.relay(c.peerVirtAddr, c.ping(0, ""))
+	}
+	zap.L().Info("Migrate connection to the new local address", zap.String("peer", c.peerVirtAddr), zap.Int("paths", len(c.paths)))
+}
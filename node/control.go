@@ -0,0 +1,338 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/lonng/zetamesh/constant"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Control API path group
+const (
+	uriStatus   = "/status"
+	uriPeers    = "/peers"
+	uriPing     = "/ping"
+	uriCounters = "/counters"
+)
+
+type (
+	// Status represents the status of the local node
+	Status struct {
+		Address          string         `json:"address"`
+		Addresses        []string       `json:"addresses"`
+		Gateway          string         `json:"gateway"`
+		GatewayReachable bool           `json:"gateway_reachable"`
+		Transport        string         `json:"transport"`          // The transport to the gateway (udp/stream)
+		Control          bool           `json:"control"`            // The control stream to the gateway is registered
+		LastHeartbeatAck time.Time      `json:"last_heartbeat_ack"` // Zero if the gateway never answered
+		NATType          string         `json:"nat_type"`
+		MappedAddress    string         `json:"mapped_address"` // The public address observed by the gateway
+		PortMapping      string         `json:"port_mapping"`   // The external address mapped on the router, e.g: UPnP 1.2.3.4:5678
+		Relays           []*RelayStatus `json:"relays"`
+	}
+
+	// RelayStatus represents the binding of the node to the relay server
+	RelayStatus struct {
+		Address string        `json:"address"`
+		Active  bool          `json:"active"` // The relay answered the binding recently
+		RTT     time.Duration `json:"rtt"`
+	}
+
+	// PeerStatus represents the status of the connection to the peer
+	PeerStatus struct {
+		VirtAddress string       `json:"virt_address"`
+		State       string       `json:"state"`
+		Remote      string       `json:"remote"`
+		Relay       string       `json:"relay,omitempty"` // The relay server selected for the peer, empty means the gateway
+		Keepalive   time.Time    `json:"keepalive"`
+		Latency     LatencyStats `json:"latency"`
+	}
+
+	// PingResult represents the result of probing the peer via the mesh tunnel
+	PingResult struct {
+		Peer    string        `json:"peer"`
+		Relayed bool          `json:"relayed"` // The Pong is relayed by the gateway
+		RTT     time.Duration `json:"rtt"`
+		Error   string        `json:"error,omitempty"`
+		Latency LatencyStats  `json:"latency"`
+	}
+
+	// ControlClient is used to query the local node via the control socket
+	ControlClient struct {
+		client *http.Client
+	}
+)
+
+// DefaultControlPath returns the default path of the node control socket
+func DefaultControlPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.TempDir(), "zetamesh.sock")
+	}
+	return "/var/run/zetamesh.sock"
+}
+
+// controlListener rejects the control connections from other users
+type controlListener struct {
+	net.Listener
+}
+
+// Accept implements the net.Listener interface
+func (l *controlListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := authorizeControl(conn); err != nil {
+			zap.L().Warn("Reject control connection", zap.Error(err))
+			_ = conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// serveControl serves the control API on the unix socket which is only
+// accessible to the owner of the node process. The socket is created with the
+// restrictive umask, so it's never accessible to others even before chmod,
+// and the connections are checked by the peer credentials if supported.
+func (n *Node) serveControl(ctx context.Context, path string) error {
+	// Remove the socket left by the previous node which exited abnormally
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return errors.Errorf("control socket %s is in use", path)
+	}
+	_ = os.Remove(path)
+
+	restore := restrictUmask()
+	listener, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return errors.WithStack(err)
+	}
+	listener = &controlListener{Listener: listener}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(uriStatus, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.status())
+	})
+	mux.HandleFunc(uriPeers, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.peers())
+	})
+	mux.HandleFunc(uriPing, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.ping(r.URL.Query().Get("peer")))
+	})
+	mux.HandleFunc(uriCounters, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.snapshotCounters())
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	zap.L().Info("Serve control API", zap.String("path", path))
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Error("Write control response failed", zap.Error(err))
+	}
+}
+
+func (n *Node) status() *Status {
+	nat := n.natStatus()
+	status := &Status{
+		Address:       n.address,
+		Gateway:       n.opt.Gateway,
+		Transport:     "udp",
+		NATType:       nat.typ.String(),
+		MappedAddress: nat.mapped,
+		Control:       n.controlStream() != nil,
+	}
+	if n.currentStream() != nil {
+		status.Transport = "stream"
+	}
+	if mapping := n.portMapping(); mapping != nil {
+		status.PortMapping = mapping.Protocol + " " + mapping.External.String()
+	}
+	for _, addr := range n.addresses {
+		status.Addresses = append(status.Addresses, addr.ip.String())
+	}
+	status.Relays = n.relayStatus()
+	if ack := n.lastHeartbeatAck.Load(); ack > 0 {
+		status.LastHeartbeatAck = time.Unix(0, ack)
+		status.GatewayReachable = time.Since(status.LastHeartbeatAck) < 2*constant.HeartbeatInterval*time.Second
+	}
+	return status
+}
+
+func (n *Node) peers() []*PeerStatus {
+	peers := []*PeerStatus{}
+	n.connections.Range(func(_, value interface{}) bool {
+		conn := value.(*connection)
+		peers = append(peers, &PeerStatus{
+			VirtAddress: conn.peerVirtAddr,
+			State:       conn.currentState().String(),
+			Remote:      conn.remote(),
+			Relay:       conn.relay.Load(),
+			Keepalive:   time.Unix(0, conn.keepalive.Load()),
+			Latency:     conn.stats.snapshot(),
+		})
+		return true
+	})
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].VirtAddress < peers[j].VirtAddress
+	})
+	return peers
+}
+
+func (n *Node) snapshotCounters() *Counters {
+	counters := &Counters{
+		Unroutable:  n.unroutable.Load(),
+		Unreachable: n.unreachable.Load(),
+		Peers:       []*PeerCounters{},
+	}
+	n.peerCounters.Range(func(key, value interface{}) bool {
+		counters.Peers = append(counters.Peers, value.(*peerCounters).snapshot(key.(string)))
+		return true
+	})
+	sort.Slice(counters.Peers, func(i, j int) bool {
+		return counters.Peers[i].Peer < counters.Peers[j].Peer
+	})
+	return counters
+}
+
+// ping probes the peer via the direct path if established, otherwise via the
+// gateway relay. The tunnel will be opened if there is no connection to the peer,
+// and both opening the tunnel and the probe are bounded by the ProbeTimeout.
+func (n *Node) ping(virtAddress string) *PingResult {
+	result := &PingResult{Peer: virtAddress}
+	if primary, found := n.routes.Load(virtAddress); found {
+		virtAddress = primary.(string)
+	}
+
+	var conn *connection
+	deadline := time.Now().Add(constant.ProbeTimeout)
+	for conn == nil && time.Now().Before(deadline) {
+		if val, found := n.connections.Load(virtAddress); found {
+			conn = val.(*connection)
+			break
+		}
+		n.openTunnel(virtAddress)
+		time.Sleep(constant.ConnectingRetryDuration)
+	}
+	if conn == nil {
+		result.Error = "no connection to the peer"
+		return result
+	}
+
+	probe, err := conn.probe(deadline)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Relayed = probe.relayed
+		result.RTT = probe.rtt
+	}
+	result.Latency = conn.stats.snapshot()
+	return result
+}
+
+// NewControlClient returns a client which queries the node via the control socket
+func NewControlClient(path string) *ControlClient {
+	return &ControlClient{
+		client: &http.Client{
+			// The ping request is answered within the ProbeTimeout
+			Timeout: constant.ProbeTimeout + time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the status of the local node
+func (c *ControlClient) Status() (*Status, error) {
+	status := &Status{}
+	if err := c.get(uriStatus, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Peers returns the status of all connections of the local node
+func (c *ControlClient) Peers() ([]*PeerStatus, error) {
+	var peers []*PeerStatus
+	if err := c.get(uriPeers, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Ping probes the peer via the mesh tunnel
+func (c *ControlClient) Ping(peer string) (*PingResult, error) {
+	result := &PingResult{}
+	if err := c.get(uriPing+"?peer="+url.QueryEscape(peer), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Counters returns the traffic counters of the local node
+func (c *ControlClient) Counters() (*Counters, error) {
+	counters := &Counters{}
+	if err := c.get(uriCounters, counters); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+func (c *ControlClient) get(uri string, res interface{}) error {
+	// The host is ignored because the request is sent via the unix socket
+	resp, err := c.client.Get("http://zetamesh" + uri)
+	if err != nil {
+		return errors.WithMessage(err, "connect to the node failed, is the node running?")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(res))
+}
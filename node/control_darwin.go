@@ -0,0 +1,34 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"net"
+	"syscall"
+)
+
+// restrictUmask makes the files created only accessible to the owner until
+// the returned function restores the umask
+func restrictUmask() func() {
+	prev := syscall.Umask(0177)
+	return func() {
+		syscall.Umask(prev)
+	}
+}
+
+// authorizeControl accepts all control connections, which are restricted by
+// the mode of the socket file only
+func authorizeControl(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// restrictUmask makes the files created only accessible to the owner until
+// the returned function restores the umask
+func restrictUmask() func() {
+	prev := syscall.Umask(0177)
+	return func() {
+		syscall.Umask(prev)
+	}
+}
+
+// authorizeControl accepts the control connections from the owner of the node
+// process or the root only, according to the peer credentials of the socket
+func authorizeControl(conn net.Conn) error {
+	raw, err := conn.(*net.UnixConn).SyscallConn()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	if credErr != nil {
+		return errors.WithStack(credErr)
+	}
+	if cred.Uid != 0 && int(cred.Uid) != os.Geteuid() {
+		return errors.Errorf("control connection from uid %d (pid %d) rejected", cred.Uid, cred.Pid)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"go.uber.org/atomic"
+)
+
+type dropReason byte
+
+const (
+	// dropChannelFull represents the packet dropped due to the connection pipeline full
+	dropChannelFull dropReason = iota
+	// dropNoTunnel represents the packet dropped due to the tunnel to the peer
+	// hasn't been opened or the session hasn't been established
+	dropNoTunnel
+	// dropSubnetMismatch represents the packet received from the peer is not
+	// destined to the addresses of current node
+	dropSubnetMismatch
+)
+
+type (
+	// Traffic represents the count of packets and the bytes of the raw IP packets
+	Traffic struct {
+		Packets uint64 `json:"packets"`
+		Bytes   uint64 `json:"bytes"`
+	}
+
+	// Drops represents the count of dropped packets by reasons
+	Drops struct {
+		ChannelFull    uint64 `json:"channel_full"`
+		NoTunnel       uint64 `json:"no_tunnel"`
+		SubnetMismatch uint64 `json:"subnet_mismatch"`
+	}
+
+	// PeerCounters represents the traffic counters between current node and the peer
+	PeerCounters struct {
+		Peer            string  `json:"peer"`
+		SentDirect      Traffic `json:"sent_direct"`
+		SentRelayed     Traffic `json:"sent_relayed"`
+		ReceivedDirect  Traffic `json:"received_direct"`
+		ReceivedRelayed Traffic `json:"received_relayed"`
+		Drops           Drops   `json:"drops"`
+	}
+
+	// Counters represents the traffic counters of the local node
+	Counters struct {
+		Unroutable  uint64          `json:"unroutable"`  // The packets to the destination out of the virtual networks
+		Unreachable uint64          `json:"unreachable"` // The packets dropped to the peers without connection
+		Peers       []*PeerCounters `json:"peers"`
+	}
+)
+
+type trafficCounter struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+func (t *trafficCounter) add(length int) {
+	t.packets.Inc()
+	t.bytes.Add(uint64(length))
+}
+
+func (t *trafficCounter) snapshot() Traffic {
+	return Traffic{
+		Packets: t.packets.Load(),
+		Bytes:   t.bytes.Load(),
+	}
+}
+
+// peerCounters keeps the traffic counters of the peer while connected, which
+// are shared by the connection replacing the previous one, so the counters
+// survive reconnecting to the new candidates of the peer.
+type peerCounters struct {
+	sentDirect      trafficCounter
+	sentRelayed     trafficCounter
+	receivedDirect  trafficCounter
+	receivedRelayed trafficCounter
+	drops           [dropSubnetMismatch + 1]atomic.Uint64
+}
+
+func (p *peerCounters) sent(relayed bool, length int) {
+	if relayed {
+		p.sentRelayed.add(length)
+		peerBytes.WithLabelValues("sent", "relayed").Add(float64(length))
+	} else {
+		p.sentDirect.add(length)
+		peerBytes.WithLabelValues("sent", "direct").Add(float64(length))
+	}
+}
+
+func (p *peerCounters) received(relayed bool, length int) {
+	if relayed {
+		p.receivedRelayed.add(length)
+		peerBytes.WithLabelValues("received", "relayed").Add(float64(length))
+	} else {
+		p.receivedDirect.add(length)
+		peerBytes.WithLabelValues("received", "direct").Add(float64(length))
+	}
+}
+
+func (p *peerCounters) drop(reason dropReason) {
+	p.drops[reason].Inc()
+}
+
+func (p *peerCounters) snapshot(peer string) *PeerCounters {
+	return &PeerCounters{
+		Peer:            peer,
+		SentDirect:      p.sentDirect.snapshot(),
+		SentRelayed:     p.sentRelayed.snapshot(),
+		ReceivedDirect:  p.receivedDirect.snapshot(),
+		ReceivedRelayed: p.receivedRelayed.snapshot(),
+		Drops: Drops{
+			ChannelFull:    p.drops[dropChannelFull].Load(),
+			NoTunnel:       p.drops[dropNoTunnel].Load(),
+			SubnetMismatch: p.drops[dropSubnetMismatch].Load(),
+		},
+	}
+}
+
+// dropUnsent counts the packets to the peer dropped before sent, the packets
+// are counted by the node if there is no connection to the peer.
+func (n *Node) dropUnsent(virtAddress string, count int) {
+	val, found := n.peerCounters.Load(virtAddress)
+	if !found {
+		n.unreachable.Add(uint64(count))
+		return
+	}
+	for ; count > 0; count-- {
+		val.(*peerCounters).drop(dropNoTunnel)
+	}
+}
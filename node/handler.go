@@ -14,44 +14,63 @@
 package node
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"net"
+	"syscall"
 	"time"
 
+	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/codec"
 	"github.com/lonng/zetamesh/constant"
 	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
-var protos = []proto.Message{
-	message.PacketType_Ping:       &message.CtrlPing{},
-	message.PacketType_Pong:       &message.CtrlPong{},
-	message.PacketType_OpenTunnel: &message.CtrlOpenTunnel{},
-}
-
+// schedule reads the packets from the gateway socket, the socket is replaced
+// after the node rebinds
 func (n *Node) schedule(ctx context.Context) error {
 	buffer := make([]byte, constant.MaxBufferSize)
 	for {
-		select {
-		case <-ctx.Done():
+		conn := n.gatewayConn()
+		c, remote, err := conn.ReadFromUDP(buffer)
+		if err == nil {
+			n.handlePacket(remote, buffer[:c])
+			continue
+		}
+
+		switch {
+		case ctx.Err() != nil:
 			zap.L().Info("Context cancelled", zap.Error(ctx.Err()))
 			return ctx.Err()
 
+		case n.stopped.Load():
+			zap.L().Info("Node stopped, stop reading the gateway socket")
+			return nil
+
+		case conn != n.gatewayConn():
+			// The socket has been replaced
+
+		case errors.Is(err, syscall.ECONNREFUSED):
+			// The ICMP port unreachable is reported for each packet sent while
+			// the gateway is down, which is recovered by the heartbeats
+			zap.L().Debug("Gateway refused the UDP packet", zap.Error(err))
+
 		default:
-			// Read new UDP message
-			c, remote, err := n.gateway.ReadFromUDP(buffer)
-			if err != nil {
-				zap.L().Error("Read UDP failed", zap.Error(err))
-				continue
+			zap.L().Warn("Read UDP failed, rebind the socket", zap.Error(err))
+			n.rebindNow()
+			select {
+			case <-ctx.Done():
+			case <-time.After(constant.RebindRetryInterval):
 			}
-
-			n.handlePacket(remote, buffer[:c])
 		}
 	}
 }
 
+// handlePacket handles the packets received from the gateway
 func (n *Node) handlePacket(remote net.Addr, data []byte) {
 	// Invalid packet
 	if len(data) < 1 {
@@ -59,119 +78,350 @@ func (n *Node) handlePacket(remote net.Addr, data []byte) {
 	}
 
 	packetType := message.PacketType(data[0])
-	payload := data[1:]
-	if packetType == message.PacketType_Data {
-		zap.L().Debug("Receive packet", zap.Stringer("source", remote))
-		dataCopy := make([]byte, len(payload))
-		copy(dataCopy, payload)
-		n.pipeline <- dataCopy
-		return
-	}
+	switch packetType {
+	case message.PacketType_HeartbeatAck:
+		ack := &message.CtrlHeartbeatAck{}
+		if err := proto.Unmarshal(data[1:], ack); err != nil {
+			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", packetType), zap.Error(err))
+			return
+		}
+		n.onHeartbeatAck(remote, ack)
+
+	case message.PacketType_Relay:
+		relay := &message.CtrlRelay{}
+		if err := proto.Unmarshal(data[1:], relay); err != nil {
+			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", packetType), zap.Error(err))
+			return
+		}
+		conn, found := n.connections.Load(relay.Source)
+		if !found {
+			zap.L().Debug("Receive relay packet of unknown connection", zap.String("peer", relay.Source))
+			return
+		}
+		n.handlePeerPacket(conn.(*connection), nil, relay.Data)
+
+	case message.PacketType_BindingAck:
+		ack := &message.CtrlBindingAck{}
+		if err := proto.Unmarshal(data[1:], ack); err != nil {
+			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", packetType), zap.Error(err))
+			return
+		}
+		n.onBindingAck(ack)
 
-	if int(packetType) >= len(protos) {
+	default:
 		zap.L().Error("Unrecognized message type", zap.Stringer("type", packetType), zap.Stringer("source", remote))
+	}
+}
+
+// handlePeerPacket handles the packets sent by the peer either directly via
+// the path or relayed by the gateway if the path is nil.
+func (n *Node) handlePeerPacket(conn *connection, path *candidatePath, data []byte) {
+	// Invalid packet
+	if len(data) < 1 {
 		return
 	}
 
-	msg := protos[int(packetType)]
-	if reseter, ok := msg.(codec.Reseter); ok {
-		reseter.Reset()
-		err := proto.Unmarshal(payload, msg)
+	relayed := path == nil
+
+	packetType := message.PacketType(data[0])
+	payload := data[1:]
+	if packetType == message.PacketType_Data {
+		zap.L().Debug("Receive packet", zap.String("peer", conn.peerVirtAddr), zap.Bool("relayed", relayed))
+		plaintext, err := conn.open(payload)
 		if err != nil {
-			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", packetType), zap.Error(err))
+			zap.L().Debug("Drop undecryptable packet", zap.String("peer", conn.peerVirtAddr), zap.Error(err))
 			return
 		}
+		if relayed {
+			conn.relayed()
+		}
+		if dst := destination(plaintext); dst == nil || !n.isLocal(dst) {
+			conn.counters.drop(dropSubnetMismatch)
+			zap.L().Debug("Drop packet not destined to current node", zap.String("peer", conn.peerVirtAddr), zap.Stringer("destination", dst))
+			return
+		}
+		conn.counters.received(relayed, len(plaintext))
+		n.pipeline <- plaintext
+		return
 	}
 
 	switch packetType {
 	case message.PacketType_Ping:
-		n.onPing(remote, msg.(*message.CtrlPing))
+		ping := &message.CtrlPing{}
+		if err := proto.Unmarshal(payload, ping); err != nil {
+			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", packetType), zap.Error(err))
+			return
+		}
+		n.onPing(conn, path, ping)
 
 	case message.PacketType_Pong:
-		n.onPong(remote, msg.(*message.CtrlPong))
+		pong := &message.CtrlPong{}
+		if err := proto.Unmarshal(payload, pong); err != nil {
+			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", packetType), zap.Error(err))
+			return
+		}
+		n.onPong(conn, path, pong)
 
-	case message.PacketType_OpenTunnel:
-		n.onOpenTunnel(msg.(*message.CtrlOpenTunnel))
+	default:
+		zap.L().Error("Unrecognized peer message type", zap.Stringer("type", packetType), zap.String("peer", conn.peerVirtAddr))
 	}
 }
 
-func (n *Node) onPing(source net.Addr, ping *message.CtrlPing) {
-	conn, found := n.connections.Load(ping.VirtAddress)
-	if !found {
+func (n *Node) onPing(conn *connection, path *candidatePath, ping *message.CtrlPing) {
+	zap.L().Debug("Receive Ping message", zap.String("peer", ping.VirtAddress), zap.Bool("relayed", path == nil))
+
+	data := n.pong(conn, ping)
+	if data == nil {
 		return
 	}
+	if path == nil {
+		conn.relayed()
+	}
+	defer n.flush(conn)
 
-	zap.L().Debug("Receive Ping message", zap.String("peer", ping.VirtAddress), zap.Stringer("source", source))
+	// Reply the Pong message via the same path of the Ping message
+	if path == nil {
+		n.relay(conn.peerVirtAddr, data)
+		return
+	}
+	path.send(data)
+}
 
-	data := codec.Encode(message.PacketType_Pong, &message.CtrlPong{
-		VirtAddress: n.opt.Address,
+// pong establishes the session with the handshake of the Ping, and returns
+// the Pong message answering the Ping. The response to the Ping nonce proves
+// the Pong is sent by current node.
+func (n *Node) pong(conn *connection, ping *message.CtrlPing) []byte {
+	if ping.VirtAddress != conn.peerVirtAddr {
+		return nil
+	}
+	// The unauthenticated handshakes are dropped silently, which may be sent by others
+	if err := conn.establish(ping.PublicKey, ping.Created, ping.Proof); err != nil {
+		zap.L().Debug("Establish session failed", zap.String("peer", ping.VirtAddress), zap.Error(err))
+		return nil
+	}
+	return codec.Encode(message.PacketType_Pong, &message.CtrlPong{
+		VirtAddress: n.address,
 		Nonce:       randseq(128),
+		PublicKey:   conn.handshake.public[:],
+		Timestamp:   ping.Timestamp,
+		Created:     conn.handshake.created,
+		Proof:       conn.handshake.proof,
+		PingNonce:   ping.Nonce,
+		Response:    conn.currentSession().respond(n.address, ping.Nonce),
 	})
-	conn.(*connection).pipeline <- data
 }
 
-func (n *Node) onPong(source net.Addr, pong *message.CtrlPong) {
-	c, found := n.connections.Load(pong.VirtAddress)
-	if !found {
-		zap.L().Info("Receive unknown connection Pong message", zap.String("vaddr", pong.VirtAddress))
+func (n *Node) onPong(conn *connection, path *candidatePath, pong *message.CtrlPong) {
+	if pong.VirtAddress != conn.peerVirtAddr {
 		return
 	}
 
-	zap.L().Debug("Receive Pong message", zap.String("peer", pong.VirtAddress), zap.Stringer("source", source))
+	relayed := path == nil
+	zap.L().Debug("Receive Pong message", zap.String("peer", pong.VirtAddress), zap.Bool("relayed", relayed))
 
-	conn := c.(*connection)
-	conn.keepalive = time.Now()
-	if conn.state != StateEstablished {
-		conn.state = StateEstablished
+	if err := conn.establish(pong.PublicKey, pong.Created, pong.Proof); err != nil {
+		zap.L().Debug("Establish session failed", zap.String("peer", pong.VirtAddress), zap.Error(err))
+		return
 	}
-}
+	defer n.flush(conn)
 
-func (n *Node) onOpenTunnel(openTunnel *message.CtrlOpenTunnel) {
-	// Send new connection ACK to the gateway server
-	openTunnelAck := func() {
-		ack := codec.Encode(message.PacketType_OpenTunnelAck, &message.CtrlOpenTunnelAck{
-			AckId: openTunnel.AckId,
-		})
+	// The Pong via the direct path must answer a Ping sent to the same remote
+	// address, otherwise it may be replayed by others to select their paths
+	if !relayed && !conn.answered(path.remote(), pong) {
+		zap.L().Debug("Drop unanswered Pong", zap.String("peer", pong.VirtAddress), zap.String("remote", path.remote()))
+		return
+	}
+	if pong.Timestamp != 0 {
+		conn.stats.observe(pong.Timestamp, relayed)
+	}
 
-		_, err := n.gateway.Write(ack)
-		if err != nil {
-			zap.L().Error("Acknowledge open tunnel failed", zap.Error(err))
+	// The Pong message relayed by gateway cannot prove the direct path available
+	if relayed {
+		conn.relayed()
+		return
+	}
+
+	if conn.nominate(path) {
+		zap.L().Info("Select candidate path", zap.String("peer", conn.peerVirtAddr),
+			zap.String("candidate", path.candidate.Address), zap.Stringer("type", path.candidate.Type))
+	}
+	// The other paths working cannot prove the selected one available
+	if path == conn.selectedPath() {
+		conn.upgrade()
+	}
+}
+
+// verifyHeartbeatAck verifies the heartbeat ack is signed by the gateway for
+// current node and newer than the accepted ones, so the error codes forged or
+// replayed by others cannot stop the node
+func (n *Node) verifyHeartbeatAck(ack *message.CtrlHeartbeatAck) error {
+	if ack.VirtAddress != n.address {
+		return errors.Errorf("heartbeat ack sent to '%s'", ack.VirtAddress)
+	}
+	if !api.Verify(n.opt.Key, ack.Nonce, ack.Signature, api.HeartbeatAckFields(ack)...) {
+		return errors.New("heartbeat ack signed with mismatched key")
+	}
+	if time.Since(time.Unix(0, ack.Timestamp)) > constant.NonceExpire {
+		return errors.New("stale heartbeat ack")
+	}
+	// The ack must answer a heartbeat sent recently by this node, otherwise the
+	// gateway may answer the heartbeat spoofed by others with our address
+	if _, found := n.heartbeatNonces.Load(ack.HeartbeatNonce); !found {
+		return errors.New("heartbeat ack answers no heartbeat sent")
+	}
+	for {
+		last := n.lastAckTimestamp.Load()
+		if ack.Timestamp <= last {
+			return errors.New("replayed heartbeat ack")
 		}
+		if n.lastAckTimestamp.CAS(last, ack.Timestamp) {
+			return nil
+		}
+	}
+}
+
+func (n *Node) onHeartbeatAck(remote net.Addr, ack *message.CtrlHeartbeatAck) {
+	if err := n.verifyHeartbeatAck(ack); err != nil {
+		zap.L().Debug("Drop heartbeat ack", zap.Stringer("remote", remote), zap.Error(err))
+		return
+	}
+	if n.gatewayLost.Swap(false) {
+		zap.L().Info("Gateway reachable again", zap.String("gateway", n.opt.Gateway), zap.Stringer("remote", remote))
+	}
+	n.lastHeartbeatAck.Store(time.Now().UnixNano())
+	if _, ok := remote.(*net.UDPAddr); ok {
+		n.lastUDPAck.Store(time.Now().UnixNano())
+	}
+	n.bindingPort.Store(ack.BindingPort)
+	if ack.Code != message.StatusCode_Success {
+		err := errors.Errorf("gateway rejected the address %s (%s): %s", n.address, ack.Code, ack.Error)
+		n.fail(api.ErrorWithCode(ack.Code, err))
+		return
+	}
+	n.updateRelays(ack)
+	n.registerOnce.Do(func() {
+		zap.L().Info("Register to the gateway successfully", zap.String("address", n.address), zap.Strings("networks", ack.Networks))
+		n.gatewayNetworks = ack.Networks
+		close(n.registered)
+	})
+}
+
+// onOpenTunnel opens the connection to the peer notified by the gateway, the
+// error is answered to the gateway via the control stream
+func (n *Node) onOpenTunnel(openTunnel *message.CtrlOpenTunnel) error {
+	// The handshakes of the peer are verified with the identity
+	if len(openTunnel.PublicKey) != ed25519.PublicKeySize {
+		return errors.Errorf("no identity of the peer '%s'", openTunnel.VirtAddress)
 	}
 
-	// Close the previous connection if the remote UDP address changed
+	// Close the previous connection if the candidates of the peer changed
+	candidates := openTunnel.UdpAddress + "|" + api.CandidatesField(openTunnel.Candidates)
 	if conn, found := n.connections.Load(openTunnel.VirtAddress); found {
 		conn := conn.(*connection)
-		if conn.peer.RemoteAddr().String() == openTunnel.UdpAddress {
-			openTunnelAck()
-			return
+		if conn.candidates == candidates && bytes.Equal(conn.peerIdentity, openTunnel.PublicKey) {
+			conn.peerRelays.Store(openTunnel.RelayLatencies)
+			n.selectRelay(conn)
+			select {
+			case conn.reprobe <- struct{}{}:
+			default:
+			}
+			return nil
 		}
 
-		// Reconnect to the new UDP address if the UDP address of peer has changed
+		// Reconnect to the new candidates if the peer has changed its network
 		conn.close()
 	}
 
-	peer, err := n.dialer.Dial("udp", openTunnel.UdpAddress)
+	paths := n.dialCandidates(openTunnel)
+	traversal, predicted := n.predict(openTunnel)
+	paths = append(paths, predicted...)
+	if len(paths) == 0 {
+		return errors.Errorf("no available candidate of the peer '%s'", openTunnel.VirtAddress)
+	}
+
+	handshake, err := newHandshake(n.identity, n.address, openTunnel.VirtAddress)
 	if err != nil {
-		return
+		for _, path := range paths {
+			_ = path.conn().Close()
+		}
+		return errors.WithMessage(err, "generate handshake key failed")
 	}
 
 	conn := &connection{
-		selfVirtAddr: n.opt.Address,
+		selfVirtAddr: n.address,
 		peerVirtAddr: openTunnel.VirtAddress,
+		peerIdentity: openTunnel.PublicKey,
 		handler:      n,
-		peer:         peer,
-		state:        StateConnecting,
+		paths:        paths,
+		candidates:   candidates,
 		pipeline:     make(chan []byte, 128),
-		keepalive:    time.Now(),
+		created:      time.Now(),
 		die:          make(chan struct{}),
+		handshake:    handshake,
+		traversal:    traversal,
+		learned:      make(chan *candidatePath),
+		migration:    make(chan *net.Dialer, 1),
+		reprobe:      make(chan struct{}, 1),
 	}
+	counters, _ := n.peerCounters.LoadOrStore(openTunnel.VirtAddress, &peerCounters{})
+	conn.counters = counters.(*peerCounters)
+	conn.state.Store(uint32(StateProbing))
+	conn.keepalive.Store(conn.created.UnixNano())
+	conn.peerRelays.Store(openTunnel.RelayLatencies)
+	n.selectRelay(conn)
 	n.connections.Store(openTunnel.VirtAddress, conn)
+	for _, addr := range openTunnel.Addresses {
+		if addr != openTunnel.VirtAddress {
+			n.routes.Store(addr, openTunnel.VirtAddress)
+		}
+	}
 	go conn.loop()
-
-	openTunnelAck()
+	return nil
 }
 
 func (n *Node) handleClosed(conn *connection) {
+	if !conn.established.Load() {
+		tunnelEstablish.WithLabelValues("failure").Inc()
+	}
+
+	// The connection may have been replaced by a new one of the same peer
+	if current, found := n.connections.Load(conn.peerVirtAddr); found && current != conn {
+		return
+	}
 	n.connections.Delete(conn.peerVirtAddr)
+	n.peerCounters.Delete(conn.peerVirtAddr)
+	n.routes.Range(func(key, value interface{}) bool {
+		if value == conn.peerVirtAddr {
+			n.routes.Delete(key)
+		}
+		return true
+	})
+}
+
+// reopen requests the gateway to open the tunnel to the peer again, e.g: the
+// connection failed. The connection is replaced if the peer has changed its
+// candidates, otherwise it probes all paths and the relay again.
+func (n *Node) reopen(virtAddress string) {
+	n.openTunnel(virtAddress)
+}
+
+// relay sends the packet to the peer via the relay server selected for the
+// peer, or via the gateway if no relay available
+func (n *Node) relay(virtAddress string, data []byte) {
+	relay := &message.CtrlRelay{
+		VirtAddress: virtAddress,
+		Source:      n.address,
+		Data:        data,
+		Nonce:       api.NewNonce(),
+		Timestamp:   time.Now().UnixNano(),
+	}
+	relay.Signature = api.Sign(n.opt.Key, relay.Nonce, api.RelayFields(relay)...)
+	packet := codec.Encode(message.PacketType_Relay, relay)
+	relayed, err := n.writeRelay(virtAddress, packet)
+	if !relayed {
+		err = n.writeGateway(packet)
+	}
+	if err != nil {
+		zap.L().Error("Relay packet failed", zap.String("peer", virtAddress), zap.Error(err))
+	}
 }
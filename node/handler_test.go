@@ -0,0 +1,62 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+)
+
+func TestVerifyHeartbeatAck(t *testing.T) {
+	n := &Node{address: "10.0.0.1", opt: Options{Key: "test key"}}
+	n.rememberHeartbeat("sent", time.Now().UnixNano())
+
+	ack := func(to, heartbeatNonce string, code message.StatusCode) *message.CtrlHeartbeatAck {
+		ack := &message.CtrlHeartbeatAck{
+			Code:           code,
+			VirtAddress:    to,
+			Timestamp:      time.Now().UnixNano(),
+			Nonce:          api.NewNonce(),
+			HeartbeatNonce: heartbeatNonce,
+		}
+		ack.Signature = api.Sign(n.opt.Key, ack.Nonce, api.HeartbeatAckFields(ack)...)
+		return ack
+	}
+
+	// The error answering the heartbeat spoofed by others must not be accepted
+	if err := n.verifyHeartbeatAck(ack("10.0.0.1", "spoofed", message.StatusCode_AddConflicted)); err == nil {
+		t.Error("ack of the heartbeat not sent accepted")
+	}
+	if err := n.verifyHeartbeatAck(ack("10.0.0.2", "sent", message.StatusCode_Success)); err == nil {
+		t.Error("ack sent to another node accepted")
+	}
+	tampered := ack("10.0.0.1", "spoofed", message.StatusCode_AddConflicted)
+	tampered.HeartbeatNonce = "sent"
+	if err := n.verifyHeartbeatAck(tampered); err == nil {
+		t.Error("ack with the tampered heartbeat nonce accepted")
+	}
+	if err := n.verifyHeartbeatAck(ack("10.0.0.1", "sent", message.StatusCode_Success)); err != nil {
+		t.Errorf("ack of the heartbeat sent rejected: %v", err)
+	}
+
+	// The nonces are forgotten after NonceExpire
+	n.rememberHeartbeat("old", time.Now().Add(-constant.NonceExpire-time.Second).UnixNano())
+	if _, found := n.heartbeatNonces.Load("old"); found {
+		t.Error("expired heartbeat nonce remembered")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const identityPEMType = "PRIVATE KEY"
+
+// DefaultIdentityPath returns the default path of the node identity file
+func DefaultIdentityPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "zetamesh", "identity.pem")
+}
+
+// loadIdentity loads the Ed25519 identity of current node from the path and a
+// new identity will be generated and persisted if the file doesn't exist.
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateIdentity(path)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != identityPEMType {
+		return nil, errors.Errorf("malformed identity file %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "parse identity file %s", path)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("identity file %s is not an Ed25519 key", path)
+	}
+	return private, nil
+}
+
+func generateIdentity(path string) (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: identityPEMType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	zap.L().Info("Generate new identity", zap.String("path", path))
+	return private, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/lonng/zetamesh/node/portmap"
+	"go.uber.org/zap"
+)
+
+// mapPort maps the node port on the router and renews the mapping before it
+// expires, the mapping is deleted when the node exits.
+func (n *Node) mapPort(ctx context.Context) {
+	var (
+		port   = n.dialer.LocalAddr.(*net.UDPAddr).Port
+		client portmap.Client
+		timer  = time.After(0)
+	)
+	defer func() {
+		if client == nil {
+			return
+		}
+		unmapCtx, cancel := context.WithTimeout(context.Background(), constant.PortMappingTimeout)
+		defer cancel()
+		if err := client.Unmap(unmapCtx, port); err != nil {
+			zap.L().Debug("Delete port mapping failed", zap.String("protocol", client.Protocol()), zap.Error(err))
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer:
+		case <-n.remapTrigger:
+			// The router may be another one after the local network changed
+			client = nil
+		}
+
+		mapping, c, err := requestMapping(ctx, client, port)
+		if err != nil {
+			if client != nil {
+				zap.L().Warn("Renew port mapping failed", zap.String("protocol", client.Protocol()), zap.Error(err))
+			}
+			client = nil
+			n.mapping.Store((*portmap.Mapping)(nil))
+			timer = time.After(constant.PortMappingRetryInterval)
+			continue
+		}
+		if client == nil {
+			zap.L().Info("Map port successfully", zap.String("protocol", mapping.Protocol),
+				zap.Stringer("external", mapping.External), zap.Duration("lifetime", mapping.Lifetime))
+		}
+		client = c
+		n.mapping.Store(mapping)
+
+		renew := mapping.Lifetime / 2
+		if renew < time.Minute {
+			renew = time.Minute
+		}
+		timer = time.After(renew)
+	}
+}
+
+// requestMapping requests the mapping with the client, and tries the clients
+// of all protocols if the client is nil
+func requestMapping(ctx context.Context, client portmap.Client, port int) (*portmap.Mapping, portmap.Client, error) {
+	clients := []portmap.Client{client}
+	if client == nil {
+		clients = portmap.Clients()
+	}
+	err := portmap.ErrUnsupported
+	for _, c := range clients {
+		reqCtx, cancel := context.WithTimeout(ctx, constant.PortMappingTimeout)
+		var mapping *portmap.Mapping
+		mapping, err = c.Map(reqCtx, port, constant.PortMappingLifetime)
+		cancel()
+		if err == nil {
+			return mapping, c, nil
+		}
+		zap.L().Debug("Request port mapping failed", zap.String("protocol", c.Protocol()), zap.Error(err))
+	}
+	return nil, nil, err
+}
+
+// portMapping returns the current port mapping, nil if no mapping
+func (n *Node) portMapping() *portmap.Mapping {
+	mapping, _ := n.mapping.Load().(*portmap.Mapping)
+	return mapping
+}
+
+// mappedCandidates returns the candidate of the port mapping, the mapping
+// behind another NAT is excluded because it's unreachable for the peers.
+func (n *Node) mappedCandidates() []*message.Candidate {
+	mapping := n.portMapping()
+	if mapping == nil || !mapping.Routable() {
+		return nil
+	}
+	return []*message.Candidate{{
+		Address:  mapping.External.String(),
+		Type:     message.CandidateType_Mapped,
+		Priority: api.CandidatePriority(message.CandidateType_Mapped, 0xffff),
+	}}
+}
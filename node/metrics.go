@@ -0,0 +1,148 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	metricsNamespace = "zetamesh"
+	metricsSubsystem = "node"
+)
+
+// Node metrics
+var (
+	tunPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tun_packets_total",
+		Help:      "The total count of packets read from or written into the virtual network interface.",
+	}, []string{"direction"})
+
+	tunBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tun_bytes_total",
+		Help:      "The total bytes read from or written into the virtual network interface.",
+	}, []string{"direction"})
+
+	tunnelEstablish = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tunnel_establish_total",
+		Help:      "The total count of tunnel establishments by result.",
+	}, []string{"result"})
+
+	tunnelEstablishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tunnel_establish_duration_seconds",
+		Help:      "The duration from the tunnel opened to the direct path established.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12), // 10ms ~ 20s
+	})
+
+	pathTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "path_transitions_total",
+		Help:      "The total count of connection state transitions by the new state.",
+	}, []string{"state"})
+
+	heartbeatFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "heartbeat_failures_total",
+		Help:      "The total count of heartbeats failed to send to the gateway.",
+	})
+
+	peerBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "peer_bytes_total",
+		Help:      "The total bytes of raw IP packets sent to or received from the peers by path.",
+	}, []string{"direction", "path"})
+)
+
+// connectionCollector collects the count of connections by state when scraped
+type connectionCollector struct {
+	node        *Node
+	connections *prometheus.Desc
+}
+
+// Describe implements the prometheus.Collector interface
+func (c *connectionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+}
+
+// Collect implements the prometheus.Collector interface
+func (c *connectionCollector) Collect(ch chan<- prometheus.Metric) {
+	states := map[connectionState]int{
+		StateProbing: 0,
+		StateDirect:  0,
+		StateRelayed: 0,
+		StateFailed:  0,
+	}
+	c.node.connections.Range(func(_, value interface{}) bool {
+		states[value.(*connection).currentState()]++
+		return true
+	})
+	for state, count := range states {
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(count), state.String())
+	}
+}
+
+// serveMetrics registers the node metrics and serves them on the address
+func (n *Node) serveMetrics(ctx context.Context, addr string) error {
+	collectors := []prometheus.Collector{
+		&connectionCollector{
+			node: n,
+			connections: prometheus.NewDesc(
+				prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "connections"),
+				"The count of connections to the peers by state.", []string{"state"}, nil),
+		},
+		tunPackets,
+		tunBytes,
+		tunnelEstablish,
+		tunnelEstablishDuration,
+		pathTransitions,
+		heartbeatFailures,
+		peerBytes,
+	}
+	for _, collector := range collectors {
+		if err := prometheus.Register(collector); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	zap.L().Info("Serve metrics", zap.String("address", addr))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.WithStack(err)
+	}
+	return nil
+}
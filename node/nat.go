@@ -0,0 +1,175 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lonng/zetamesh/codec"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// natResult represents the NAT behavior detected by the binding requests
+type natResult struct {
+	typ    message.NATType
+	mapped string // The address mapped by the NAT and observed by the gateway
+}
+
+// natStatus returns the latest NAT detection result
+func (n *Node) natStatus() *natResult {
+	if result, ok := n.nat.Load().(*natResult); ok {
+		return result
+	}
+	return &natResult{typ: message.NATType_NATUnknown}
+}
+
+// detectNAT classifies the NAT behavior and the result will be reported to
+// the gateway by the following heartbeats
+func (n *Node) detectNAT() {
+	if n.detecting.Swap(true) {
+		return
+	}
+	defer n.detecting.Store(false)
+
+	typ, mapped := n.classifyNAT()
+	n.nat.Store(&natResult{typ: typ, mapped: mapped})
+	zap.L().Info("Detect NAT type", zap.Stringer("type", typ), zap.String("mapped", mapped))
+}
+
+// redetectNAT forgets the address mapped by the NAT and detects it again, so
+// the heartbeats are not signed for the stale address until detected
+func (n *Node) redetectNAT() {
+	nat := n.natStatus()
+	if nat.mapped == "" {
+		return
+	}
+	zap.L().Info("Heartbeat unanswered, detect NAT again", zap.String("mapped", nat.mapped))
+	n.nat.Store(&natResult{typ: nat.typ})
+	go n.detectNAT()
+}
+
+// classifyNAT tests the NAT behavior as RFC 5780 with the primary and secondary
+// ports of the gateway. There is no NAT if the mapped address equals to the local
+// address. The NAT filters the packets by the remote port if the binding answered
+// from the secondary port is lost, and the NAT is symmetric if the addresses
+// mapped for the primary and secondary ports are different.
+func (n *Node) classifyNAT() (message.NATType, string) {
+	primary := n.gatewayConn()
+	first, err := n.binding(primary, false)
+	if err != nil {
+		zap.L().Warn("Binding request failed", zap.Error(err))
+		return message.NATType_NATUnknown, ""
+	}
+	mapped := first.MappedAddress
+	if mapped == primary.LocalAddr().String() {
+		return message.NATType_NATOpen, mapped
+	}
+
+	port := n.bindingPort.Load()
+	if port == 0 {
+		zap.L().Info("Binding port is disabled by the gateway")
+		return message.NATType_NATUnknown, mapped
+	}
+	gateway := primary.RemoteAddr().(*net.UDPAddr)
+	conn, err := n.dialer.Dial("udp", net.JoinHostPort(gateway.IP.String(), strconv.Itoa(int(port))))
+	if err != nil {
+		zap.L().Warn("Dial binding port failed", zap.Error(err))
+		return message.NATType_NATUnknown, mapped
+	}
+	defer conn.Close()
+	go n.readBinding(conn)
+
+	// The filtering must be tested before sending anything to the secondary
+	// port, which opens the NAT filter for the secondary port
+	_, err = n.binding(primary, true)
+	filtered := err != nil
+
+	second, err := n.binding(conn, false)
+	if err != nil {
+		zap.L().Warn("Binding request to the secondary port failed", zap.Error(err))
+		return message.NATType_NATUnknown, mapped
+	}
+	switch {
+	case second.MappedAddress != mapped:
+		return message.NATType_NATSymmetric, mapped
+	case filtered:
+		return message.NATType_NATPortRestricted, mapped
+	default:
+		return message.NATType_NATEndpointIndependent, mapped
+	}
+}
+
+// binding sends the binding request via the connection and waits the response,
+// which may be answered from another port if the changePort specified.
+func (n *Node) binding(conn net.Conn, changePort bool) (*message.CtrlBindingAck, error) {
+	id := n.bindingID.Inc()
+	ch := make(chan *message.CtrlBindingAck, 1)
+	n.bindings.Store(id, ch)
+	defer n.bindings.Delete(id)
+
+	data := codec.Encode(message.PacketType_Binding, &message.CtrlBinding{
+		TransactionId: id,
+		ChangePort:    changePort,
+		Padding:       make([]byte, constant.BindingPadding),
+	})
+	for i := 0; i < constant.BindingRetries; i++ {
+		if _, err := conn.Write(data); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		select {
+		case ack := <-ch:
+			return ack, nil
+		case <-time.After(constant.BindingTimeout):
+		}
+	}
+	return nil, errors.Errorf("binding request to %s timeout", conn.RemoteAddr())
+}
+
+// readBinding reads the binding responses until the connection closed
+func (n *Node) readBinding(conn net.Conn) {
+	buffer := make([]byte, constant.MaxBufferSize)
+	for {
+		c, err := conn.Read(buffer)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if c < 1 || message.PacketType(buffer[0]) != message.PacketType_BindingAck {
+			continue
+		}
+		ack := &message.CtrlBindingAck{}
+		if err := proto.Unmarshal(buffer[1:c], ack); err != nil {
+			continue
+		}
+		n.onBindingAck(ack)
+	}
+}
+
+func (n *Node) onBindingAck(ack *message.CtrlBindingAck) {
+	if ch, found := n.bindings.Load(ack.TransactionId); found {
+		select {
+		case ch.(chan *message.CtrlBindingAck) <- ack:
+		default:
+		}
+	}
+}
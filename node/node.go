@@ -15,56 +15,147 @@ package node
 
 import (
 	"context"
+	"crypto/ed25519"
 	"net"
 	"sync"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/libp2p/go-reuseport"
 	"github.com/lonng/zetamesh/api"
 	"github.com/lonng/zetamesh/codec"
 	"github.com/lonng/zetamesh/constant"
 	"github.com/lonng/zetamesh/message"
 	"github.com/lonng/zetamesh/node/tun"
+	"github.com/lonng/zetamesh/version"
 	"github.com/pkg/errors"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
-var subnetMask = []byte{0xff, 0xff, 0, 0}
-
 // Options represents the CLI arguments of the Zetamesh peer node
 type Options struct {
-	Gateway string
-	Key     string
-	Address string
-	TLS     bool
+	Gateway  string
+	Key      string
+	Address  []string
+	TLS      bool
+	Identity string
+	Control  string // The path of control socket, the control API is disabled if not specified
+	Metrics  string // The listen address of the metrics, the metrics are disabled if not specified
+
+	PortMapping bool // Map the node port on the router with PCP, NAT-PMP or UPnP
 }
 
 // Node represents a local peer node of ZetaMesh
 type Node struct {
 	opt       Options
 	apiClient *api.Client
+	identity  ed25519.PrivateKey
 	dialer    *net.Dialer
-	gateway   *net.UDPConn
+	gateway   atomic.Value // *net.UDPConn, which is replaced after the node rebinds
+	listener  *net.UDPConn // The unconnected socket of the node port to receive from unknown addresses
 	pipeline  chan []byte
 
-	mask        net.IP   // Only packet sent to the same subnet will be handled
-	pending     sync.Map // virtAddr -> time.Time
-	connections sync.Map // virtAddr -> connection
+	address     string            // The primary virtual address of current node
+	addresses   []*virtualAddress // Only packet sent to the same subnets will be handled
+	pending     sync.Map          // virtAddr -> time.Time
+	connections sync.Map          // primary virtAddr -> connection
+	routes      sync.Map          // virtAddr -> primary virtAddr of the peer
+	buffersMu   sync.Mutex
+	buffers     map[string]*packetQueue // primary virtAddr -> *packetQueue
+
+	registerOnce    sync.Once
+	registered      chan struct{} // Closed after the gateway accepted the first heartbeat
+	failure         chan error    // The fatal error which makes the node exit
+	gatewayNetworks []string      // The virtual network CIDRs defined by the gateway
+
+	lastHeartbeatAck atomic.Int64 // The unix nano of last heartbeat answered by the gateway
+	lastUDPAck       atomic.Int64 // The unix nano of last heartbeat answered via UDP
+	lastAckTimestamp atomic.Int64 // The gateway timestamp of the last accepted heartbeat ack
+	heartbeatNonces  sync.Map     // The nonce of the recent heartbeat -> the unix nano sent
+	heartbeatTrigger chan struct{}
+	stream           atomic.Value // *api.Stream, the fallback transport if UDP is blocked
+	gatewayLost      atomic.Bool  // No heartbeat answered for GatewayLostTimeout
+	rebindTrigger    chan struct{}
+	stopped          atomic.Bool // The gateway socket is closed by Stop and never rebound
+	remapTrigger     chan struct{}
+
+	peerCounters sync.Map      // primary virtAddr -> *peerCounters, which is removed with the connection
+	unroutable   atomic.Uint64 // The count of packets to the destination out of the virtual networks
+	unreachable  atomic.Uint64 // The count of packets dropped to the peers without connection
+
+	nat         atomic.Value  // *natResult
+	detecting   atomic.Bool   // The NAT detection is running
+	bindingPort atomic.Uint32 // The secondary binding port of the gateway
+	bindingID   atomic.Int64
+	bindings    sync.Map // transaction id -> chan *message.CtrlBindingAck
+
+	mapping atomic.Value // *portmap.Mapping
+
+	relays     sync.Map     // address -> *relayClient
+	relayToken atomic.Value // *relayToken
+
+	control           atomic.Value // *api.ControlStream, nil if disconnected
+	controlRegistered atomic.Int64 // The unix nano of the last registration of the control stream
+	controlSocket     atomic.Bool  // The control stream was connected via the WebSocket last time
 }
 
 // New returns a new instance of local peer node
 func New(opt Options) *Node {
 	return &Node{
-		opt:       opt,
-		apiClient: api.NewClient(opt.Gateway, opt.Key, opt.TLS),
-		pipeline:  make(chan []byte, 512),
+		opt:        opt,
+		apiClient:  api.NewClient(opt.Gateway, opt.Key, opt.TLS),
+		pipeline:   make(chan []byte, 512),
+		buffers:    map[string]*packetQueue{},
+		registered: make(chan struct{}),
+		failure:    make(chan error, 1),
+
+		heartbeatTrigger: make(chan struct{}, 1),
+		rebindTrigger:    make(chan struct{}, 1),
+		remapTrigger:     make(chan struct{}, 1),
 	}
 }
 
 // Serve starts the local peer and connect to the matcher
 func (n *Node) Serve() error {
+	identityPath := n.opt.Identity
+	if identityPath == "" {
+		identityPath = DefaultIdentityPath()
+	}
+	identity, err := loadIdentity(identityPath)
+	if err != nil {
+		return errors.WithMessage(err, "load identity failed")
+	}
+	n.identity = identity
+
+	// The address can be specified in CIDR form to override the network prefix
+	for _, addr := range n.opt.Address {
+		address, err := parseAddress(addr)
+		if err != nil {
+			return err
+		}
+		n.addresses = append(n.addresses, address)
+	}
+
+	// Request the gateway to allocate addresses if not specified
+	if len(n.addresses) == 0 {
+		lease, err := n.apiClient.Lease(identity)
+		if err != nil {
+			return err
+		}
+		for _, addr := range lease.Addresses {
+			address, err := parseAddress(addr)
+			if err != nil || address.network == nil {
+				return errors.Errorf("invalid address %s leased by gateway", addr)
+			}
+			n.addresses = append(n.addresses, address)
+		}
+		if len(n.addresses) == 0 {
+			return errors.New("no address leased by gateway")
+		}
+		zap.L().Info("Lease address successfully", zap.Strings("addresses", lease.Addresses))
+	}
+	n.address = n.addresses[0].ip.String()
+
 	// Random select a free port to serve the current node
 	port, err := func() (int, error) {
 		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
@@ -83,9 +174,6 @@ func (n *Node) Serve() error {
 		Control:   reuseport.Control,
 	}
 
-	// Initialize the subnet mask
-	n.mask = net.ParseIP(n.opt.Address).Mask([]byte{0xff, 0xff, 0, 0})
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -94,12 +182,86 @@ func (n *Node) Serve() error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	n.gateway = conn.(*net.UDPConn)
+	n.gateway.Store(conn.(*net.UDPConn))
+
+	// The packets from the dialed addresses are delivered to the connected
+	// sockets, and the others are delivered to the listener
+	lc := net.ListenConfig{Control: reuseport.Control}
+	listener, err := lc.ListenPacket(ctx, "udp", n.dialer.LocalAddr.String())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	n.listener = listener.(*net.UDPConn)
 
 	zap.L().Info("Setup local address successfully", zap.Stringer("local", conn.LocalAddr()))
 
+	// Begin schedule all UDP messages
+	scheduled := make(chan error, 1)
+	go func() {
+		scheduled <- n.schedule(ctx)
+	}()
+
+	go n.serveListener(ctx)
+
+	// Begin forward heartbeat message eventually
+	go n.heartbeat(ctx)
+
+	// Fallback to the stream if the UDP is blocked
+	go n.keepTransport(ctx)
+
+	// Keep the bindings of the relay servers advertised by the gateway
+	go n.keepRelays(ctx)
+
+	// Rebind the sockets if the local network changed or the gateway lost
+	go n.keepGateway(ctx)
+
+	// Keep the control stream which carries the tunnel requests
+	go n.keepControl(ctx)
+
+	// Serve the control API for the local commands
+	if n.opt.Control != "" {
+		go func() {
+			if err := n.serveControl(ctx, n.opt.Control); err != nil {
+				zap.L().Warn("Serve control API failed", zap.Error(err))
+			}
+		}()
+	}
+
+	// Serve the Prometheus metrics
+	if n.opt.Metrics != "" {
+		go func() {
+			if err := n.serveMetrics(ctx, n.opt.Metrics); err != nil {
+				zap.L().Warn("Serve metrics failed", zap.Error(err))
+			}
+		}()
+	}
+
+	// Wait the gateway accepting current peer before setting up the virtual network
+	// interface, because the address may be conflicted with other peers. The
+	// stream fallback is tried if no response via UDP after RegisterTimeout, and
+	// the peer is registered via the stream in background.
+	select {
+	case <-n.registered:
+	case err := <-n.failure:
+		return err
+	case <-time.After(constant.RegisterTimeout):
+		zap.L().Warn("No heartbeat response from the gateway, continue without confirmation")
+	}
+	go n.detectNAT()
+	if n.opt.PortMapping {
+		go n.mapPort(ctx)
+	}
+
+	if err := n.setupNetwork(); err != nil {
+		return err
+	}
+
 	// Setup virtual network interface tunnel
-	dev, err := tun.NewTUN(n.opt.Address)
+	addresses := make([]*net.IPNet, 0, len(n.addresses))
+	for _, addr := range n.addresses {
+		addresses = append(addresses, addr.ipNet())
+	}
+	dev, err := tun.NewTUN(addresses)
 	if err != nil {
 		return err
 	}
@@ -110,17 +272,27 @@ func (n *Node) Serve() error {
 	// Begin virtual network interface traffic handling
 	go n.serveDev(ctx, dev)
 
-	// Begin forward heartbeat message eventually
-	go n.heartbeat(ctx)
+	select {
+	case err := <-scheduled:
+		return err
+	case err := <-n.failure:
+		return err
+	}
+}
 
-	// Begin schedule all UDP messages
-	return n.schedule(ctx)
+// fail makes the node exit with the fatal error
+func (n *Node) fail(err error) {
+	select {
+	case n.failure <- err:
+	default:
+	}
 }
 
 // Stop stops the local peer and disconnect to the matcher
 func (n *Node) Stop() {
-	if n.gateway != nil {
-		_ = n.gateway.Close()
+	n.stopped.Store(true)
+	if conn := n.gatewayConn(); conn != nil {
+		_ = conn.Close()
 	}
 }
 
@@ -138,27 +310,28 @@ func (n *Node) serveDev(ctx context.Context, dev tun.Device) {
 				if err != nil {
 					continue
 				}
-				packet := gopacket.NewPacket(buffer[:c], layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-				ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-				if !ok {
-					continue
-				}
-
-				// Skip the packet because it has different subnet
-				if !ipv4.DstIP.Mask(subnetMask).Equal(n.mask) {
+				tunPackets.WithLabelValues("read").Inc()
+				tunBytes.WithLabelValues("read").Add(float64(c))
+				dst := destination(buffer[:c])
+				if dst == nil {
 					continue
 				}
 
 				// Write pipeline back if the destination is the current virtual address
-				destination := ipv4.DstIP.String()
-				if destination == n.opt.Address {
+				if n.isLocal(dst) {
 					dataCopy := make([]byte, c)
 					copy(dataCopy, buffer[:c])
 					n.pipeline <- dataCopy
 					continue
 				}
 
-				n.forward(destination, buffer[:c])
+				// Skip the packet because it has different subnet
+				if !n.routable(dst) {
+					n.unroutable.Inc()
+					continue
+				}
+
+				n.forward(dst.String(), buffer[:c])
 			}
 		}
 	}
@@ -174,7 +347,10 @@ func (n *Node) serveDev(ctx context.Context, dev tun.Device) {
 				_, err := dev.Write(data)
 				if err != nil {
 					zap.L().Error("Write data into virtual device failed", zap.Error(err))
+					continue
 				}
+				tunPackets.WithLabelValues("write").Inc()
+				tunBytes.WithLabelValues("write").Add(float64(len(data)))
 			}
 		}
 	}
@@ -186,31 +362,60 @@ func (n *Node) serveDev(ctx context.Context, dev tun.Device) {
 func (n *Node) forward(virtAddress string, data []byte) {
 	zap.L().Debug("Send packet", zap.String("peer", virtAddress))
 
-	// Open a new tunnel if cannot find the connection between the peers
+	// The connection is indexed by the primary address of the peer
+	if primary, found := n.routes.Load(virtAddress); found {
+		virtAddress = primary.(string)
+	}
+
 	conn, found := n.connections.Load(virtAddress)
-	if found {
-		conn := conn.(*connection)
-		if conn.state == StateEstablished {
-			// We must make a copy of the data
-			dataCopy := make([]byte, len(data))
-			copy(dataCopy, data)
+	if found && conn.(*connection).currentSession() != nil {
+		n.send(conn.(*connection), data)
+		return
+	}
 
-			select {
-			case conn.pipeline <- codec.EncodeRaw(dataCopy):
-			default:
-				zap.L().Warn("Drop data due to channel full", zap.Reflect("peer", virtAddress))
-			}
-		} else {
-			_, _ = n.gateway.Write(codec.Encode(message.PacketType_Relay, &message.CtrlRelay{
-				VirtAddress: virtAddress,
-				Data:        data,
-			}))
-			zap.L().Debug("Relay data due to connection not ready", zap.Stringer("state", conn.state), zap.Int("length", len(data)))
-		}
+	// Buffer the packet until the session established and open a new tunnel
+	// if cannot find the connection between the peers
+	n.buffer(virtAddress, data)
+	if !found {
+		n.openTunnel(virtAddress)
+		return
+	}
+	// The session may be established after checked above and the buffered
+	// packets have been flushed before the packet buffered
+	if conn.(*connection).currentSession() != nil {
+		n.flush(conn.(*connection))
+	}
+}
 
+// send encrypts the packet and sends it via the direct path if established,
+// otherwise via the gateway relay
+func (n *Node) send(conn *connection, data []byte) {
+	counters := conn.counters
+	sealed, err := conn.seal(data)
+	if err != nil {
+		counters.drop(dropNoTunnel)
+		zap.L().Debug("Drop data due to session not ready", zap.String("peer", conn.peerVirtAddr), zap.Error(err))
+		return
+	}
+	if conn.currentState() == StateDirect {
+		select {
+		case conn.pipeline <- sealed:
+			counters.sent(false, len(data))
+		default:
+			counters.drop(dropChannelFull)
+			zap.L().Warn("Drop data due to channel full", zap.String("peer", conn.peerVirtAddr))
+		}
 		return
 	}
 
+	n.relay(conn.peerVirtAddr, sealed)
+	counters.sent(true, len(data))
+	zap.L().Debug("Relay data due to connection not ready", zap.Stringer("state", conn.currentState()), zap.Int("length", len(sealed)))
+}
+
+// openTunnel requests the gateway to open the tunnel to the peer via the control
+// stream, the request is throttled if there is a pending request of the peer.
+func (n *Node) openTunnel(virtAddress string) {
 	// The connection is trying to establish
 	pending, found := n.pending.Load(virtAddress)
 	if found && pending.(time.Time).Add(time.Second).After(time.Now()) {
@@ -221,35 +426,100 @@ func (n *Node) forward(virtAddress string, data []byte) {
 
 	n.pending.Store(virtAddress, time.Now())
 	go func() {
-		defer n.pending.Delete(virtAddress)
-		err := n.apiClient.OpenTunnel(n.opt.Address, virtAddress)
+		err := n.requestTunnel(virtAddress)
+		if e, ok := errors.Cause(err).(*api.Error); ok && e.Code == message.StatusCode_PeerOffline {
+			// Keep the pending state to avoid requesting the gateway for every packet
+			zap.L().Info("Peer is offline", zap.String("peer", virtAddress))
+			n.pending.Store(virtAddress, time.Now().Add(constant.OfflineRetryDuration))
+			n.discard(virtAddress)
+			return
+		}
+		n.pending.Delete(virtAddress)
 		if err != nil {
+			tunnelEstablish.WithLabelValues("failure").Inc()
 			zap.L().Error("Try to establish connection failed", zap.Error(err), zap.String("peer", virtAddress))
 		}
 	}()
 }
 
-// heartbeat keeps alive with the gateway and forward UDP heartbeat to
-// the gateway every `HeartbeatInterval` seconds
+// heartbeat keeps alive with the gateway and forward heartbeat to the
+// gateway every `HeartbeatInterval` seconds via UDP or the stream
 func (n *Node) heartbeat(ctx context.Context) {
-	data := codec.Encode(message.PacketType_Heartbeat, &message.CtrlHeartbeat{
-		VirtAddress: n.opt.Address,
-	})
-
-	timer := time.After(0)
+	var (
+		timer = time.After(0)
+		sent  int64 // The unix nano of the previous heartbeat
+	)
 	for {
 		select {
 		case <-ctx.Done():
 			zap.L().Info("UDP heartbeat cancelled", zap.Error(ctx.Err()))
 			return
 
+		case <-n.heartbeatTrigger:
 		case <-timer:
-			timer = time.After(time.Second * constant.HeartbeatInterval)
-			_, err := n.gateway.Write(data)
-			if err != nil {
-				zap.L().Error("Send heartbeat failed", zap.Error(err))
-				continue
-			}
 		}
+
+		// Retry sooner if the previous heartbeat is unanswered, e.g: the gateway
+		// is restarting, so the node is registered again once it is back
+		interval := time.Second * constant.HeartbeatInterval
+		if sent > 0 && n.lastHeartbeatAck.Load() < sent {
+			interval = constant.HeartbeatRetryInterval
+			// The NAT may map the gateway socket to another address, and the
+			// heartbeats signed for the previous address are dropped
+			n.redetectNAT()
+		}
+		timer = time.After(interval)
+		sent = time.Now().UnixNano()
+		heartbeat := n.heartbeatMessage()
+		n.rememberHeartbeat(heartbeat.Nonce, sent)
+		data := codec.Encode(message.PacketType_Heartbeat, heartbeat)
+		if err := n.writeGateway(data); err != nil {
+			heartbeatFailures.Inc()
+			zap.L().Error("Send heartbeat failed", zap.Error(err))
+		}
+	}
+}
+
+// rememberHeartbeat remembers the nonce of the heartbeat sent, which must be
+// echoed by the heartbeat ack, and forgets the nonces older than NonceExpire
+func (n *Node) rememberHeartbeat(nonce string, sent int64) {
+	n.heartbeatNonces.Store(nonce, sent)
+	n.heartbeatNonces.Range(func(key, value interface{}) bool {
+		if time.Since(time.Unix(0, value.(int64))) > constant.NonceExpire {
+			n.heartbeatNonces.Delete(key)
+		}
+		return true
+	})
+}
+
+// heartbeatMessage returns the heartbeat signed by the node, which is used to
+// register the control stream as well
+func (n *Node) heartbeatMessage() *message.CtrlHeartbeat {
+	nonce := api.NewNonce()
+	timestamp := time.Now().UnixNano()
+	addresses := make([]string, 0, len(n.addresses))
+	for _, addr := range n.addresses {
+		addresses = append(addresses, addr.ip.String())
+	}
+	hosts := n.gatherCandidates()
+	candidates := append(n.mappedCandidates(), hosts...)
+	if len(candidates) > api.MaxCandidates-1 {
+		candidates = candidates[:api.MaxCandidates-1]
+	}
+	nat := n.natStatus()
+	heartbeat := &message.CtrlHeartbeat{
+		VirtAddress:    n.address,
+		Nonce:          nonce,
+		PublicKey:      n.identity.Public().(ed25519.PublicKey),
+		Timestamp:      timestamp,
+		Addresses:      addresses,
+		Version:        version.NewVersion().String(),
+		Candidates:     candidates,
+		NatType:        nat.typ,
+		RelayLatencies: n.relayLatencies(),
+		Endpoint:       nat.mapped,
 	}
+	heartbeat.Proof = api.SignIdentity(n.identity, api.IdentityFields(heartbeat)...)
+	heartbeat.Signature = api.Sign(n.opt.Key, nonce, api.HeartbeatFields(heartbeat)...)
+	return heartbeat
 }
@@ -0,0 +1,69 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// nativeEndian is the byte order of the host
+var nativeEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Gateways returns the IPv4 default gateways of the routing table on Linux,
+// and the guessed gateways of the local networks on the other systems
+func Gateways() []net.IP {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return guessGateways()
+	}
+	defer file.Close()
+	return parseRoutes(file, nativeEndian)
+}
+
+// parseRoutes returns the default gateways of the routing table, whose
+// addresses are the hex of the integers in the host byte order
+func parseRoutes(r io.Reader, order binary.ByteOrder) []net.IP {
+	var gateways []net.IP
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ip := make(net.IP, 4)
+		order.PutUint32(ip, uint32(addr))
+		if !ip.IsUnspecified() {
+			gateways = append(gateways, ip)
+		}
+	}
+	return gateways
+}
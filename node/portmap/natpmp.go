@@ -0,0 +1,110 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The opcodes of NAT-PMP, the response opcode is the request one plus 128
+const (
+	natpmpOpExternalAddress = 0
+	natpmpOpMapUDP          = 1
+	natpmpResponse          = 128
+)
+
+type natpmp struct {
+	server *net.UDPAddr
+}
+
+// NewNATPMP returns the NAT-PMP client of the server
+func NewNATPMP(server *net.UDPAddr) Client {
+	return &natpmp{server: server}
+}
+
+// Protocol implements the Client interface
+func (c *natpmp) Protocol() string {
+	return "NAT-PMP"
+}
+
+// Map implements the Client interface
+func (c *natpmp) Map(ctx context.Context, port int, lifetime time.Duration) (*Mapping, error) {
+	ip, err := c.externalAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	external, granted, err := c.mapUDP(ctx, port, port, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol: c.Protocol(),
+		External: &net.UDPAddr{IP: ip, Port: external},
+		Lifetime: granted,
+	}, nil
+}
+
+// Unmap implements the Client interface
+func (c *natpmp) Unmap(ctx context.Context, port int) error {
+	_, _, err := c.mapUDP(ctx, port, 0, 0)
+	return err
+}
+
+// call sends the request of the opcode and returns the response whose result
+// code is checked
+func (c *natpmp) call(ctx context.Context, req []byte, size int) ([]byte, error) {
+	op := req[1]
+	res, err := request(ctx, c.server, req, func(res []byte) bool {
+		return len(res) >= size && res[0] == 0 && res[1] == op+natpmpResponse
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(res[2:4]); code != 0 {
+		return nil, errors.Errorf("NAT-PMP result code %d", code)
+	}
+	return res, nil
+}
+
+func (c *natpmp) externalAddress(ctx context.Context) (net.IP, error) {
+	res, err := c.call(ctx, []byte{0, natpmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), res[8:12]...)), nil
+}
+
+// mapUDP requests the mapping of the internal port, the mapping is deleted if
+// both the external port and the lifetime are zero
+func (c *natpmp) mapUDP(ctx context.Context, port, external int, lifetime time.Duration) (int, time.Duration, error) {
+	req := make([]byte, 12)
+	req[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(req[4:6], uint16(port))
+	binary.BigEndian.PutUint16(req[6:8], uint16(external))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	res, err := c.call(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if int(binary.BigEndian.Uint16(res[8:10])) != port {
+		return 0, 0, errors.New("NAT-PMP mapped unexpected internal port")
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second
+	return int(binary.BigEndian.Uint16(res[10:12])), granted, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// natpmpResponder answers the NAT-PMP requests with the result codes of the
+// external address and the mapping requests
+type natpmpResponder struct {
+	external    net.IP
+	port        int
+	addressCode uint16
+	mapCode     uint16
+	lifetimes   chan uint32
+}
+
+func (r *natpmpResponder) handle(req []byte) []byte {
+	if len(req) < 2 || req[0] != 0 {
+		return nil
+	}
+	switch req[1] {
+	case natpmpOpExternalAddress:
+		res := make([]byte, 12)
+		res[1] = natpmpOpExternalAddress + natpmpResponse
+		binary.BigEndian.PutUint16(res[2:4], r.addressCode)
+		copy(res[8:12], r.external.To4())
+		return res
+	case natpmpOpMapUDP:
+		if len(req) < 12 {
+			return nil
+		}
+		lifetime := binary.BigEndian.Uint32(req[8:12])
+		r.lifetimes <- lifetime
+		res := make([]byte, 16)
+		res[1] = natpmpOpMapUDP + natpmpResponse
+		binary.BigEndian.PutUint16(res[2:4], r.mapCode)
+		copy(res[8:10], req[4:6])
+		binary.BigEndian.PutUint16(res[10:12], uint16(r.port))
+		binary.BigEndian.PutUint32(res[12:16], lifetime)
+		return res
+	}
+	return nil
+}
+
+func TestNATPMPMap(t *testing.T) {
+	cases := []struct {
+		name        string
+		addressCode uint16
+		mapCode     uint16
+		err         bool
+	}{
+		{name: "mapped"},
+		{name: "external address refused", addressCode: 3, err: true},
+		{name: "mapping refused", mapCode: 4, err: true},
+	}
+	for _, c := range cases {
+		responder := &natpmpResponder{
+			external:    net.IPv4(203, 0, 113, 6),
+			port:        41000,
+			addressCode: c.addressCode,
+			mapCode:     c.mapCode,
+			lifetimes:   make(chan uint32, 16),
+		}
+		client := NewNATPMP(serveUDP(t, responder.handle))
+		mapping, err := client.Map(context.Background(), 2823, time.Hour)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got mapping %+v", c.name, mapping)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if lifetime := <-responder.lifetimes; lifetime != 3600 {
+			t.Errorf("%s: expected lifetime 3600 requested, got %d", c.name, lifetime)
+		}
+		if mapping.Protocol != "NAT-PMP" || mapping.External.String() != "203.0.113.6:41000" || mapping.Lifetime != time.Hour {
+			t.Errorf("%s: unexpected mapping %s %s %s", c.name, mapping.Protocol, mapping.External, mapping.Lifetime)
+		}
+
+		if err := client.Unmap(context.Background(), 2823); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if lifetime := <-responder.lifetimes; lifetime != 0 {
+			t.Errorf("%s: expected lifetime 0 requested to unmap, got %d", c.name, lifetime)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pcpVersion    = 2
+	pcpOpMap      = 1
+	pcpResponse   = 0x80
+	pcpProtoUDP   = 17
+	pcpHeaderSize = 24
+	pcpMapSize    = 36
+)
+
+type pcp struct {
+	server *net.UDPAddr
+	nonce  [12]byte // The mapping nonce which must be the same to renew the mapping
+}
+
+// NewPCP returns the PCP client of the server
+func NewPCP(server *net.UDPAddr) Client {
+	c := &pcp{server: server}
+	_, _ = rand.Read(c.nonce[:])
+	return c
+}
+
+// Protocol implements the Client interface
+func (c *pcp) Protocol() string {
+	return "PCP"
+}
+
+// Map implements the Client interface
+func (c *pcp) Map(ctx context.Context, port int, lifetime time.Duration) (*Mapping, error) {
+	return c.mapUDP(ctx, port, lifetime)
+}
+
+// Unmap implements the Client interface
+func (c *pcp) Unmap(ctx context.Context, port int) error {
+	_, err := c.mapUDP(ctx, port, 0)
+	return err
+}
+
+// mapUDP sends the MAP request of the internal port, and the mapping is
+// deleted if the lifetime is zero
+func (c *pcp) mapUDP(ctx context.Context, port int, lifetime time.Duration) (*Mapping, error) {
+	client, err := localIP(c.server)
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, pcpHeaderSize+pcpMapSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], client.To16())
+	copy(req[24:36], c.nonce[:])
+	req[36] = pcpProtoUDP
+	binary.BigEndian.PutUint16(req[40:42], uint16(port))
+	binary.BigEndian.PutUint16(req[42:44], uint16(port))
+	copy(req[44:60], net.IPv4zero.To16())
+
+	res, err := request(ctx, c.server, req, func(res []byte) bool {
+		// The NAT-PMP server answers the unsupported version with version 0
+		if len(res) >= 4 && res[0] == 0 {
+			return true
+		}
+		return len(res) >= pcpHeaderSize+pcpMapSize && res[0] == pcpVersion &&
+			res[1] == pcpOpMap|pcpResponse && bytes.Equal(res[24:36], c.nonce[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res[0] != pcpVersion {
+		return nil, ErrUnsupported
+	}
+	if code := res[3]; code != 0 {
+		return nil, errors.Errorf("PCP result code %d", code)
+	}
+	if int(binary.BigEndian.Uint16(res[40:42])) != port {
+		return nil, errors.New("PCP mapped unexpected internal port")
+	}
+	return &Mapping{
+		Protocol: c.Protocol(),
+		External: &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), res[44:60]...)).To4(),
+			Port: int(binary.BigEndian.Uint16(res[42:44])),
+		},
+		Lifetime: time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second,
+	}, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// pcpResponder answers the MAP requests with the result code, the mapping of
+// the internal port is mapped to the external address
+func pcpResponder(code byte, external *net.UDPAddr, lifetimes chan<- uint32) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		if len(req) < pcpHeaderSize+pcpMapSize || req[0] != pcpVersion || req[1] != pcpOpMap {
+			return nil
+		}
+		lifetime := binary.BigEndian.Uint32(req[4:8])
+		lifetimes <- lifetime
+
+		res := make([]byte, pcpHeaderSize+pcpMapSize)
+		res[0] = pcpVersion
+		res[1] = pcpOpMap | pcpResponse
+		res[3] = code
+		binary.BigEndian.PutUint32(res[4:8], lifetime)
+		copy(res[24:36], req[24:36])
+		res[36] = pcpProtoUDP
+		copy(res[40:42], req[40:42])
+		binary.BigEndian.PutUint16(res[42:44], uint16(external.Port))
+		copy(res[44:60], external.IP.To16())
+		return res
+	}
+}
+
+func TestPCPMap(t *testing.T) {
+	external := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 40000}
+	cases := []struct {
+		name    string
+		handler func(chan<- uint32) func(req []byte) []byte
+		err     bool
+	}{
+		{
+			name: "mapped",
+			handler: func(lifetimes chan<- uint32) func(req []byte) []byte {
+				return pcpResponder(0, external, lifetimes)
+			},
+		},
+		{
+			name: "result code",
+			handler: func(lifetimes chan<- uint32) func(req []byte) []byte {
+				return pcpResponder(2, external, lifetimes)
+			},
+			err: true,
+		},
+		{
+			name: "NAT-PMP server",
+			handler: func(lifetimes chan<- uint32) func(req []byte) []byte {
+				return func(req []byte) []byte {
+					lifetimes <- 0
+					return []byte{0, req[1] + natpmpResponse, 0, 1}
+				}
+			},
+			err: true,
+		},
+	}
+	for _, c := range cases {
+		lifetimes := make(chan uint32, 16)
+		client := NewPCP(serveUDP(t, c.handler(lifetimes)))
+		mapping, err := client.Map(context.Background(), 2823, time.Hour)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got mapping %+v", c.name, mapping)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if lifetime := <-lifetimes; lifetime != 3600 {
+			t.Errorf("%s: expected lifetime 3600 requested, got %d", c.name, lifetime)
+		}
+		if mapping.Protocol != "PCP" || mapping.External.String() != external.String() || mapping.Lifetime != time.Hour {
+			t.Errorf("%s: unexpected mapping %s %s %s", c.name, mapping.Protocol, mapping.External, mapping.Lifetime)
+		}
+
+		// The mapping is deleted by the MAP request of zero lifetime
+		if err := client.Unmap(context.Background(), 2823); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if lifetime := <-lifetimes; lifetime != 0 {
+			t.Errorf("%s: expected lifetime 0 requested to unmap, got %d", c.name, lifetime)
+		}
+	}
+}
+
+func TestPCPUnsupported(t *testing.T) {
+	// No response from the server
+	client := NewPCP(serveUDP(t, func([]byte) []byte { return nil }))
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := client.Map(ctx, 2823, time.Hour); err == nil {
+		t.Fatal("expected error without response")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package portmap maps the UDP port of the node on the home router with PCP
+// (RFC 6887), NAT-PMP (RFC 6886) or UPnP IGD, so the peers can reach the node
+// via the mapped address without hole punching.
+package portmap
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The well-known port of the PCP and NAT-PMP servers
+const serverPort = 5351
+
+// The retransmission of the PCP and NAT-PMP requests, the interval is doubled
+// after each retry as RFC 6886
+const (
+	initialTimeout = 250 * time.Millisecond
+	maxTries       = 3
+)
+
+// ErrUnsupported is returned if the router doesn't support the protocol
+var ErrUnsupported = errors.New("port mapping unsupported")
+
+// Mapping represents the UDP port mapping created on the router
+type Mapping struct {
+	Protocol string        // The protocol which creates the mapping
+	External *net.UDPAddr  // The external address of the mapping
+	Lifetime time.Duration // Zero means the mapping is permanent
+}
+
+// Client creates the UDP port mappings on the router with a protocol
+type Client interface {
+	// Protocol returns the name of the protocol
+	Protocol() string
+	// Map creates or renews the mapping of the internal port
+	Map(ctx context.Context, port int, lifetime time.Duration) (*Mapping, error)
+	// Unmap deletes the mapping of the internal port
+	Unmap(ctx context.Context, port int) error
+}
+
+// Clients returns the clients of all protocols in preference order, the PCP
+// and NAT-PMP requests are sent to the default gateways.
+func Clients() []Client {
+	var clients []Client
+	gateways := Gateways()
+	for _, gw := range gateways {
+		clients = append(clients, NewPCP(&net.UDPAddr{IP: gw, Port: serverPort}))
+	}
+	for _, gw := range gateways {
+		clients = append(clients, NewNATPMP(&net.UDPAddr{IP: gw, Port: serverPort}))
+	}
+	return append(clients, NewUPnP(ssdpAddress))
+}
+
+// request sends the request to the server and returns the first response
+// accepted by the function, the request is retransmitted if timeout.
+func request(ctx context.Context, server *net.UDPAddr, req []byte, accept func(res []byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, server)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, 1100)
+	timeout := initialTimeout
+	for i := 0; i < maxTries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		_ = conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				// The ICMP port unreachable means no server listening
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					return nil, ErrUnsupported
+				}
+				break
+			}
+			if accept(buffer[:n]) {
+				return buffer[:n], nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		timeout *= 2
+	}
+	return nil, ErrUnsupported
+}
+
+// localIP returns the local IP used to reach the address
+func localIP(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Routable reports whether the external IP of the mapping is reachable from
+// the Internet, the mapping is useless behind another NAT (e.g: CGNAT).
+func (m *Mapping) Routable() bool {
+	ip := m.External.IP.To4()
+	return ip != nil && ip.IsGlobalUnicast() && !isPrivate(ip)
+}
+
+// isPrivate reports whether the IPv4 address is private or shared (RFC 6598)
+func isPrivate(ip net.IP) bool {
+	return ip[0] == 10 ||
+		ip[0] == 172 && ip[1]&0xf0 == 16 ||
+		ip[0] == 192 && ip[1] == 168 ||
+		ip[0] == 100 && ip[1]&0xc0 == 64
+}
+
+// guessGateways returns the first host of the private IPv4 networks of the
+// local interfaces, which is the address of most home routers
+func guessGateways() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var gateways []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || !isPrivate(ip) {
+			continue
+		}
+		gateway := ip.Mask(ipNet.Mask)
+		gateway[3]++
+		if !gateway.Equal(ip) {
+			gateways = append(gateways, gateway)
+		}
+	}
+	return gateways
+}
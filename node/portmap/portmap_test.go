@@ -0,0 +1,91 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serveUDP starts a fake server on the loopback which answers the requests
+// with the handler, no response is sent if the handler returns nil.
+func serveUDP(t *testing.T, handler func(req []byte) []byte) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, remote, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if res := handler(append([]byte(nil), buffer[:n]...)); res != nil {
+				_, _ = conn.WriteToUDP(res, remote)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestParseRoutes(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	cases := []struct {
+		name     string
+		routes   string
+		order    binary.ByteOrder
+		expected []net.IP
+	}{
+		{
+			name:     "little endian",
+			routes:   header + "eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			order:    binary.LittleEndian,
+			expected: []net.IP{{192, 168, 1, 1}},
+		},
+		{
+			name:     "big endian",
+			routes:   header + "eth0\t00000000\tC0A80101\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			order:    binary.BigEndian,
+			expected: []net.IP{{192, 168, 1, 1}},
+		},
+		{
+			name: "multiple default routes",
+			routes: header +
+				"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+				"wlan0\t00000000\t0100000A\t0003\t0\t0\t600\t00000000\t0\t0\t0\n",
+			order:    binary.LittleEndian,
+			expected: []net.IP{{192, 168, 1, 1}, {10, 0, 0, 1}},
+		},
+		{
+			name: "non-default and on-link routes",
+			routes: header +
+				"eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n" +
+				"eth0\t00000000\t00000000\t0001\t0\t0\t100\t00000000\t0\t0\t0\n" +
+				"eth0\t00000000\tZZZZZZZZ\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			order: binary.LittleEndian,
+		},
+	}
+	for _, c := range cases {
+		gateways := parseRoutes(strings.NewReader(c.routes), c.order)
+		if !reflect.DeepEqual(gateways, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, gateways)
+		}
+	}
+}
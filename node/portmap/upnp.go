@@ -0,0 +1,329 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The multicast address of the SSDP discovery
+const ssdpAddress = "239.255.255.250:1900"
+
+// The UPnP error code of the routers which only support the permanent mappings
+const upnpOnlyPermanentLeases = 725
+
+// The WAN connection services which support the port mapping
+var wanServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// upnpError represents the error answered by the SOAP action
+type upnpError struct {
+	action      string
+	status      int
+	code        int // The UPnP error code in the SOAP fault, zero if absent
+	description string
+}
+
+func (e *upnpError) Error() string {
+	if e.code == 0 {
+		return fmt.Sprintf("UPnP %s failed with status %d", e.action, e.status)
+	}
+	return fmt.Sprintf("UPnP %s failed with error %d %s", e.action, e.code, e.description)
+}
+
+type upnp struct {
+	ssdp *net.UDPAddr
+
+	// The discovered WAN connection service of the router
+	serviceType string
+	controlURL  string
+}
+
+// NewUPnP returns the UPnP IGD client, the router is discovered by the SSDP
+// requests sent to the address.
+func NewUPnP(ssdp string) Client {
+	addr, _ := net.ResolveUDPAddr("udp4", ssdp)
+	return &upnp{ssdp: addr}
+}
+
+// Protocol implements the Client interface
+func (c *upnp) Protocol() string {
+	return "UPnP"
+}
+
+// Map implements the Client interface
+func (c *upnp) Map(ctx context.Context, port int, lifetime time.Duration) (*Mapping, error) {
+	if c.controlURL == "" {
+		if err := c.discover(ctx); err != nil {
+			return nil, err
+		}
+	}
+	location, err := url.Parse(c.controlURL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The port is irrelevant because no packet is sent to find the local IP
+	router, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(location.Hostname(), strconv.Itoa(serverPort)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	client, err := localIP(router)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(res["NewExternalIPAddress"]).To4()
+	if ip == nil {
+		return nil, errors.Errorf("UPnP invalid external address %q", res["NewExternalIPAddress"])
+	}
+
+	// Some routers only support the permanent mappings, which are renewed
+	// as the others and deleted by Unmap
+	err = c.addPortMapping(ctx, port, client, lifetime)
+	if e, ok := errors.Cause(err).(*upnpError); ok && e.code == upnpOnlyPermanentLeases {
+		lifetime = 0
+		err = c.addPortMapping(ctx, port, client, lifetime)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol: c.Protocol(),
+		External: &net.UDPAddr{IP: ip, Port: port},
+		Lifetime: lifetime,
+	}, nil
+}
+
+// addPortMapping maps the external port to the same port of the client, and
+// the mapping is permanent if the lifetime is zero
+func (c *upnp) addPortMapping(ctx context.Context, port int, client net.IP, lifetime time.Duration) error {
+	_, err := c.call(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(port)},
+		{"NewProtocol", "UDP"},
+		{"NewInternalPort", strconv.Itoa(port)},
+		{"NewInternalClient", client.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "zetamesh"},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	return err
+}
+
+// Unmap implements the Client interface
+func (c *upnp) Unmap(ctx context.Context, port int) error {
+	if c.controlURL == "" {
+		return nil
+	}
+	_, err := c.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(port)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+// discover finds the WAN connection service of the router by SSDP
+func (c *upnp) discover(ctx context.Context) error {
+	if c.ssdp == nil {
+		return ErrUnsupported
+	}
+	search := strings.Join([]string{
+		"M-SEARCH * HTTP/1.1",
+		"HOST: " + ssdpAddress,
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		`MAN: "ssdp:discover"`,
+		"MX: 1",
+		"", "",
+	}, "\r\n")
+
+	// The responses are sent by unicast to the source address
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	var location string
+	buffer := make([]byte, 2048)
+	timeout := initialTimeout * 4
+	for i := 0; i < maxTries && location == ""; i++ {
+		if _, err := conn.WriteToUDP([]byte(search), c.ssdp); err != nil {
+			return errors.WithStack(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location = res.Header.Get("Location")
+	}
+	if location == "" {
+		return ErrUnsupported
+	}
+	return c.describe(ctx, location)
+}
+
+// upnpDevice represents the device description of UPnP
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// describe fetches the device description and finds the WAN connection service
+func (c *upnp) describe(ctx context.Context, location string) error {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&root); err != nil {
+		return errors.WithStack(err)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if root.URLBase != "" {
+		if u, err := url.Parse(root.URLBase); err == nil {
+			base = u
+		}
+	}
+
+	devices := []upnpDevice{root.Device}
+	for len(devices) > 0 {
+		device := devices[0]
+		devices = append(devices[1:], device.Devices...)
+		for _, service := range device.Services {
+			for _, prefix := range wanServices {
+				if !strings.HasPrefix(service.ServiceType, prefix) {
+					continue
+				}
+				control, err := base.Parse(service.ControlURL)
+				if err != nil {
+					continue
+				}
+				c.serviceType = service.ServiceType
+				c.controlURL = control.String()
+				return nil
+			}
+		}
+	}
+	return ErrUnsupported
+}
+
+// call invokes the SOAP action of the WAN connection service and returns the
+// output arguments
+func (c *upnp) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, c.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%s>", arg[0])
+		_ = xml.EscapeText(body, []byte(arg[1]))
+		fmt.Fprintf(body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequest(http.MethodPost, c.controlURL, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, c.serviceType, action))
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Collect the text of the leaf elements as the output arguments, which
+	// include the error code of the SOAP fault
+	output := map[string]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var name string
+	for {
+		token, err := decoder.Token()
+		// The body of the failed action may not be a SOAP fault
+		if err == io.EOF || err != nil && res.StatusCode != http.StatusOK {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				output[name] = strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(output["errorCode"])
+		return nil, &upnpError{
+			action:      action,
+			status:      res.StatusCode,
+			code:        code,
+			description: output["errorDescription"],
+		}
+	}
+	return output, nil
+}
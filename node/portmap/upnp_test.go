@@ -0,0 +1,171 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const upnpDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/control</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// upnpRouter is a fake Internet gateway device, which only accepts the
+// permanent mappings if specified
+type upnpRouter struct {
+	onlyPermanent bool
+	errorCode     int // The error code of AddPortMapping if not zero
+
+	mu      sync.Mutex
+	actions []string // The actions with the lease durations if any
+}
+
+func (r *upnpRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		_, _ = w.Write([]byte(upnpDescription))
+		return
+	}
+
+	var envelope struct {
+		Body struct {
+			Action struct {
+				XMLName       xml.Name
+				LeaseDuration string `xml:"NewLeaseDuration"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(req.Body).Decode(&envelope); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := envelope.Body.Action.XMLName.Local
+	r.mu.Lock()
+	r.actions = append(r.actions, strings.TrimSpace(action+" "+envelope.Body.Action.LeaseDuration))
+	r.mu.Unlock()
+
+	switch {
+	case action == "GetExternalIPAddress":
+		fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>`+
+			`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	case action == "AddPortMapping" && r.errorCode != 0:
+		r.fault(w, r.errorCode, "ConflictInMappingEntry")
+	case action == "AddPortMapping" && r.onlyPermanent && envelope.Body.Action.LeaseDuration != "0":
+		r.fault(w, upnpOnlyPermanentLeases, "OnlyPermanentLeasesSupported")
+	default:
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`, action)
+	}
+}
+
+func (r *upnpRouter) fault(w http.ResponseWriter, code int, description string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+		`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+func TestUPnPMap(t *testing.T) {
+	cases := []struct {
+		name     string
+		router   *upnpRouter
+		lifetime time.Duration
+		actions  []string
+		err      bool
+	}{
+		{
+			name:     "lease",
+			router:   &upnpRouter{},
+			lifetime: time.Hour,
+			actions:  []string{"GetExternalIPAddress", "AddPortMapping 3600", "DeletePortMapping"},
+		},
+		{
+			name:     "only permanent leases",
+			router:   &upnpRouter{onlyPermanent: true},
+			lifetime: 0,
+			actions:  []string{"GetExternalIPAddress", "AddPortMapping 3600", "AddPortMapping 0", "DeletePortMapping"},
+		},
+		{
+			name:    "conflict",
+			router:  &upnpRouter{errorCode: 718},
+			actions: []string{"GetExternalIPAddress", "AddPortMapping 3600"},
+			err:     true,
+		},
+	}
+	for _, c := range cases {
+		server := httptest.NewServer(c.router)
+		ssdp := serveUDP(t, func(req []byte) []byte {
+			if !strings.HasPrefix(string(req), "M-SEARCH") {
+				return nil
+			}
+			return []byte("HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+				"Location: " + server.URL + "/description.xml\r\n\r\n")
+		})
+
+		client := NewUPnP(ssdp.String())
+		mapping, err := client.Map(context.Background(), 2823, time.Hour)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got mapping %+v", c.name, mapping)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if mapping.Protocol != "UPnP" || mapping.External.String() != "203.0.113.7:2823" || mapping.Lifetime != c.lifetime {
+				t.Errorf("%s: unexpected mapping %s %s %s", c.name, mapping.Protocol, mapping.External, mapping.Lifetime)
+			}
+			if err := client.Unmap(context.Background(), 2823); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		server.Close()
+
+		c.router.mu.Lock()
+		actions := strings.Join(c.router.actions, ",")
+		c.router.mu.Unlock()
+		if expected := strings.Join(c.actions, ","); actions != expected {
+			t.Errorf("%s: expected actions %s, got %s", c.name, expected, actions)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// traversalPlan represents how to traverse the NAT between the peers, which
+// is decided by the NAT types of both sides.
+type traversalPlan struct {
+	predicted int // The count of ports following the server reflexive port of the peer
+	random    int // The count of random ports of the peer probed in each round
+	sockets   int // The count of extra local sockets opened to the peer
+}
+
+// planTraversal returns the traversal plan of the NAT types. The NAT mapping of
+// a symmetric NAT is different for each destination, so the server reflexive
+// address observed by the gateway is useless for the peer.
+//
+// The node probes the ports following the server reflexive port of the peer
+// behind a symmetric NAT, which works if the NAT allocates ports sequentially.
+// The node behind a symmetric NAT opens many sockets to the peer, and the peer
+// probes many random ports, any collision of them opens the path (birthday).
+func planTraversal(local, remote message.NATType) traversalPlan {
+	var plan traversalPlan
+	if remote == message.NATType_NATSymmetric {
+		plan.predicted = constant.PredictedPorts
+		// The random probes are sent from the local port, which is mapped to
+		// a new public port by the local symmetric NAT and the peer will
+		// not accept them.
+		if local != message.NATType_NATSymmetric {
+			plan.random = constant.BirthdayProbes
+		}
+	}
+	if local == message.NATType_NATSymmetric {
+		plan.sockets = constant.BirthdaySockets
+	}
+	return plan
+}
+
+// traversal represents the rounds of probing the predicted addresses of the
+// peer, which are sent via the listener because the replies are from unknown
+// addresses and will be learned as the peer reflexive paths.
+type traversal struct {
+	ip        net.IP // The public IP of the peer
+	predicted []int
+	random    int
+	probed    map[int]bool // The random ports probed in the previous rounds
+	rounds    int          // The remaining rounds
+	rand      *rand.Rand
+}
+
+func newTraversal(ip net.IP, base int, plan traversalPlan, r *rand.Rand) *traversal {
+	return &traversal{
+		ip:        ip,
+		predicted: predictPorts(base, plan.predicted),
+		random:    plan.random,
+		probed:    map[int]bool{},
+		rounds:    constant.PortPredictionRounds,
+		rand:      r,
+	}
+}
+
+// next returns the addresses to be probed in the next round, and reports
+// false if all rounds finished
+func (t *traversal) next() ([]*net.UDPAddr, bool) {
+	if t.rounds <= 0 {
+		return nil, false
+	}
+	t.rounds--
+	if t.ip == nil {
+		return nil, true
+	}
+
+	// The predicted ports are probed in every round because the peer may
+	// open its NAT mapping later than the first round, but the random ports
+	// are only probed once to cover as many ports as possible
+	ports := make([]int, 0, len(t.predicted)+t.random)
+	ports = append(ports, t.predicted...)
+	ports = append(ports, randomPorts(t.rand, t.random, t.probed)...)
+	addrs := make([]*net.UDPAddr, 0, len(ports))
+	for _, port := range ports {
+		addrs = append(addrs, &net.UDPAddr{IP: t.ip, Port: port})
+	}
+	return addrs, true
+}
+
+// predictPorts returns the ports following the base port, which will be
+// allocated next by the NAT allocating ports sequentially
+func predictPorts(base, count int) []int {
+	ports := make([]int, 0, count)
+	for port := base + 1; len(ports) < count && port <= 65535; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// randomPorts returns the distinct random ports out of the well-known ports,
+// which haven't been seen before, and the returned ports are marked as seen
+func randomPorts(r *rand.Rand, count int, seen map[int]bool) []int {
+	const low = 1024
+	ports := make([]int, 0, count)
+	for len(ports) < count && len(seen) < 65536-low {
+		port := low + r.Intn(65536-low)
+		if seen[port] {
+			continue
+		}
+		seen[port] = true
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// predict returns the port prediction of the peer and the extra paths opened
+// by the local node, both are nil if no symmetric NAT between the peers.
+func (n *Node) predict(openTunnel *message.CtrlOpenTunnel) (*traversal, []*candidatePath) {
+	plan := planTraversal(n.natStatus().typ, openTunnel.NatType)
+	if plan == (traversalPlan{}) {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", openTunnel.UdpAddress)
+	if err != nil || addr.IP.To4() == nil {
+		return nil, nil
+	}
+
+	zap.L().Info("Predict ports of the symmetric NAT", zap.String("peer", openTunnel.VirtAddress),
+		zap.Stringer("local", n.natStatus().typ), zap.Stringer("remote", openTunnel.NatType))
+
+	var ip net.IP
+	if plan.predicted > 0 || plan.random > 0 {
+		ip = addr.IP.To4()
+	}
+	t := newTraversal(ip, addr.Port, plan, rand.New(rand.NewSource(time.Now().UnixNano())))
+
+	// The sockets are bound to random local ports to be mapped to different
+	// public ports, which are not shared with the node port
+	candidate := &message.Candidate{
+		Address:  openTunnel.UdpAddress,
+		Type:     message.CandidateType_ServerReflexive,
+		Priority: api.CandidatePriority(message.CandidateType_ServerReflexive, 0),
+	}
+	var paths []*candidatePath
+	for i := 0; i < plan.sockets; i++ {
+		conn, err := net.DialUDP("udp4", nil, addr)
+		if err != nil {
+			zap.L().Debug("Dial predicted path failed", zap.String("candidate", openTunnel.UdpAddress), zap.Error(err))
+			break
+		}
+		path := newCandidatePath(candidate, conn, uint64(candidate.Priority)-1)
+		path.predicted = true
+		paths = append(paths, path)
+	}
+	return t, paths
+}
+
+// serveListener reads the packets from the addresses which haven't been dialed,
+// e.g: the peer behind a symmetric NAT whose public port is unknown. The Ping
+// and Pong messages of the connected peers are accepted to learn new paths if
+// their handshakes are signed by the peer identities and the Ping challenges
+// sent to the addresses are answered.
+func (n *Node) serveListener(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		_ = n.listener.Close()
+	}()
+
+	buffer := make([]byte, constant.MaxBufferSize)
+	for {
+		c, remote, err := n.listener.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			zap.L().Debug("Read listener failed", zap.Error(err))
+			continue
+		}
+
+		hs := handshakeOf(buffer[:c])
+		if hs == nil {
+			continue
+		}
+		value, found := n.connections.Load(hs.GetVirtAddress())
+		if !found {
+			continue
+		}
+		conn := value.(*connection)
+		if !conn.verify(hs.GetPublicKey(), hs.GetCreated(), hs.GetProof()) {
+			zap.L().Debug("Drop unverified handshake", zap.String("peer", hs.GetVirtAddress()), zap.Stringer("remote", remote))
+			continue
+		}
+		if path, found := conn.learnedPaths.Load(remote.String()); found {
+			n.handlePeerPacket(conn, path.(*candidatePath), buffer[:c])
+			continue
+		}
+		n.challenge(conn, remote, hs)
+	}
+}
+
+// challenge answers the handshake received from the unknown remote address,
+// and the remote address is learned only after the Pong from it answers the
+// Ping sent to it, so the handshakes replayed from other addresses cannot make
+// the node learn their addresses.
+func (n *Node) challenge(conn *connection, remote *net.UDPAddr, hs signedHandshake) {
+	switch msg := hs.(type) {
+	case *message.CtrlPing:
+		data := n.pong(conn, msg)
+		if data == nil {
+			return
+		}
+		n.probe(remote, data)
+		n.probe(remote, conn.ping(0, remote.String()))
+
+	case *message.CtrlPong:
+		if msg.VirtAddress != conn.peerVirtAddr {
+			return
+		}
+		if err := conn.establish(msg.PublicKey, msg.Created, msg.Proof); err != nil {
+			zap.L().Debug("Establish session failed", zap.String("peer", msg.VirtAddress), zap.Error(err))
+			return
+		}
+		if !conn.answered(remote.String(), msg) {
+			zap.L().Debug("Drop unanswered Pong", zap.String("peer", msg.VirtAddress), zap.Stringer("remote", remote))
+			return
+		}
+		if path := conn.learn(remote, n.dialer); path != nil {
+			n.onPong(conn, path, msg)
+		}
+	}
+}
+
+// signedHandshake represents the handshake carried by the Ping and Pong messages
+type signedHandshake interface {
+	GetVirtAddress() string
+	GetPublicKey() []byte
+	GetCreated() int64
+	GetProof() []byte
+}
+
+// handshakeOf returns the handshake of the Ping or Pong message
+func handshakeOf(data []byte) signedHandshake {
+	if len(data) < 1 {
+		return nil
+	}
+	switch message.PacketType(data[0]) {
+	case message.PacketType_Ping:
+		ping := &message.CtrlPing{}
+		if err := proto.Unmarshal(data[1:], ping); err == nil {
+			return ping
+		}
+	case message.PacketType_Pong:
+		pong := &message.CtrlPong{}
+		if err := proto.Unmarshal(data[1:], pong); err == nil {
+			return pong
+		}
+	}
+	return nil
+}
+
+// probe sends the packet to the address via the listener
+func (n *Node) probe(addr *net.UDPAddr, data []byte) {
+	if _, err := n.listener.WriteToUDP(data, addr); err != nil {
+		zap.L().Debug("Send probe failed", zap.Stringer("address", addr), zap.Error(err))
+	}
+}
+
+// learn returns the peer reflexive path to the remote address which answered
+// the Ping challenge, and the path is dialed if unknown.
+func (c *connection) learn(remote *net.UDPAddr, dialer *net.Dialer) *candidatePath {
+	address := remote.String()
+	if path, found := c.learnedPaths.Load(address); found {
+		return path.(*candidatePath)
+	}
+	if c.learnedCount.Inc() > constant.MaxLearnedPaths {
+		return nil
+	}
+
+	conn, err := dialer.Dial("udp", address)
+	if err != nil {
+		zap.L().Debug("Dial peer reflexive path failed", zap.String("address", address), zap.Error(err))
+		return nil
+	}
+	candidate := &message.Candidate{
+		Address:  address,
+		Type:     message.CandidateType_PeerReflexive,
+		Priority: api.CandidatePriority(message.CandidateType_PeerReflexive, 0),
+	}
+	path := newCandidatePath(candidate, conn, uint64(candidate.Priority))
+
+	// The paths are owned by the connection loop
+	select {
+	case c.learned <- path:
+	case <-c.die:
+		path.close()
+		return nil
+	}
+	c.learnedPaths.Store(address, path)
+	zap.L().Info("Learn peer reflexive path", zap.String("peer", c.peerVirtAddr), zap.String("candidate", address))
+	return path
+}
+
+// prune closes the predicted paths except the selected one after the port
+// prediction finished
+func (c *connection) prune() {
+	selected := c.selectedPath()
+	paths := make([]*candidatePath, 0, len(c.paths))
+	for _, path := range c.paths {
+		if path.predicted && path != selected {
+			path.close()
+			continue
+		}
+		paths = append(paths, path)
+	}
+	c.paths = paths
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPlanTraversal(t *testing.T) {
+	var (
+		open       = message.NATType_NATOpen
+		cone       = message.NATType_NATEndpointIndependent
+		restricted = message.NATType_NATPortRestricted
+		symmetric  = message.NATType_NATSymmetric
+		unknown    = message.NATType_NATUnknown
+	)
+	cases := []struct {
+		name          string
+		local, remote message.NATType
+		expected      traversalPlan
+	}{
+		{"open to open", open, open, traversalPlan{}},
+		{"cone to cone", cone, cone, traversalPlan{}},
+		{"restricted to restricted", restricted, restricted, traversalPlan{}},
+		{"unknown to unknown", unknown, unknown, traversalPlan{}},
+		{"cone to symmetric", cone, symmetric, traversalPlan{
+			predicted: constant.PredictedPorts,
+			random:    constant.BirthdayProbes,
+		}},
+		{"unknown to symmetric", unknown, symmetric, traversalPlan{
+			predicted: constant.PredictedPorts,
+			random:    constant.BirthdayProbes,
+		}},
+		{"restricted to symmetric", restricted, symmetric, traversalPlan{
+			predicted: constant.PredictedPorts,
+			random:    constant.BirthdayProbes,
+		}},
+		{"symmetric to cone", symmetric, cone, traversalPlan{
+			sockets: constant.BirthdaySockets,
+		}},
+		{"symmetric to restricted", symmetric, restricted, traversalPlan{
+			sockets: constant.BirthdaySockets,
+		}},
+		{"symmetric to symmetric", symmetric, symmetric, traversalPlan{
+			predicted: constant.PredictedPorts,
+			sockets:   constant.BirthdaySockets,
+		}},
+	}
+	for _, c := range cases {
+		if plan := planTraversal(c.local, c.remote); plan != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, plan)
+		}
+	}
+}
+
+func TestPredictPorts(t *testing.T) {
+	cases := []struct {
+		base, count int
+		expected    []int
+	}{
+		{1000, 3, []int{1001, 1002, 1003}},
+		{1000, 0, []int{}},
+		{65533, 4, []int{65534, 65535}},
+		{65535, 4, []int{}},
+	}
+	for _, c := range cases {
+		if ports := predictPorts(c.base, c.count); !reflect.DeepEqual(ports, c.expected) {
+			t.Errorf("predict %d ports after %d: expected %v, got %v", c.count, c.base, c.expected, ports)
+		}
+	}
+}
+
+func TestRandomPorts(t *testing.T) {
+	cases := []struct {
+		name     string
+		seen     int // The count of ports seen before
+		count    int
+		expected int
+	}{
+		{"none", 0, 0, 0},
+		{"fresh", 0, 256, 256},
+		{"partially seen", 1000, 256, 256},
+		{"almost exhausted", 65536 - 1024 - 10, 256, 10},
+		{"exhausted", 65536 - 1024, 256, 0},
+	}
+	for _, c := range cases {
+		r := rand.New(rand.NewSource(1))
+		seen := map[int]bool{}
+		for port := 1024; len(seen) < c.seen; port++ {
+			seen[port] = true
+		}
+		before := make(map[int]bool, len(seen))
+		for port := range seen {
+			before[port] = true
+		}
+
+		ports := randomPorts(r, c.count, seen)
+		if len(ports) != c.expected {
+			t.Errorf("%s: expected %d ports, got %d", c.name, c.expected, len(ports))
+		}
+		unique := map[int]bool{}
+		for _, port := range ports {
+			if port < 1024 || port > 65535 {
+				t.Errorf("%s: port %d out of range", c.name, port)
+			}
+			if before[port] || unique[port] {
+				t.Errorf("%s: port %d probed twice", c.name, port)
+			}
+			if !seen[port] {
+				t.Errorf("%s: port %d not marked as seen", c.name, port)
+			}
+			unique[port] = true
+		}
+	}
+}
+
+func TestTraversalRounds(t *testing.T) {
+	plan := traversalPlan{predicted: 4, random: 8}
+	cases := []struct {
+		name      string
+		ip        net.IP
+		addresses int // The count of addresses probed in each round
+	}{
+		{"symmetric peer", net.IPv4(1, 2, 3, 4), plan.predicted + plan.random},
+		{"local sockets only", nil, 0},
+	}
+	for _, c := range cases {
+		tr := newTraversal(c.ip, 5000, plan, rand.New(rand.NewSource(1)))
+		random := map[int]bool{}
+		for round := 0; round < constant.PortPredictionRounds; round++ {
+			addrs, ok := tr.next()
+			if !ok {
+				t.Fatalf("%s: finished after %d rounds", c.name, round)
+			}
+			if len(addrs) != c.addresses {
+				t.Fatalf("%s: expected %d addresses in round %d, got %d", c.name, c.addresses, round, len(addrs))
+			}
+			for i, addr := range addrs {
+				if !addr.IP.Equal(c.ip) {
+					t.Errorf("%s: unexpected address %s", c.name, addr)
+				}
+				// The predicted ports are probed in every round, but the
+				// random ports are never probed twice
+				if i < plan.predicted {
+					if addr.Port != 5001+i {
+						t.Errorf("%s: expected predicted port %d, got %d", c.name, 5001+i, addr.Port)
+					}
+					continue
+				}
+				if random[addr.Port] {
+					t.Errorf("%s: random port %d probed twice", c.name, addr.Port)
+				}
+				random[addr.Port] = true
+			}
+		}
+		if _, ok := tr.next(); ok {
+			t.Errorf("%s: expected finished after %d rounds", c.name, constant.PortPredictionRounds)
+		}
+	}
+}
+
+// newConnections returns both sides of a connection between 10.0.0.1 and 10.0.0.2
+func newConnections(t *testing.T) (*connection, *connection) {
+	publicA, identityA, _ := ed25519.GenerateKey(crand.Reader)
+	publicB, identityB, _ := ed25519.GenerateKey(crand.Reader)
+	handshakeA, err := newHandshake(identityA, "10.0.0.1", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshakeB, err := newHandshake(identityB, "10.0.0.2", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &connection{selfVirtAddr: "10.0.0.1", peerVirtAddr: "10.0.0.2", peerIdentity: publicB, handshake: handshakeA}
+	b := &connection{selfVirtAddr: "10.0.0.2", peerVirtAddr: "10.0.0.1", peerIdentity: publicA, handshake: handshakeB}
+	return a, b
+}
+
+func TestChallengePong(t *testing.T) {
+	a, b := newConnections(t)
+	nodeA := &Node{address: "10.0.0.1"}
+	nodeB := &Node{address: "10.0.0.2"}
+
+	// The Pong answers the Ping sent to the peer at 1.2.3.4:1000
+	data := a.ping(0, "1.2.3.4:1000")
+	ping := &message.CtrlPing{}
+	if err := proto.Unmarshal(data[1:], ping); err != nil {
+		t.Fatal(err)
+	}
+	data = nodeB.pong(b, ping)
+	if data == nil {
+		t.Fatal("Ping of the peer unanswered")
+	}
+	pong := &message.CtrlPong{}
+	if err := proto.Unmarshal(data[1:], pong); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.establish(pong.PublicKey, pong.Created, pong.Proof); err != nil {
+		t.Fatal(err)
+	}
+	if !a.answered("1.2.3.4:1000", pong) {
+		t.Fatal("Pong from the address challenged rejected")
+	}
+
+	// The captured Pong replayed from another address is never learned
+	replayed := &net.UDPAddr{IP: net.IPv4(6, 6, 6, 6), Port: 6666}
+	if a.answered(replayed.String(), pong) {
+		t.Error("Pong replayed from another address accepted")
+	}
+	nodeA.challenge(a, replayed, pong)
+	if _, found := a.learnedPaths.Load(replayed.String()); found {
+		t.Error("address of the replayed Pong learned")
+	}
+
+	// The response must be computed by the peer for the Ping nonce
+	forged := proto.Clone(pong).(*message.CtrlPong)
+	forged.Response = a.currentSession().respond("10.0.0.1", pong.PingNonce)
+	if a.answered("1.2.3.4:1000", forged) {
+		t.Error("Pong with the reflected response accepted")
+	}
+	forged = proto.Clone(pong).(*message.CtrlPong)
+	forged.PingNonce = "unknown"
+	if a.answered("1.2.3.4:1000", forged) {
+		t.Error("Pong answering an unknown Ping accepted")
+	}
+
+	// The Pong answering an expired Ping cannot prove the path available
+	a.expireChallenges(time.Now().Add(constant.PingExpire + time.Second))
+	if a.answered("1.2.3.4:1000", pong) {
+		t.Error("Pong answering an expired Ping accepted")
+	}
+}
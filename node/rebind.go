@@ -0,0 +1,157 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"go.uber.org/zap"
+)
+
+// gatewayConn returns the current UDP socket connected to the gateway
+func (n *Node) gatewayConn() *net.UDPConn {
+	conn, _ := n.gateway.Load().(*net.UDPConn)
+	return conn
+}
+
+// rebindNow requests the node to rebind the UDP socket, e.g: the socket failed
+func (n *Node) rebindNow() {
+	select {
+	case n.rebindTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// keepGateway watches the local network and the heartbeats, and rebinds the
+// UDP sockets if the local network changed or the gateway is lost. The node
+// keeps the same local port so only the local address is changed.
+func (n *Node) keepGateway(ctx context.Context) {
+	var (
+		ticker   = time.NewTicker(constant.NetworkCheckInterval)
+		previous = api.CandidatesField(n.gatherCandidates())
+		rebound  = time.Now()
+	)
+	defer ticker.Stop()
+
+	for {
+		var reason string
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.rebindTrigger:
+			reason = "socket failed"
+		case <-ticker.C:
+		}
+
+		hosts := api.CandidatesField(n.gatherCandidates())
+		if hosts != previous {
+			zap.L().Info("Local network changed", zap.String("candidates", hosts))
+			previous = hosts
+			reason = "network changed"
+		}
+		if reason == "" && n.gatewayUnanswered() && time.Since(rebound) > constant.GatewayLostTimeout {
+			if !n.gatewayLost.Swap(true) {
+				zap.L().Warn("Gateway lost, no heartbeat answered", zap.String("gateway", n.opt.Gateway))
+			}
+			reason = "gateway lost"
+		}
+		if reason == "" || time.Since(rebound) < constant.RebindRetryInterval {
+			continue
+		}
+		rebound = time.Now()
+		n.rebind(ctx, reason)
+	}
+}
+
+// gatewayUnanswered reports whether no heartbeat is answered by the gateway via
+// either UDP or the stream for GatewayLostTimeout
+func (n *Node) gatewayUnanswered() bool {
+	last := n.lastHeartbeatAck.Load()
+	return last > 0 && time.Since(time.Unix(0, last)) > constant.GatewayLostTimeout
+}
+
+// rebind dials the gateway with a new UDP socket bound to the current local
+// address, and migrates the peer connections and the relays to the new local
+// address. The node registers again with the new candidates, and reopens the
+// tunnels so the peers learn the new candidates.
+func (n *Node) rebind(ctx context.Context, reason string) {
+	if n.stopped.Load() {
+		return
+	}
+	conn, err := n.dialer.DialContext(ctx, "udp", n.opt.Gateway)
+	if err != nil {
+		zap.L().Warn("Rebind UDP socket failed", zap.String("reason", reason), zap.Error(err))
+		return
+	}
+	prev := n.gatewayConn()
+	n.gateway.Store(conn.(*net.UDPConn))
+	_ = prev.Close()
+	zap.L().Info("Rebind UDP socket", zap.String("reason", reason), zap.Stringer("local", conn.LocalAddr()))
+
+	// The relays are dialed again once advertised by the next heartbeat ack
+	n.relays.Range(func(key, value interface{}) bool {
+		n.relays.Delete(key)
+		value.(*relayClient).close()
+		return true
+	})
+	n.connections.Range(func(_, value interface{}) bool {
+		select {
+		case value.(*connection).migration <- n.dialer:
+		default:
+		}
+		return true
+	})
+
+	select {
+	case n.remapTrigger <- struct{}{}:
+	default:
+	}
+	// The address observed by the gateway is unknown until detected again, and
+	// the heartbeats signed for the previous address would be rejected
+	n.nat.Store(&natResult{typ: n.natStatus().typ})
+	go n.detectNAT()
+
+	// The control stream may be broken silently by the network change
+	if stream := n.controlStream(); stream != nil {
+		stream.Close()
+	}
+
+	started := time.Now().UnixNano()
+	n.heartbeatNow()
+	go n.reopenTunnels(ctx, started)
+}
+
+// reopenTunnels requests the gateway to reopen the tunnels to the connected
+// peers after the heartbeat with the new candidates is answered and the
+// control stream is registered again
+func (n *Node) reopenTunnels(ctx context.Context, since int64) {
+	deadline := time.After(constant.GatewayLostTimeout)
+	for n.lastHeartbeatAck.Load() < since || n.controlRegistered.Load() < since {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-time.After(constant.ConnectingRetryDuration):
+		}
+	}
+	n.connections.Range(func(key, _ interface{}) bool {
+		n.openTunnel(key.(string))
+		return true
+	})
+}
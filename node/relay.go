@@ -0,0 +1,294 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/codec"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// relayToken represents the token issued by the gateway to bind the relays
+type relayToken struct {
+	token  []byte
+	expiry int64
+}
+
+// relayClient represents the binding of the node to a dedicated relay server
+type relayClient struct {
+	address string
+	conn    *net.UDPConn
+	srtt    atomic.Int64 // The smoothed round-trip time in microseconds
+	lastAck atomic.Int64 // The unix nano of the last binding answered by the relay
+	closed  atomic.Bool
+}
+
+// active reports whether the relay answered the binding recently
+func (r *relayClient) active() bool {
+	last := r.lastAck.Load()
+	return last > 0 && time.Since(time.Unix(0, last)) < constant.RelayBindExpire
+}
+
+func (r *relayClient) close() {
+	if !r.closed.Swap(true) {
+		_ = r.conn.Close()
+	}
+}
+
+// updateRelays updates the relay servers advertised by the gateway and the
+// token to bind them, the relays no longer advertised are closed
+func (n *Node) updateRelays(ack *message.CtrlHeartbeatAck) {
+	if len(ack.RelayToken) > 0 {
+		n.relayToken.Store(&relayToken{token: ack.RelayToken, expiry: ack.RelayTokenExpiry})
+	}
+
+	advertised := map[string]struct{}{}
+	for _, address := range ack.Relays {
+		advertised[address] = struct{}{}
+		if _, found := n.relays.Load(address); found {
+			continue
+		}
+		conn, err := n.dialer.Dial("udp", address)
+		if err != nil {
+			zap.L().Error("Dial relay failed", zap.String("relay", address), zap.Error(err))
+			continue
+		}
+		client := &relayClient{address: address, conn: conn.(*net.UDPConn)}
+		if _, loaded := n.relays.LoadOrStore(address, client); loaded {
+			_ = conn.Close()
+			continue
+		}
+		zap.L().Info("Add relay server", zap.String("relay", address))
+		go n.readRelay(client)
+		n.bindRelay(client)
+	}
+
+	n.relays.Range(func(key, value interface{}) bool {
+		if _, found := advertised[key.(string)]; !found {
+			zap.L().Info("Remove relay server", zap.String("relay", key.(string)))
+			n.relays.Delete(key)
+			value.(*relayClient).close()
+		}
+		return true
+	})
+}
+
+// keepRelays renews the bindings of the relays periodically, and reselects the
+// relay of each peer with the latest round-trip time
+func (n *Node) keepRelays(ctx context.Context) {
+	ticker := time.NewTicker(constant.RelayBindInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			n.relays.Range(func(_, value interface{}) bool {
+				value.(*relayClient).close()
+				return true
+			})
+			return
+		case <-ticker.C:
+		}
+
+		n.relays.Range(func(_, value interface{}) bool {
+			n.bindRelay(value.(*relayClient))
+			return true
+		})
+		n.connections.Range(func(_, value interface{}) bool {
+			n.selectRelay(value.(*connection))
+			return true
+		})
+	}
+}
+
+// bindRelay binds the node to the relay with the token issued by the gateway and
+// signed by the node identity, the timestamp is echoed by the relay to measure
+// the round-trip time
+func (n *Node) bindRelay(client *relayClient) {
+	token, _ := n.relayToken.Load().(*relayToken)
+	if token == nil {
+		return
+	}
+	bind := &message.CtrlRelayBind{
+		VirtAddress: n.address,
+		Token:       token.token,
+		Expiry:      token.expiry,
+		Timestamp:   time.Now().UnixNano(),
+		PublicKey:   n.identity.Public().(ed25519.PublicKey),
+	}
+	bind.Signature = api.SignIdentity(n.identity, api.RelayBindFields(bind)...)
+	data := codec.Encode(message.PacketType_RelayBind, bind)
+	if _, err := client.conn.Write(data); err != nil {
+		zap.L().Debug("Bind relay failed", zap.String("relay", client.address), zap.Error(err))
+	}
+}
+
+// readRelay reads the packets from the relay until the client is closed
+func (n *Node) readRelay(client *relayClient) {
+	buffer := make([]byte, constant.MaxBufferSize)
+	for {
+		c, err := client.conn.Read(buffer)
+		if err != nil {
+			if client.closed.Load() {
+				return
+			}
+			// The ICMP unreachable is reported if the relay is down temporarily
+			zap.L().Debug("Read relay failed", zap.String("relay", client.address), zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+		if c < 1 {
+			continue
+		}
+		// The relay server only forwards the packets of the peers
+		switch message.PacketType(buffer[0]) {
+		case message.PacketType_Relay:
+			n.handlePacket(client.conn.RemoteAddr(), buffer[:c])
+			continue
+		case message.PacketType_RelayBindAck:
+		default:
+			continue
+		}
+		ack := &message.CtrlRelayBindAck{}
+		if err := proto.Unmarshal(buffer[1:c], ack); err != nil {
+			zap.L().Error("Unmarshal proto message failed", zap.Stringer("type", message.PacketType_RelayBindAck), zap.Error(err))
+			continue
+		}
+		n.onRelayBindAck(client, ack)
+	}
+}
+
+func (n *Node) onRelayBindAck(client *relayClient, ack *message.CtrlRelayBindAck) {
+	if ack.Code != message.StatusCode_Success {
+		zap.L().Warn("Relay rejected the binding", zap.String("relay", client.address), zap.Stringer("code", ack.Code))
+		return
+	}
+	rtt := time.Since(time.Unix(0, ack.Timestamp))
+	if rtt < 0 || rtt > constant.RelayBindInterval {
+		return
+	}
+	activated := !client.active()
+	sample := rtt.Microseconds()
+	if srtt := client.srtt.Load(); srtt > 0 && !activated {
+		sample = (7*srtt + sample) / 8
+	}
+	client.srtt.Store(sample)
+	client.lastAck.Store(time.Now().UnixNano())
+
+	// Report the latency to the gateway as soon as possible, so the peers
+	// opening tunnels to the node can select the relay
+	if activated {
+		zap.L().Info("Bind relay successfully", zap.String("relay", client.address), zap.Duration("rtt", rtt))
+		n.heartbeatNow()
+	}
+}
+
+// relayLatencies returns the round-trip time to the active relays, which is
+// reported to the gateway and offered to the peers
+func (n *Node) relayLatencies() []*message.RelayLatency {
+	var latencies []*message.RelayLatency
+	n.relays.Range(func(_, value interface{}) bool {
+		client := value.(*relayClient)
+		if client.active() {
+			latencies = append(latencies, &message.RelayLatency{
+				Address: client.address,
+				Rtt:     client.srtt.Load(),
+			})
+		}
+		return true
+	})
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i].Address < latencies[j].Address
+	})
+	return latencies
+}
+
+// pickRelay returns the relay with the lowest latency between the local node
+// and the peer via the relay, empty means no relay shared with the peer
+func (n *Node) pickRelay(peer []*message.RelayLatency) string {
+	var (
+		best    string
+		minimum int64
+	)
+	for _, latency := range peer {
+		value, found := n.relays.Load(latency.Address)
+		if !found || !value.(*relayClient).active() {
+			continue
+		}
+		total := value.(*relayClient).srtt.Load() + latency.Rtt
+		if best == "" || total < minimum {
+			best, minimum = latency.Address, total
+		}
+	}
+	return best
+}
+
+// selectRelay selects the relay of the connection, which falls back to the
+// gateway if no relay is available
+func (n *Node) selectRelay(conn *connection) {
+	peer, _ := conn.peerRelays.Load().([]*message.RelayLatency)
+	relay := n.pickRelay(peer)
+	if conn.relay.Load() != relay {
+		conn.relay.Store(relay)
+		zap.L().Info("Select relay of the peer", zap.String("peer", conn.peerVirtAddr), zap.String("relay", relay))
+	}
+}
+
+// writeRelay sends the packet via the relay selected for the peer, and reports
+// false if the packet should be relayed by the gateway
+func (n *Node) writeRelay(virtAddress string, data []byte) (bool, error) {
+	conn, found := n.connections.Load(virtAddress)
+	if !found {
+		return false, nil
+	}
+	relay := conn.(*connection).relay.Load()
+	if relay == "" {
+		return false, nil
+	}
+	client, found := n.relays.Load(relay)
+	if !found || !client.(*relayClient).active() {
+		return false, nil
+	}
+	_, err := client.(*relayClient).conn.Write(data)
+	return true, errors.WithStack(err)
+}
+
+// relayStatus returns the status of the relays ordered by address
+func (n *Node) relayStatus() []*RelayStatus {
+	relays := []*RelayStatus{}
+	n.relays.Range(func(_, value interface{}) bool {
+		client := value.(*relayClient)
+		relays = append(relays, &RelayStatus{
+			Address: client.address,
+			Active:  client.active(),
+			RTT:     time.Duration(client.srtt.Load()) * time.Microsecond,
+		})
+		return true
+	})
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i].Address < relays[j].Address
+	})
+	return relays
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// sessionInfo is mixed into the key derivation to bind the keys to the protocol
+var sessionInfo = []byte("zetamesh data v1 chacha20poly1305")
+
+// replayWindowSize represents the count of the most recent counters which are
+// remembered to reject the replayed packets
+const replayWindowSize = 2048
+
+// handshakeLabel separates the handshake proofs from other identity signatures
+const handshakeLabel = "zetamesh handshake v1"
+
+// handshake represents the ephemeral X25519 key pair of a connection. The public
+// key is carried by Ping/Pong and both peers derive the same session from the
+// Diffie-Hellman result, so the gateway never learns the data keys. The public
+// key is signed by the node identity, so neither the gateway nor the relays can
+// replace it.
+type handshake struct {
+	private [32]byte
+	public  [32]byte
+	created int64  // The unix nano of the key generated, a newer key replaces the older
+	proof   []byte // The signature of the public key by the node identity
+}
+
+// handshakeFields returns the signed fields of the handshake sent by the sender
+func handshakeFields(sender, receiver string, public []byte, created int64) []string {
+	return []string{handshakeLabel, sender, receiver, string(public), strconv.FormatInt(created, 10)}
+}
+
+func newHandshake(identity ed25519.PrivateKey, sender, receiver string) (*handshake, error) {
+	h := &handshake{created: time.Now().UnixNano()}
+	if _, err := io.ReadFull(rand.Reader, h.private[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	public, err := curve25519.X25519(h.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	copy(h.public[:], public)
+	h.proof = api.SignIdentity(identity, handshakeFields(sender, receiver, h.public[:], h.created)...)
+	return h, nil
+}
+
+// derive returns the session shared with the peer owning the public key
+func (h *handshake) derive(peerPublic []byte) (*session, error) {
+	shared, err := curve25519.X25519(h.private[:], peerPublic)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid peer public key")
+	}
+
+	// The salt must be the same for both sides, so the keys are sorted
+	lo, hi := h.public[:], peerPublic
+	initiator := bytes.Compare(lo, hi) < 0
+	if !initiator {
+		lo, hi = hi, lo
+	}
+	salt := append(append([]byte{}, lo...), hi...)
+
+	// The keys are the send and receive keys followed by the shared key of
+	// the Ping challenges
+	keys := make([]byte, 3*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, sessionInfo), keys); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sendKey, recvKey := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:2*chacha20poly1305.KeySize]
+	if !initiator {
+		sendKey, recvKey = recvKey, sendKey
+	}
+
+	s := &session{
+		peerPublic: append([]byte{}, peerPublic...),
+		challenge:  keys[2*chacha20poly1305.KeySize:],
+	}
+	if s.send, err = chacha20poly1305.New(sendKey); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if s.recv, err = chacha20poly1305.New(recvKey); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s, nil
+}
+
+// session represents the encryption state of the data packets between two peers.
+// ENCRYPTED FORMAT:
+// COUNTER(8 bytes, big endian) | CHACHA20-POLY1305 CIPHERTEXT
+type session struct {
+	peerPublic  []byte
+	peerCreated int64  // The creation time of the ephemeral key of the peer
+	peerProof   []byte // The verified signature of the ephemeral key of the peer
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	challenge   []byte // The MAC key of the responses to the Ping nonces
+	counter     atomic.Uint64
+
+	mu     sync.Mutex
+	window replayWindow
+}
+
+func (s *session) nonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+// seal encrypts the plaintext and returns the encrypted payload
+func (s *session) seal(plaintext []byte) []byte {
+	counter := s.counter.Inc()
+	out := make([]byte, 8, 8+len(plaintext)+s.send.Overhead())
+	binary.BigEndian.PutUint64(out, counter)
+	return s.send.Seal(out, s.nonce(counter), plaintext, nil)
+}
+
+// open decrypts the encrypted payload and rejects the forged or replayed packets
+func (s *session) open(payload []byte) ([]byte, error) {
+	if len(payload) < 8+s.recv.Overhead() {
+		return nil, errors.New("encrypted payload too short")
+	}
+	counter := binary.BigEndian.Uint64(payload)
+	plaintext, err := s.recv.Open(nil, s.nonce(counter), payload[8:], nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.window.accept(counter) {
+		return nil, errors.Errorf("replayed packet with counter %d", counter)
+	}
+	return plaintext, nil
+}
+
+// respond returns the response of the sender to the Ping nonce, the sender
+// is mixed in so the responses reflected to the Ping sender are rejected
+func (s *session) respond(sender, nonce string) []byte {
+	mac := hmac.New(sha256.New, s.challenge)
+	_, _ = mac.Write([]byte(sender))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(nonce))
+	return mac.Sum(nil)
+}
+
+// verifyResponse reports whether the response to the Ping nonce is computed
+// by the sender owning the session
+func (s *session) verifyResponse(sender, nonce string, response []byte) bool {
+	return hmac.Equal(s.respond(sender, nonce), response)
+}
+
+// replayWindow is a sliding bitmap of the recently received counters
+type replayWindow struct {
+	last   uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.last {
+		// Clear the slots slid out of the window
+		for i := w.last + 1; i <= counter && i-w.last <= replayWindowSize; i++ {
+			w.bitmap[(i/64)%uint64(len(w.bitmap))] &^= 1 << (i % 64)
+		}
+		w.last = counter
+	} else if w.last-counter >= replayWindowSize {
+		return false
+	}
+
+	word, bit := (counter/64)%uint64(len(w.bitmap)), uint64(1)<<(counter%64)
+	if w.bitmap[word]&bit != 0 {
+		return false
+	}
+	w.bitmap[word] |= bit
+	return true
+}
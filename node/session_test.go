@@ -0,0 +1,186 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// newSessions returns the sessions derived by both sides of a connection
+func newSessions(t *testing.T) (*session, *session) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	local, err := newHandshake(identity, "10.0.0.1", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := newHandshake(identity, "10.0.0.2", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := local.derive(remote.public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := remote.derive(local.public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestSessionSealOpen(t *testing.T) {
+	a, b := newSessions(t)
+	for _, plaintext := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xff}, 1400)} {
+		opened, err := b.open(a.seal(plaintext))
+		if err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Errorf("expected %x, got %x", plaintext, opened)
+		}
+		opened, err = a.open(b.seal(plaintext))
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("reverse direction: expected %x, got %x (%v)", plaintext, opened, err)
+		}
+	}
+
+	// Each direction has its own key, so the packets cannot be reflected
+	if _, err := a.open(a.seal([]byte("reflected"))); err == nil {
+		t.Error("reflected packet opened")
+	}
+}
+
+func TestSessionTamper(t *testing.T) {
+	a, b := newSessions(t)
+	sealed := a.seal([]byte("hello"))
+	cases := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"ciphertext", func(p []byte) []byte { p[8] ^= 1; return p }},
+		{"tag", func(p []byte) []byte { p[len(p)-1] ^= 1; return p }},
+		{"counter", func(p []byte) []byte { binary.BigEndian.PutUint64(p, 100); return p }},
+		{"truncated", func(p []byte) []byte { return p[:len(p)-1] }},
+		{"too short", func(p []byte) []byte { return p[:8] }},
+	}
+	for _, c := range cases {
+		payload := c.tamper(append([]byte{}, sealed...))
+		if _, err := b.open(payload); err == nil {
+			t.Errorf("%s: tampered packet opened", c.name)
+		}
+	}
+	// The tampered packets don't consume the counter of the genuine one
+	if _, err := b.open(sealed); err != nil {
+		t.Errorf("genuine packet rejected after tampered ones: %v", err)
+	}
+	if _, err := b.open(sealed); err == nil {
+		t.Error("replayed packet opened")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	cases := []struct {
+		name     string
+		counters []uint64
+		expected []bool
+	}{
+		{"zero", []uint64{0}, []bool{false}},
+		{"in order", []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"duplicated", []uint64{1, 2, 2, 1}, []bool{true, true, false, false}},
+		{"out of order in window", []uint64{5, 3, 4, 1, 3}, []bool{true, true, true, true, false}},
+		{"too old", []uint64{replayWindowSize + 1, 1, 2}, []bool{true, false, true}},
+		{"window edge", []uint64{replayWindowSize + 10, 10, 11}, []bool{true, false, true}},
+		{"slid window", []uint64{1, 3 * replayWindowSize, 2*replayWindowSize + 1, 1}, []bool{true, true, true, false}},
+	}
+	for _, c := range cases {
+		var w replayWindow
+		for i, counter := range c.counters {
+			if ok := w.accept(counter); ok != c.expected[i] {
+				t.Errorf("%s: counter %d at %d expected %v, got %v", c.name, counter, i, c.expected[i], ok)
+			}
+		}
+	}
+}
+
+func TestDeriveSymmetry(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	local, _ := newHandshake(identity, "10.0.0.1", "10.0.0.2")
+	remote, _ := newHandshake(identity, "10.0.0.2", "10.0.0.1")
+	other, _ := newHandshake(identity, "10.0.0.3", "10.0.0.1")
+
+	a, err := local.derive(remote.public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := remote.derive(local.public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.open(a.seal([]byte("hello"))); err != nil {
+		t.Errorf("sessions derived by both sides mismatched: %v", err)
+	}
+
+	// The session derived with another key cannot open the packets
+	c, err := other.derive(local.public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.open(a.seal([]byte("hello"))); err == nil {
+		t.Error("packet opened by the session of another key")
+	}
+
+	// The low order point makes the shared secret all zero
+	if _, err := local.derive(make([]byte, 32)); err == nil {
+		t.Error("derived with the low order public key")
+	}
+}
+
+func TestVerifyHandshake(t *testing.T) {
+	peerPublic, peerPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	conn := &connection{
+		selfVirtAddr: "10.0.0.1",
+		peerVirtAddr: "10.0.0.2",
+		peerIdentity: peerPublic,
+	}
+	cases := []struct {
+		name     string
+		identity ed25519.PrivateKey
+		sender   string
+		receiver string
+		expected bool
+	}{
+		{"signed by the peer", peerPrivate, "10.0.0.2", "10.0.0.1", true},
+		{"signed by others", otherPrivate, "10.0.0.2", "10.0.0.1", false},
+		{"sent to others", peerPrivate, "10.0.0.2", "10.0.0.3", false},
+		{"reflected", peerPrivate, "10.0.0.1", "10.0.0.2", false},
+	}
+	for _, c := range cases {
+		h, err := newHandshake(c.identity, c.sender, c.receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := conn.verify(h.public[:], h.created, h.proof); ok != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, ok)
+		}
+		if conn.verify(h.public[:], h.created+1, h.proof) {
+			t.Errorf("%s: verified with the tampered creation time", c.name)
+		}
+	}
+}
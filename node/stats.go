@@ -0,0 +1,144 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lonng/zetamesh/constant"
+)
+
+// probe represents a Ping message waiting for the Pong, the done channel is
+// only used by the probes sent on demand (e.g: zetamesh ping).
+type probe struct {
+	sent time.Time
+	done chan probeResult
+}
+
+type probeResult struct {
+	rtt     time.Duration
+	relayed bool
+}
+
+// LatencyStats represents the round-trip statistics of a connection
+type LatencyStats struct {
+	RTT      time.Duration `json:"rtt"`    // The smoothed round-trip time
+	Jitter   time.Duration `json:"jitter"` // The mean deviation of the round-trip time
+	LastRTT  time.Duration `json:"last_rtt"`
+	Sent     uint64        `json:"sent"`
+	Received uint64        `json:"received"`
+	Lost     uint64        `json:"lost"`
+}
+
+// Loss returns the ratio of the lost probes
+func (s LatencyStats) Loss() float64 {
+	if s.Received+s.Lost == 0 {
+		return 0
+	}
+	return float64(s.Lost) / float64(s.Received+s.Lost)
+}
+
+// probeStats keeps the round-trip statistics of the Ping messages sent to the
+// peer, the Pong message echoes the timestamp of the Ping to identify it. The
+// RTT and its mean deviation (reported as jitter) are smoothed as RFC 6298.
+type probeStats struct {
+	mu       sync.Mutex
+	inflight map[int64]*probe // timestamp -> probe
+	stats    LatencyStats
+}
+
+// send registers a probe and returns the timestamp carried by the Ping
+func (p *probeStats) send(done chan probeResult) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.expire(now)
+
+	// The timestamp identifies the probe and must be unique
+	timestamp := now.UnixNano()
+	for {
+		if _, found := p.inflight[timestamp]; !found {
+			break
+		}
+		timestamp++
+	}
+	if p.inflight == nil {
+		p.inflight = map[int64]*probe{}
+	}
+	p.inflight[timestamp] = &probe{sent: now, done: done}
+	p.stats.Sent++
+	return timestamp
+}
+
+// observe updates the statistics with the Pong echoes the timestamp
+func (p *probeStats) observe(timestamp int64, relayed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	probe, found := p.inflight[timestamp]
+	if !found {
+		return
+	}
+	delete(p.inflight, timestamp)
+
+	rtt := time.Since(probe.sent)
+	s := &p.stats
+	if s.Received == 0 {
+		s.RTT = rtt
+		s.Jitter = rtt / 2
+	} else {
+		delta := s.RTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.Jitter += (delta - s.Jitter) / 4
+		s.RTT += (rtt - s.RTT) / 8
+	}
+	s.LastRTT = rtt
+	s.Received++
+
+	if probe.done != nil {
+		probe.done <- probeResult{rtt: rtt, relayed: relayed}
+	}
+}
+
+// expire counts the probes without Pong in time as lost
+func (p *probeStats) expire(now time.Time) {
+	for timestamp, probe := range p.inflight {
+		if now.Sub(probe.sent) > constant.ProbeTimeout {
+			delete(p.inflight, timestamp)
+			p.stats.Lost++
+		}
+	}
+}
+
+// cancel gives up waiting for the probe and counts it as lost
+func (p *probeStats) cancel(timestamp int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.inflight[timestamp]; found {
+		delete(p.inflight, timestamp)
+		p.stats.Lost++
+	}
+}
+
+// snapshot returns the current statistics
+func (p *probeStats) snapshot() LatencyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(time.Now())
+	return p.stats
+}
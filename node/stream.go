@@ -0,0 +1,119 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/constant"
+	"go.uber.org/zap"
+)
+
+// currentStream returns the stream to the gateway, nil if the node uses UDP
+func (n *Node) currentStream() *api.Stream {
+	stream, _ := n.stream.Load().(*api.Stream)
+	return stream
+}
+
+// writeGateway sends the packet to the gateway via the stream if the node has
+// fallen back to the stream, otherwise via UDP
+func (n *Node) writeGateway(data []byte) error {
+	if stream := n.currentStream(); stream != nil {
+		return stream.Write(data)
+	}
+	_, err := n.gatewayConn().Write(data)
+	return err
+}
+
+// udpUnreachable reports whether the gateway has not answered the heartbeats
+// via UDP for a while
+func (n *Node) udpUnreachable(started time.Time) bool {
+	last := n.lastUDPAck.Load()
+	if last == 0 {
+		return time.Since(started) >= constant.RegisterTimeout
+	}
+	return time.Since(time.Unix(0, last)) > 2*constant.HeartbeatInterval*time.Second
+}
+
+// keepTransport falls back to the stream if the UDP heartbeats get no response,
+// e.g: the outbound UDP is blocked, and switches back to UDP once the gateway
+// answers the binding request via UDP.
+func (n *Node) keepTransport(ctx context.Context) {
+	started := time.Now()
+	timer := time.After(constant.RegisterTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			if stream := n.currentStream(); stream != nil {
+				_ = stream.Close()
+			}
+			return
+		case <-timer:
+			timer = time.After(constant.TransportCheckInterval)
+		}
+
+		stream := n.currentStream()
+		if stream == nil {
+			if !n.udpUnreachable(started) {
+				continue
+			}
+			zap.L().Warn("Gateway unreachable via UDP, fallback to the stream", zap.String("gateway", n.opt.Gateway))
+			stream, err := n.apiClient.DialStream(ctx)
+			if err != nil {
+				zap.L().Error("Dial stream failed", zap.String("gateway", n.opt.Gateway), zap.Error(err))
+				continue
+			}
+			zap.L().Info("Connect to the gateway via the stream", zap.Stringer("remote", stream.RemoteAddr()))
+			n.stream.Store(stream)
+			go n.readStream(stream)
+			n.heartbeatNow()
+			continue
+		}
+
+		// The binding request is answered only if the UDP works in both directions
+		if _, err := n.binding(n.gatewayConn(), false); err != nil {
+			continue
+		}
+		zap.L().Info("Gateway reachable via UDP again, close the stream", zap.String("gateway", n.opt.Gateway))
+		n.stream.Store((*api.Stream)(nil))
+		_ = stream.Close()
+		n.heartbeatNow()
+	}
+}
+
+// readStream handles the packets received from the stream until it is closed
+func (n *Node) readStream(stream *api.Stream) {
+	remote := api.StreamAddr(stream.RemoteAddr().String())
+	for {
+		data, err := stream.Read()
+		if err != nil {
+			if n.currentStream() == stream {
+				zap.L().Warn("Stream closed unexpectedly", zap.Error(err))
+				n.stream.Store((*api.Stream)(nil))
+			}
+			return
+		}
+		n.handlePacket(remote, data)
+	}
+}
+
+// heartbeatNow sends the heartbeat immediately, e.g: the transport changed
+func (n *Node) heartbeatNow() {
+	select {
+	case n.heartbeatTrigger <- struct{}{}:
+	default:
+	}
+}
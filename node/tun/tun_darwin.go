@@ -19,6 +19,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 	"syscall"
 	"unsafe"
@@ -76,8 +77,9 @@ type sockaddrCtl struct {
 
 var sockaddrCtlSize uintptr = 32
 
-// NewTUN creates a new TUN device and set the address to the specified address
-func NewTUN(addr string) (Device, error) {
+// NewTUN creates a new TUN device and set the addresses to the specified addresses,
+// the mask of each address is used as the prefix of the virtual network
+func NewTUN(addrs []*net.IPNet) (Device, error) {
 
 	// Supposed to be socket(PF_SYSTEM, SOCK_DGRAM, SYSPROTO_CONTROL), but ...
 	//
@@ -181,22 +183,40 @@ func NewTUN(addr string) (Device, error) {
 		return nil, err
 	}
 
-	// Set the IP address for the virtual interface
-	source := addr
-	ifconfig := exec.Command("ifconfig", name, "inet", source, source, "up", "netmask", "255.255.0.0")
-	if out, err := ifconfig.CombinedOutput(); err != nil {
-		return nil, errors.WithMessagef(err, "output: %s", string(out))
+	for _, addr := range addrs {
+		if err := setAddress(name, addr); err != nil {
+			return nil, err
+		}
 	}
 
-	mask := net.ParseIP(addr).Mask([]byte{0xff, 0xff, 0, 0})
+	return dev, nil
+}
 
-	// Add a static route rule for the virtual interface (workaround for point-to-point in osx)
-	route := exec.Command("route", "-n", "add", "-net", mask.String()+"/16", source)
-	if out, err := route.CombinedOutput(); err != nil {
-		return nil, errors.WithMessagef(err, "output: %s", string(out))
+// setAddress sets the IP address for the virtual interface and routes the network
+// of the address to the interface
+func setAddress(name string, addr *net.IPNet) error {
+	source := addr.IP.String()
+	network := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+
+	var ifconfig, route *exec.Cmd
+	if addr.IP.To4() != nil {
+		netmask := net.IP(addr.Mask).String()
+		ifconfig = exec.Command("ifconfig", name, "inet", source, source, "up", "netmask", netmask)
+		// Add a static route rule for the virtual interface (workaround for point-to-point in osx)
+		route = exec.Command("route", "-n", "add", "-net", network.String(), source)
+	} else {
+		ones, _ := addr.Mask.Size()
+		ifconfig = exec.Command("ifconfig", name, "inet6", source, "prefixlen", strconv.Itoa(ones), "alias", "up")
+		route = exec.Command("route", "-n", "add", "-inet6", network.String(), "-interface", name)
 	}
 
-	return dev, nil
+	if out, err := ifconfig.CombinedOutput(); err != nil {
+		return errors.WithMessagef(err, "output: %s", string(out))
+	}
+	if out, err := route.CombinedOutput(); err != nil {
+		return errors.WithMessagef(err, "output: %s", string(out))
+	}
+	return nil
 }
 
 // tunReadCloser is a hack to work around the first 4 bytes "packet
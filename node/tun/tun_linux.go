@@ -14,7 +14,7 @@
 package tun
 
 import (
-	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -25,8 +25,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// NewTUN creates a new TUN device and set the address to the specified address
-func NewTUN(addr string) (Device, error) {
+// NewTUN creates a new TUN device and set the addresses to the specified addresses,
+// the mask of each address is used as the prefix of the virtual network
+func NewTUN(addrs []*net.IPNet) (Device, error) {
 	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR|syscall.O_NONBLOCK, 0)
 	if err != nil {
 		return nil, err
@@ -90,11 +91,17 @@ func NewTUN(addr string) (Device, error) {
 		ReadWriteCloser: os.NewFile(uintptr(fd), "tun"),
 	}
 
-	// Set the IP address for the virtual interface
-	source := addr
-	ifconfig := exec.Command("ip", "addr", "add", fmt.Sprintf("%s/16", source), "dev", name)
-	if out, err := ifconfig.CombinedOutput(); err != nil {
-		return nil, errors.WithMessagef(err, "output: %s", string(out))
+	// Set the IP addresses for the virtual interface, and the duplicate address
+	// detection of IPv6 is unnecessary because the gateway guarantees uniqueness
+	for _, addr := range addrs {
+		args := []string{"addr", "add", addr.String(), "dev", name}
+		if addr.IP.To4() == nil {
+			args = append([]string{"-6"}, append(args, "nodad")...)
+		}
+		ifconfig := exec.Command("ip", args...)
+		if out, err := ifconfig.CombinedOutput(); err != nil {
+			return nil, errors.WithMessagef(err, "output: %s", string(out))
+		}
 	}
 
 	// Up the virtual interface device
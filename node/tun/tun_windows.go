@@ -20,6 +20,7 @@ package tun
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"sync/atomic"
@@ -75,10 +76,11 @@ func procyield(cycles uint32)
 //go:linkname nanotime runtime.nanotime
 func nanotime() int64
 
-// NewTUN creates a new TUN device and set the address to the specified address
+// NewTUN creates a new TUN device and set the addresses to the specified addresses,
+// the mask of each address is used as the prefix of the virtual network.
 // It will creates a Wintun interface with the given name. Should a Wintun
 // interface with the same name exist, it is reused.
-func NewTUN(addr string) (Device, error) {
+func NewTUN(addrs []*net.IPNet) (Device, error) {
 	// Does an interface with this name already exist?
 	wt, err := wintunPool.OpenAdapter(zetameshIfaceName)
 	if err == nil {
@@ -117,13 +119,22 @@ func NewTUN(addr string) (Device, error) {
 	}
 	dev.readWait = dev.session.ReadWaitEvent()
 
-	// Set the IP address for the virtual interface
-	ifconfig := exec.Command("netsh", "interface", "ip", "set", "address",
-		fmt.Sprintf(`name="%s"`, name),
-		fmt.Sprintf("addr=%s", addr),
-		fmt.Sprintf("mask=%s", "255.255.0.0"), "gateway=none")
-	if out, err := ifconfig.CombinedOutput(); err != nil {
-		return nil, errors.WithMessagef(err, "output: %s", string(out))
+	// Set the IP addresses for the virtual interface
+	for _, addr := range addrs {
+		var ifconfig *exec.Cmd
+		if addr.IP.To4() != nil {
+			ifconfig = exec.Command("netsh", "interface", "ip", "set", "address",
+				fmt.Sprintf(`name="%s"`, name),
+				fmt.Sprintf("addr=%s", addr.IP),
+				fmt.Sprintf("mask=%s", net.IP(addr.Mask)), "gateway=none")
+		} else {
+			ifconfig = exec.Command("netsh", "interface", "ipv6", "add", "address",
+				fmt.Sprintf(`interface="%s"`, name),
+				fmt.Sprintf("address=%s", addr), "store=active")
+		}
+		if out, err := ifconfig.CombinedOutput(); err != nil {
+			return nil, errors.WithMessagef(err, "output: %s", string(out))
+		}
 	}
 
 	return dev, err
@@ -0,0 +1,62 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relay
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	metricsNamespace = "zetamesh"
+	metricsSubsystem = "relay"
+)
+
+// Relay metrics
+var (
+	relayPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "packets_total",
+		Help:      "The total count of packets relayed between the peers.",
+	})
+
+	relayBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "bytes_total",
+		Help:      "The total bytes of the payload relayed between the peers.",
+	})
+
+	relayDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "drops_total",
+		Help:      "The total count of dropped relay packets by reason.",
+	}, []string{"reason"})
+
+	relayBindings = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "bindings",
+		Help:      "The count of peers bound to the relay server.",
+	})
+)
+
+// registerMetrics registers the relay metrics
+func registerMetrics() {
+	prometheus.MustRegister(
+		relayPackets,
+		relayBytes,
+		relayDrops,
+		relayBindings,
+	)
+}
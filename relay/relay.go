@@ -0,0 +1,234 @@
+// Copyright 2020 ZetaMesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relay implements the dedicated relay server, which only forwards the
+// packets between the peers bound to it. The peers are authorized by the tokens
+// issued by the gateway to their identities, and the payload is encrypted
+// end-to-end with the handshakes signed by the identities, so the relay server
+// is not trusted.
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lonng/zetamesh/api"
+	"github.com/lonng/zetamesh/codec"
+	"github.com/lonng/zetamesh/constant"
+	"github.com/lonng/zetamesh/message"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Options represents the CLI arguments of the Zetamesh relay server
+type Options struct {
+	Host    string
+	Port    int
+	Secret  string // The secret shared with the gateway to verify the relay tokens
+	Metrics string // The listen address of the metrics, the metrics are disabled if not specified
+}
+
+// binding represents the UDP address of the peer bound to the relay
+type binding struct {
+	addr      *net.UDPAddr
+	expiry    int64     // The expiry of the relay token in unix nano
+	timestamp int64     // The timestamp of the latest bind, the replayed binds are older
+	updated   time.Time // The binding is removed if not renewed for RelayBindExpire
+}
+
+type server struct {
+	conn     *net.UDPConn
+	secret   string
+	bindings sync.Map   // virtAddr -> *binding
+	mu       sync.Mutex // Serialize the updates of the bindings and the gauge
+}
+
+// Serve serves the relay server
+func Serve(opt Options) error {
+	if opt.Secret == "" {
+		return errors.New("the secret shared with the gateway must be specified")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(opt.Host), Port: opt.Port})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	zap.L().Info("Listen UDP successfully", zap.Stringer("address", conn.LocalAddr()))
+
+	if opt.Metrics != "" {
+		registerMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			if err := http.ListenAndServe(opt.Metrics, mux); err != nil {
+				zap.L().Warn("Serve metrics failed", zap.Error(err))
+			}
+		}()
+	}
+
+	s := &server{conn: conn, secret: opt.Secret}
+	go s.reap(context.Background())
+
+	buffer := make([]byte, constant.MaxBufferSize)
+	for {
+		n, remote, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			// The socket is unusable if the error is permanent, e.g: closed
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return errors.WithStack(err)
+			}
+			zap.L().Error("Read UDP packet failed", zap.Error(err))
+			time.Sleep(constant.ConnectingRetryDuration)
+			continue
+		}
+		if n < 1 {
+			continue
+		}
+		if err := s.process(remote, buffer[:n]); err != nil {
+			zap.L().Debug("Process message failed", zap.Error(err))
+		}
+	}
+}
+
+func (s *server) process(remote *net.UDPAddr, data []byte) error {
+	packetType := message.PacketType(data[0])
+	switch packetType {
+	case message.PacketType_RelayBind:
+		bind := &message.CtrlRelayBind{}
+		if err := proto.Unmarshal(data[1:], bind); err != nil {
+			return errors.WithMessagef(err, "unmarshal message %s failed", packetType)
+		}
+		return s.bind(remote, bind)
+
+	case message.PacketType_Relay:
+		relay := &message.CtrlRelay{}
+		if err := proto.Unmarshal(data[1:], relay); err != nil {
+			return errors.WithMessagef(err, "unmarshal message %s failed", packetType)
+		}
+		return s.forward(remote, relay)
+
+	default:
+		return errors.Errorf("unrecognized message type %s from %s", packetType, remote)
+	}
+}
+
+// bind binds the virtual address to the remote address if the token is issued
+// to the identity which signed the bind, and the timestamp is echoed to measure
+// the round-trip time. The binds replayed by others from other addresses are
+// rejected because they are not newer than the latest one.
+func (s *server) bind(remote *net.UDPAddr, bind *message.CtrlRelayBind) error {
+	ack := &message.CtrlRelayBindAck{Timestamp: bind.Timestamp, Code: message.StatusCode_Success}
+	if err := s.verify(bind); err != nil {
+		zap.L().Debug("Reject relay bind", zap.String("peer", bind.VirtAddress), zap.Stringer("remote", remote), zap.Error(err))
+		ack.Code = message.StatusCode_KeyNotMatched
+	} else {
+		s.mu.Lock()
+		prev, found := s.bindings.Load(bind.VirtAddress)
+		switch {
+		case !found:
+			relayBindings.Inc()
+		case bind.Timestamp <= prev.(*binding).timestamp:
+			ack.Code = message.StatusCode_KeyNotMatched
+		case prev.(*binding).addr.String() != remote.String():
+			zap.L().Info("Rebind peer to new address", zap.String("peer", bind.VirtAddress), zap.Stringer("remote", remote))
+		}
+		if ack.Code == message.StatusCode_Success {
+			s.bindings.Store(bind.VirtAddress, &binding{
+				addr:      remote,
+				expiry:    bind.Expiry,
+				timestamp: bind.Timestamp,
+				updated:   time.Now(),
+			})
+		}
+		s.mu.Unlock()
+	}
+	_, err := s.conn.WriteToUDP(codec.Encode(message.PacketType_RelayBindAck, ack), remote)
+	return errors.WithStack(err)
+}
+
+// verify verifies the token and the signature of the bind
+func (s *server) verify(bind *message.CtrlRelayBind) error {
+	if bind.VirtAddress == "" {
+		return errors.New("empty virtual address")
+	}
+	if !api.VerifyRelayToken(s.secret, bind.VirtAddress, bind.PublicKey, bind.Expiry, bind.Token) {
+		return errors.New("invalid or expired token")
+	}
+	if !api.VerifyIdentity(bind.PublicKey, bind.Signature, api.RelayBindFields(bind)...) {
+		return errors.New("bind not signed by the identity of the token")
+	}
+	skew := time.Since(time.Unix(0, bind.Timestamp))
+	if skew > constant.NonceExpire || skew < -constant.NonceExpire {
+		return errors.New("stale bind")
+	}
+	return nil
+}
+
+// forward forwards the relay packet to the destination, the source must be the
+// peer bound at the remote address, which prevents the peers from impersonating
+// others
+func (s *server) forward(remote *net.UDPAddr, relay *message.CtrlRelay) error {
+	src, found := s.bindings.Load(relay.Source)
+	if !found || src.(*binding).addr.String() != remote.String() {
+		relayDrops.WithLabelValues("unbound_source").Inc()
+		return errors.Errorf("relay packet from %s impersonates peer '%s'", remote, relay.Source)
+	}
+	dst, found := s.bindings.Load(relay.VirtAddress)
+	if !found {
+		relayDrops.WithLabelValues("unbound_destination").Inc()
+		return errors.Errorf("destination peer '%s' is not bound", relay.VirtAddress)
+	}
+
+	relayPackets.Inc()
+	relayBytes.Add(float64(len(relay.Data)))
+	data := codec.Encode(message.PacketType_Relay, &message.CtrlRelay{
+		VirtAddress: relay.VirtAddress,
+		Source:      relay.Source,
+		Data:        relay.Data,
+	})
+	_, err := s.conn.WriteToUDP(data, dst.(*binding).addr)
+	return errors.WithStack(err)
+}
+
+// reap removes the bindings which are not renewed or whose token expired
+func (s *server) reap(ctx context.Context) {
+	ticker := time.NewTicker(constant.RelayBindInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.mu.Lock()
+		s.bindings.Range(func(key, value interface{}) bool {
+			b := value.(*binding)
+			if now.Sub(b.updated) > constant.RelayBindExpire || now.UnixNano() >= b.expiry {
+				s.bindings.Delete(key)
+				relayBindings.Dec()
+				zap.L().Debug("Remove expired binding", zap.String("peer", key.(string)))
+			}
+			return true
+		})
+		s.mu.Unlock()
+	}
+}